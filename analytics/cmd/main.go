@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	_ "time/tzdata" // plant.timezone must resolve on hosts without a zoneinfo database
+)
+
+const usage = `usage: %s <command> [flags]
+
+commands:
+  pr       join inverter power with irradiance and store performance ratio and specific yield
+  soiling  store the daily soiling ratio, soiling rate and cleaning events from soiling sensors
+  report   write the energy, availability and PR report of a period as CSV and HTML
+`
+
+const defaultEnvPath = "/home/admin/workspace/.env"
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "pr":
+		err = runPR(os.Args[2:])
+	case "soiling":
+		err = runSoiling(os.Args[2:])
+	case "report":
+		err = runReport(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Printf(usage, os.Args[0])
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// commonFlags are shared by every command: the config file, the .env with the InfluxDB
+// credentials and a dry run that prints results without writing them.
+type commonFlags struct {
+	configPath *string
+	envPath    *string
+	dryRun     *bool
+}
+
+func addCommonFlags(fs *flag.FlagSet) commonFlags {
+	return commonFlags{
+		configPath: fs.String("configPath", "", "Path to the config file"),
+		envPath:    fs.String("envPath", defaultEnvPath, "Path to the .env file with the InfluxDB settings"),
+		dryRun:     fs.Bool("dry-run", false, "print results without writing them"),
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"analytics/internal"
+
+	dotenv "github.com/joho/godotenv"
+)
+
+// runPR computes the plant performance for one local day. Without -day it covers today up to the
+// last complete interval and stores that interval plus the day-to-date totals, so it can run from
+// cron every interval; with -day it recomputes every interval of that day.
+func runPR(args []string) error {
+	fs := flag.NewFlagSet("pr", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	day := fs.String("day", "", "recompute a whole local day (YYYY-MM-DD) instead of the latest interval")
+	fs.Parse(args)
+	if *common.configPath == "" {
+		return fmt.Errorf("-configPath is required")
+	}
+
+	var cfg internal.Config
+	if err := internal.LoadConfig(*common.configPath, &cfg); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if err := dotenv.Load(*common.envPath); err != nil {
+		return fmt.Errorf("load .env: %w", err)
+	}
+
+	loc := cfg.Location()
+	interval := cfg.Interval()
+	now := time.Now().In(loc)
+	stop := now.Truncate(interval)
+	var start time.Time
+	if *day != "" {
+		d, err := time.ParseInLocation("2006-01-02", *day, loc)
+		if err != nil {
+			return fmt.Errorf("-day: %w", err)
+		}
+		start = d
+		if end := d.AddDate(0, 0, 1); end.Before(stop) {
+			stop = end
+		}
+	} else {
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	}
+	if !stop.After(start) {
+		return fmt.Errorf("nothing to compute between %s and %s", start.Format(time.RFC3339), stop.Format(time.RFC3339))
+	}
+	fmt.Printf("Plant %s: %s .. %s every %s\n", cfg.Plant.Name, start.Format(time.RFC3339), stop.Format(time.RFC3339), interval)
+
+	influx := internal.NewInflux(cfg.Storage)
+	defer influx.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	query := func(src *internal.Source, fn string) (internal.Series, error) {
+		if src == nil {
+			return nil, nil
+		}
+		return influx.Query(ctx, cfg.Sources.Bucket, *src, start, stop, interval, fn)
+	}
+	power, err := query(&cfg.Sources.Power, "mean")
+	if err != nil {
+		return err
+	}
+	irradiance, err := query(&cfg.Sources.Irradiance, "mean")
+	if err != nil {
+		return err
+	}
+	temperature, err := query(cfg.Sources.Temperature, "mean")
+	if err != nil {
+		return err
+	}
+	var energy map[string]float64
+	if cfg.Sources.Energy != nil {
+		counters, err := query(cfg.Sources.Energy, "max")
+		if err != nil {
+			return err
+		}
+		energy = internal.DailyEnergy(counters)
+	}
+
+	windows := internal.Join(power, irradiance, temperature)
+	perf := internal.NewPerformance(cfg)
+	var points []internal.Point
+	for _, w := range windows {
+		if *day != "" || w.Time.Equal(stop) {
+			points = append(points, perf.Instant(w)...)
+		}
+	}
+	points = append(points, perf.Daily(start, windows, energy)...)
+	if len(points) == 0 {
+		fmt.Println("No data to compute performance from")
+		return nil
+	}
+
+	printPoints(points, loc)
+	if *common.dryRun {
+		return nil
+	}
+	influx.Write(points)
+	fmt.Printf("%d points written\n", len(points))
+	return nil
+}
+
+func printPoints(points []internal.Point, loc *time.Location) {
+	for _, p := range points {
+		tags := make([]string, 0, len(p.Tags))
+		for k, v := range p.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		fields := make([]string, 0, len(p.Fields))
+		for k, v := range p.Fields {
+			fields = append(fields, fmt.Sprintf("%s=%.4f", k, v))
+		}
+		sort.Strings(fields)
+		fmt.Printf("[%s] %s %s\n", p.Time.In(loc).Format("2006-01-02 15:04"), strings.Join(tags, ","), strings.Join(fields, " "))
+	}
+}
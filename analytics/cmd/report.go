@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"analytics/internal"
+
+	dotenv "github.com/joho/godotenv"
+)
+
+// runReport writes the energy report of a period: a CSV with the daily and period figures of
+// every inverter and the plant, a CSV of the downtime events and a self-contained HTML page. The
+// data is read from the local InfluxDB or, with -archive, from a line protocol export. SQLite
+// archives are not supported, as the module has no SQLite driver.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	month := fs.String("month", "", "report a calendar month (YYYY-MM); default the previous month")
+	from := fs.String("from", "", "first local day of the period (YYYY-MM-DD), with -to")
+	to := fs.String("to", "", "last local day of the period (YYYY-MM-DD), with -from")
+	archive := fs.String("archive", "", "read a line protocol export (.lp or .lp.gz) instead of InfluxDB; SQLite archives are not supported")
+	outDir := fs.String("out", ".", "directory the report files are written to")
+	fs.Parse(args)
+	if *common.configPath == "" {
+		return fmt.Errorf("-configPath is required")
+	}
+
+	var cfg internal.Config
+	if err := internal.LoadConfig(*common.configPath, &cfg); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	loc := cfg.Location()
+	first, last, err := reportPeriod(*month, *from, *to, time.Now().In(loc), loc)
+	if err != nil {
+		return err
+	}
+	interval := cfg.Interval()
+	start, stop := first, last.AddDate(0, 0, 1)
+	fmt.Printf("Plant %s: report %s .. %s every %s\n", cfg.Plant.Name, first.Format("2006-01-02"), last.Format("2006-01-02"), interval)
+
+	var source internal.Querier
+	if *archive != "" {
+		a, err := internal.NewArchive(*archive)
+		if err != nil {
+			return err
+		}
+		source = a
+	} else {
+		if err := dotenv.Load(*common.envPath); err != nil {
+			return fmt.Errorf("load .env: %w", err)
+		}
+		influx := internal.NewInflux(cfg.Storage)
+		defer influx.Close()
+		source = influx
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	query := func(src *internal.Source, fn string) (internal.Series, error) {
+		if src == nil {
+			return nil, nil
+		}
+		return source.Query(ctx, cfg.Sources.Bucket, *src, start, stop, interval, fn)
+	}
+	power, err := query(&cfg.Sources.Power, "mean")
+	if err != nil {
+		return err
+	}
+	irradiance, err := query(&cfg.Sources.Irradiance, "mean")
+	if err != nil {
+		return err
+	}
+	temperature, err := query(cfg.Sources.Temperature, "mean")
+	if err != nil {
+		return err
+	}
+	counters, err := query(cfg.Sources.Energy, "max")
+	if err != nil {
+		return err
+	}
+
+	report := internal.BuildReport(cfg, first, last, internal.Join(power, irradiance, temperature), counters)
+	if len(report.Totals) == 0 {
+		fmt.Println("No data in the period")
+		return nil
+	}
+	for _, row := range report.Totals {
+		name := row.Inverter
+		if name == "" {
+			name = "plant"
+		}
+		fmt.Printf("%-16s energy=%.1f kWh yield=%.2f kWh/kWp pr=%.4f peak=%.1f kW availability=%.4f downtime=%.0f min events=%d\n",
+			name, row.Energy, row.SpecificYield, row.PR, row.PeakPower, row.Availability, row.Downtime, row.Events)
+	}
+	if *common.dryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return err
+	}
+	base := filepath.Join(*outDir, fmt.Sprintf("%s_%s_%s", cfg.Plant.Name, first.Format("2006-01-02"), last.Format("2006-01-02")))
+	files := []struct {
+		path  string
+		write func(*os.File) error
+	}{
+		{base + ".csv", func(f *os.File) error { return internal.WriteCSV(f, report) }},
+		{base + "_downtime.csv", func(f *os.File) error { return internal.WriteDowntimeCSV(f, report, loc) }},
+		{base + ".html", func(f *os.File) error { return internal.WriteHTML(f, report, loc) }},
+	}
+	for _, file := range files {
+		f, err := os.Create(file.path)
+		if err != nil {
+			return err
+		}
+		if err := file.write(f); err != nil {
+			f.Close()
+			return fmt.Errorf("write %s: %w", file.path, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", file.path)
+	}
+	return nil
+}
+
+// reportPeriod resolves the first and last local day from -month or -from/-to, defaulting to the
+// month before now.
+func reportPeriod(month, from, to string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	switch {
+	case month != "" && (from != "" || to != ""):
+		return time.Time{}, time.Time{}, fmt.Errorf("use either -month or -from/-to")
+	case month != "":
+		m, err := time.ParseInLocation("2006-01", month, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("-month: %w", err)
+		}
+		return m, m.AddDate(0, 1, -1), nil
+	case from != "" || to != "":
+		if from == "" || to == "" {
+			return time.Time{}, time.Time{}, fmt.Errorf("-from and -to go together")
+		}
+		first, err := time.ParseInLocation("2006-01-02", from, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("-from: %w", err)
+		}
+		last, err := time.ParseInLocation("2006-01-02", to, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("-to: %w", err)
+		}
+		if last.Before(first) {
+			return time.Time{}, time.Time{}, fmt.Errorf("-to is before -from")
+		}
+		return first, last, nil
+	}
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	return thisMonth.AddDate(0, -1, 0), thisMonth.AddDate(0, 0, -1), nil
+}
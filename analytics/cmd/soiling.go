@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"analytics/internal"
+
+	dotenv "github.com/joho/godotenv"
+)
+
+// runSoiling computes the daily soiling ratio, soiling rate and cleaning events over the last
+// complete local days. The rate and the days since cleaning depend on the days before, so every
+// run recomputes the whole period and rewrites its points; it can run from cron once a day.
+func runSoiling(args []string) error {
+	fs := flag.NewFlagSet("soiling", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	days := fs.Int("days", 30, "number of complete local days up to yesterday to analyse")
+	fs.Parse(args)
+	if *common.configPath == "" {
+		return fmt.Errorf("-configPath is required")
+	}
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive")
+	}
+
+	var cfg internal.Config
+	if err := internal.LoadConfig(*common.configPath, &cfg); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if len(cfg.Soiling.Sensors) == 0 {
+		return fmt.Errorf("soiling.sensors is empty")
+	}
+	if cfg.Plant.Latitude == 0 && cfg.Plant.Longitude == 0 {
+		return fmt.Errorf("plant.latitude and plant.longitude are needed for solar noon")
+	}
+	if err := dotenv.Load(*common.envPath); err != nil {
+		return fmt.Errorf("load .env: %w", err)
+	}
+
+	loc := cfg.Location()
+	interval := cfg.Interval()
+	now := time.Now().In(loc)
+	stop := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	start := stop.AddDate(0, 0, -*days)
+	fmt.Printf("Plant %s: soiling %s .. %s every %s\n", cfg.Plant.Name, start.Format("2006-01-02"), stop.AddDate(0, 0, -1).Format("2006-01-02"), interval)
+
+	influx := internal.NewInflux(cfg.Storage)
+	defer influx.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	soiling := internal.NewSoiling(cfg)
+	irradiance, err := influx.Query(ctx, cfg.Sources.Bucket, cfg.Sources.Irradiance, start, stop, interval, "mean")
+	if err != nil {
+		return err
+	}
+	stable := soiling.Stable(irradiance)
+	var sensors []internal.SensorDays
+	for _, src := range cfg.Soiling.Sensors {
+		ratio, err := influx.Query(ctx, cfg.Sources.Bucket, src, start, stop, interval, "mean")
+		if err != nil {
+			return err
+		}
+		for device, d := range soiling.Daily(ratio, stable) {
+			sensors = append(sensors, internal.SensorDays{Device: device, Sensor: src.Field, Days: d})
+		}
+	}
+	points := soiling.Points(sensors)
+	if len(points) == 0 {
+		fmt.Printf("No day with enough stable midday intervals (%d windows)\n", len(stable))
+		return nil
+	}
+
+	printPoints(points, loc)
+	if *common.dryRun {
+		return nil
+	}
+	influx.Write(points)
+	fmt.Printf("%d points written to %s\n", len(points), cfg.Soiling.Measurement)
+	return nil
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Querier reads a source aggregated over windows: the local InfluxDB or an archive file.
+type Querier interface {
+	Query(ctx context.Context, bucket string, src Source, start, stop time.Time, every time.Duration, fn string) (Series, error)
+}
+
+// Archive reads the sources from a line protocol file, such as the export of a bucket by
+// `influxd inspect export-lp` (gzip compressed when the name ends in .gz), with nanosecond
+// timestamps. It aggregates like the query of Influx.Query, so reports come out the same offline.
+type Archive struct {
+	path string
+}
+
+func NewArchive(path string) (*Archive, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &Archive{path: path}, nil
+}
+
+// Query scans the file for src between start and stop and aggregates it with fn, mean or max,
+// over windows of every stamped with their end. bucket is not used: an export holds one bucket.
+func (a *Archive) Query(ctx context.Context, bucket string, src Source, start, stop time.Time, every time.Duration, fn string) (Series, error) {
+	if fn != "mean" && fn != "max" {
+		return nil, fmt.Errorf("archive: aggregate %q is not supported", fn)
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(a.path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %w", a.path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	type window struct {
+		sum, max float64
+		n        int
+	}
+	windows := map[string]map[time.Time]*window{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if lineNo%100000 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lp, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s line %d: %w", a.path, lineNo, err)
+		}
+		if lp.measurement != src.Measurement || lp.time.Before(start) || !lp.time.Before(stop) {
+			continue
+		}
+		v, ok := lp.fields[src.Field]
+		if !ok {
+			continue
+		}
+		name := lp.tags[src.Tag]
+		if len(src.Names) > 0 && !slices.Contains(src.Names, name) {
+			continue
+		}
+		// aggregateWindow windows are aligned to the epoch.
+		end := time.Unix(0, lp.time.UnixNano()-lp.time.UnixNano()%int64(every)+int64(every))
+		if end.After(stop) {
+			end = stop
+		}
+		if windows[name] == nil {
+			windows[name] = map[time.Time]*window{}
+		}
+		w := windows[name][end]
+		if w == nil {
+			w = &window{max: math.Inf(-1)}
+			windows[name][end] = w
+		}
+		w.sum += v
+		w.max = math.Max(w.max, v)
+		w.n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("archive %s: %w", a.path, err)
+	}
+
+	series := Series{}
+	for name, byEnd := range windows {
+		samples := make([]Sample, 0, len(byEnd))
+		for end, w := range byEnd {
+			v := w.max
+			if fn == "mean" {
+				v = w.sum / float64(w.n)
+			}
+			samples = append(samples, Sample{Time: end, Value: v})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+		series[name] = samples
+	}
+	return series, nil
+}
+
+// lineProtocol is one parsed line. Only numeric and boolean fields are kept.
+type lineProtocol struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64
+	time        time.Time
+}
+
+func parseLine(line string) (lineProtocol, error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) != 3 {
+		return lineProtocol{}, fmt.Errorf("want measurement, fields and timestamp")
+	}
+	lp := lineProtocol{tags: map[string]string{}, fields: map[string]float64{}}
+	key := splitUnescaped(sections[0], ',', false)
+	lp.measurement = unescape(key[0])
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 {
+			return lineProtocol{}, fmt.Errorf("bad tag %q", tag)
+		}
+		lp.tags[unescape(kv[0])] = unescape(kv[1])
+	}
+	for _, f := range splitUnescaped(sections[1], ',', true) {
+		i := indexUnescaped(f, '=')
+		if i < 0 {
+			return lineProtocol{}, fmt.Errorf("bad field %q", f)
+		}
+		name, raw := unescape(f[:i]), f[i+1:]
+		switch {
+		case strings.HasPrefix(raw, `"`):
+			continue
+		case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+			lp.fields[name] = 1
+		case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+			lp.fields[name] = 0
+		default:
+			raw = strings.TrimRight(raw, "iu")
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return lineProtocol{}, fmt.Errorf("bad field %q", f)
+			}
+			lp.fields[name] = v
+		}
+	}
+	ns, err := strconv.ParseInt(sections[2], 10, 64)
+	if err != nil {
+		return lineProtocol{}, fmt.Errorf("bad timestamp %q", sections[2])
+	}
+	lp.time = time.Unix(0, ns)
+	return lp, nil
+}
+
+// splitUnescaped splits s at sep where it is not escaped with a backslash nor, when quotes is
+// set, inside a double quoted string field value.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	inQuote := false
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			parts = append(parts, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// unescape removes the backslashes escaping commas, spaces and equal signs in names and tags.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, =\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
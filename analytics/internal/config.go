@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"common/solar"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Plant       PlantConfig       `yaml:"plant"`
+	Sources     SourcesConfig     `yaml:"sources"`
+	Performance PerformanceConfig `yaml:"performance"`
+	Soiling     SoilingConfig     `yaml:"soiling"`
+	Report      ReportConfig      `yaml:"report"`
+	Storage     StorageConfig     `yaml:"storage"`
+}
+
+type PlantConfig struct {
+	Name      string     `yaml:"name"`
+	Timezone  string     `yaml:"timezone"` // days are cut at local midnight; default UTC
+	Inverters []Inverter `yaml:"inverters"`
+
+	solar.Site `yaml:",inline"` // latitude and longitude, for solar noon
+}
+
+// Inverter is named as the power source tags it (the logger3000 slave name).
+type Inverter struct {
+	Name          string  `yaml:"name"`
+	DCCapacityKWp float64 `yaml:"dc_capacity_kwp"`
+}
+
+type SourcesConfig struct {
+	Bucket      string  `yaml:"bucket"`
+	Power       Source  `yaml:"power"`       // AC power per inverter, W
+	Energy      *Source `yaml:"energy"`      // optional daily yield counter per inverter, kWh; power is integrated when absent
+	Irradiance  Source  `yaml:"irradiance"`  // plane-of-array irradiance, W/m2; sensors are averaged
+	Temperature *Source `yaml:"temperature"` // optional module temperature, degC; sensors are averaged
+}
+
+// Source is one field in the bucket, split into series by Tag. Names limits the series read;
+// empty reads all of them (the power and energy sources default to the configured inverters).
+type Source struct {
+	Measurement string   `yaml:"measurement"`
+	Field       string   `yaml:"field"`
+	Tag         string   `yaml:"tag"`
+	Names       []string `yaml:"names"`
+}
+
+type PerformanceConfig struct {
+	IntervalMinutes        int     `yaml:"interval_minutes"`        // join window; default 5
+	MinIrradiance          float64 `yaml:"min_irradiance"`          // W/m2 below which no interval PR is written; default 50
+	TemperatureCoefficient float64 `yaml:"temperature_coefficient"` // of Pmax, 1/degC; default -0.0035
+	ReferenceTemperature   float64 `yaml:"reference_temperature"`   // degC; default 25
+}
+
+// SoilingConfig is the section of the soiling command. The daily soiling ratio is taken from the
+// intervals around solar noon with high, steady irradiance, where soiling sensors read best.
+type SoilingConfig struct {
+	Measurement         string   `yaml:"measurement"`           // default soiling_daily
+	Sensors             []Source `yaml:"sensors"`               // soiling ratio fields, %
+	MiddayHours         float64  `yaml:"midday_hours"`          // intervals within this many hours of solar noon; default 2
+	MinIrradiance       float64  `yaml:"min_irradiance"`        // W/m2; default 500
+	MaxIrradianceChange float64  `yaml:"max_irradiance_change"` // largest relative change from the neighbouring intervals; default 0.05
+	MinSamples          int      `yaml:"min_samples"`           // stable intervals needed for a daily value; default 6
+	CleaningStep        float64  `yaml:"cleaning_step"`         // day-to-day rise of the ratio, in points, taken as a cleaning or rain; default 1
+	RateDays            int      `yaml:"rate_days"`             // the soiling rate is fitted over at most this many days since the last cleaning; default 14
+}
+
+// ReportConfig is the section of the report command. An inverter is expected to produce in every
+// interval where the irradiance is above availability_irradiance and at least one inverter reported;
+// it is down in those where it did not report or produced under min_power_fraction of its capacity.
+type ReportConfig struct {
+	AvailabilityIrradiance float64 `yaml:"availability_irradiance"` // W/m2; default 50
+	MinPowerFraction       float64 `yaml:"min_power_fraction"`      // of the DC capacity; default 0.01
+	MinDowntimeMinutes     int     `yaml:"min_downtime_minutes"`    // shorter outages count against availability but are not listed; default 15
+}
+
+type StorageConfig struct {
+	Local  Influxdb2Target `yaml:"local"`
+	Remote Influxdb2Target `yaml:"remote"`
+}
+
+type Influxdb2Target struct {
+	Influxdb2 Influxdb2Config `yaml:"influxdb2"`
+}
+
+type Influxdb2Config struct {
+	Bucket      string `yaml:"bucket"`
+	Measurement string `yaml:"measurement"`
+}
+
+func LoadConfig(path string, out *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	if cfg.Plant.Timezone == "" {
+		cfg.Plant.Timezone = "UTC"
+	}
+	if cfg.Performance.IntervalMinutes <= 0 {
+		cfg.Performance.IntervalMinutes = 5
+	}
+	if cfg.Performance.MinIrradiance == 0 {
+		cfg.Performance.MinIrradiance = 50
+	}
+	if cfg.Performance.TemperatureCoefficient == 0 {
+		cfg.Performance.TemperatureCoefficient = -0.0035
+	}
+	if cfg.Performance.ReferenceTemperature == 0 {
+		cfg.Performance.ReferenceTemperature = 25
+	}
+	if cfg.Soiling.Measurement == "" {
+		cfg.Soiling.Measurement = "soiling_daily"
+	}
+	if cfg.Soiling.MiddayHours <= 0 {
+		cfg.Soiling.MiddayHours = 2
+	}
+	if cfg.Soiling.MinIrradiance == 0 {
+		cfg.Soiling.MinIrradiance = 500
+	}
+	if cfg.Soiling.MaxIrradianceChange <= 0 {
+		cfg.Soiling.MaxIrradianceChange = 0.05
+	}
+	if cfg.Soiling.MinSamples <= 0 {
+		cfg.Soiling.MinSamples = 6
+	}
+	if cfg.Soiling.CleaningStep <= 0 {
+		cfg.Soiling.CleaningStep = 1
+	}
+	if cfg.Soiling.RateDays <= 0 {
+		cfg.Soiling.RateDays = 14
+	}
+	if cfg.Report.AvailabilityIrradiance == 0 {
+		cfg.Report.AvailabilityIrradiance = 50
+	}
+	if cfg.Report.MinPowerFraction <= 0 {
+		cfg.Report.MinPowerFraction = 0.01
+	}
+	if cfg.Report.MinDowntimeMinutes <= 0 {
+		cfg.Report.MinDowntimeMinutes = 15
+	}
+	if len(cfg.Sources.Power.Names) == 0 {
+		cfg.Sources.Power.Names = cfg.InverterNames()
+	}
+	if cfg.Sources.Energy != nil && len(cfg.Sources.Energy.Names) == 0 {
+		cfg.Sources.Energy.Names = cfg.InverterNames()
+	}
+
+	if cfg.Sources.Bucket == "" {
+		return fmt.Errorf("sources.bucket is empty")
+	}
+	if len(cfg.Plant.Inverters) == 0 {
+		return fmt.Errorf("plant.inverters is empty")
+	}
+	for _, inv := range cfg.Plant.Inverters {
+		if inv.DCCapacityKWp <= 0 {
+			return fmt.Errorf("plant.inverters %q: dc_capacity_kwp must be positive", inv.Name)
+		}
+	}
+	for name, src := range map[string]*Source{"power": &cfg.Sources.Power, "energy": cfg.Sources.Energy,
+		"irradiance": &cfg.Sources.Irradiance, "temperature": cfg.Sources.Temperature} {
+		if src == nil {
+			continue
+		}
+		if src.Measurement == "" || src.Field == "" || src.Tag == "" {
+			return fmt.Errorf("sources.%s needs measurement, field and tag", name)
+		}
+	}
+	for i, src := range cfg.Soiling.Sensors {
+		if src.Measurement == "" || src.Field == "" || src.Tag == "" {
+			return fmt.Errorf("soiling.sensors[%d] needs measurement, field and tag", i)
+		}
+	}
+	if _, err := time.LoadLocation(cfg.Plant.Timezone); err != nil {
+		return fmt.Errorf("plant.timezone: %w", err)
+	}
+	if cfg.Storage.Local.Influxdb2.Measurement == "" {
+		return fmt.Errorf("storage.local.influxdb2.measurement is empty")
+	}
+	if cfg.Storage.Local.Influxdb2.Bucket == "" {
+		return fmt.Errorf("storage.local.influxdb2.bucket is empty")
+	}
+	*out = cfg
+	return nil
+}
+
+func (c Config) InverterNames() []string {
+	names := make([]string, len(c.Plant.Inverters))
+	for i, inv := range c.Plant.Inverters {
+		names[i] = inv.Name
+	}
+	return names
+}
+
+// Capacity maps inverter name to DC capacity in kWp.
+func (c Config) Capacity() map[string]float64 {
+	capacity := make(map[string]float64, len(c.Plant.Inverters))
+	for _, inv := range c.Plant.Inverters {
+		capacity[inv.Name] = inv.DCCapacityKWp
+	}
+	return capacity
+}
+
+func (c Config) Location() *time.Location {
+	loc, _ := time.LoadLocation(c.Plant.Timezone)
+	return loc
+}
+
+func (c Config) Interval() time.Duration {
+	return time.Duration(c.Performance.IntervalMinutes) * time.Minute
+}
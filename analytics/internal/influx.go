@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// Sample is one aggregated window of a series, stamped with the window end.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series maps the source tag value (inverter or sensor name) to its samples in time order.
+type Series map[string][]Sample
+
+// Point is one line of results to write, to the storage measurement unless Measurement is set.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]any
+	Time        time.Time
+}
+
+// Influx reads the sources from the local InfluxDB and writes results to the local and remote
+// ones, configured from INFLUX_{HOST,TOKEN,ORG}_{LOCAL,REMOTE} like the pollers.
+type Influx struct {
+	local, remote               influxdb2.Client
+	localWrite, remoteWrite     api.WriteAPI
+	localMeasure, remoteMeasure string
+	query                       api.QueryAPI
+}
+
+func NewInflux(storage StorageConfig) *Influx {
+	in := &Influx{
+		local:         influxdb2.NewClient(os.Getenv("INFLUX_HOST_LOCAL"), os.Getenv("INFLUX_TOKEN_LOCAL")),
+		localMeasure:  storage.Local.Influxdb2.Measurement,
+		remoteMeasure: storage.Remote.Influxdb2.Measurement,
+	}
+	in.query = in.local.QueryAPI(os.Getenv("INFLUX_ORG_LOCAL"))
+	if ok, err := in.local.Ping(context.Background()); ok && err == nil {
+		in.localWrite = in.local.WriteAPI(os.Getenv("INFLUX_ORG_LOCAL"), storage.Local.Influxdb2.Bucket)
+		logErrors("local", in.localWrite)
+	} else {
+		fmt.Println("WARNING: Local InfluxDB not reachable")
+	}
+	if host := os.Getenv("INFLUX_HOST_REMOTE"); host != "" && storage.Remote.Influxdb2.Bucket != "" {
+		in.remote = influxdb2.NewClient(host, os.Getenv("INFLUX_TOKEN_REMOTE"))
+		if ok, err := in.remote.Ping(context.Background()); ok && err == nil {
+			in.remoteWrite = in.remote.WriteAPI(os.Getenv("INFLUX_ORG_REMOTE"), storage.Remote.Influxdb2.Bucket)
+			logErrors("remote", in.remoteWrite)
+		} else {
+			fmt.Println("WARNING: Remote InfluxDB not reachable")
+		}
+	}
+	if in.remoteMeasure == "" {
+		in.remoteMeasure = in.localMeasure
+	}
+	return in
+}
+
+func logErrors(name string, w api.WriteAPI) {
+	errs := w.Errors()
+	go func() {
+		for err := range errs {
+			fmt.Printf("Error writing to %s InfluxDB %v\n", name, err)
+		}
+	}()
+}
+
+// Query reads src between start and stop, aggregated with fn (a Flux aggregate such as mean or
+// max) over windows of every.
+func (in *Influx) Query(ctx context.Context, bucket string, src Source, start, stop time.Time, every time.Duration, fn string) (Series, error) {
+	flux := FluxQuery(bucket, src, start, stop, every, fn)
+	result, err := in.query.Query(ctx, flux)
+	if err != nil {
+		return nil, fmt.Errorf("query %s.%s: %w", src.Measurement, src.Field, err)
+	}
+	defer result.Close()
+	series := Series{}
+	for result.Next() {
+		rec := result.Record()
+		v, ok := toFloat(rec.Value())
+		if !ok {
+			continue
+		}
+		name, _ := rec.ValueByKey(src.Tag).(string)
+		series[name] = append(series[name], Sample{Time: rec.Time(), Value: v})
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("query %s.%s: %w", src.Measurement, src.Field, err)
+	}
+	for _, samples := range series {
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	}
+	return series, nil
+}
+
+// FluxQuery builds the query Influx.Query runs.
+func FluxQuery(bucket string, src Source, start, stop time.Time, every time.Duration, fn string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "from(bucket: %s)\n", strconv.Quote(bucket))
+	fmt.Fprintf(&b, "  |> range(start: %s, stop: %s)\n", start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "  |> filter(fn: (r) => r._measurement == %s and r._field == %s)\n", strconv.Quote(src.Measurement), strconv.Quote(src.Field))
+	if len(src.Names) > 0 {
+		quoted := make([]string, len(src.Names))
+		for i, n := range src.Names {
+			quoted[i] = strconv.Quote(n)
+		}
+		fmt.Fprintf(&b, "  |> filter(fn: (r) => contains(value: r[%s], set: [%s]))\n", strconv.Quote(src.Tag), strings.Join(quoted, ", "))
+	}
+	fmt.Fprintf(&b, "  |> group(columns: [%s])\n", strconv.Quote(src.Tag))
+	fmt.Fprintf(&b, "  |> aggregateWindow(every: %ds, fn: %s, createEmpty: false)\n", int(every.Seconds()), fn)
+	return b.String()
+}
+
+func toFloat(v any) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// Write sends points to the local and remote InfluxDB and flushes them.
+func (in *Influx) Write(points []Point) {
+	for _, p := range points {
+		local, remote := in.localMeasure, in.remoteMeasure
+		if p.Measurement != "" {
+			local, remote = p.Measurement, p.Measurement
+		}
+		if in.localWrite != nil {
+			in.localWrite.WritePoint(influxdb2.NewPoint(local, p.Tags, p.Fields, p.Time))
+		}
+		if in.remoteWrite != nil {
+			in.remoteWrite.WritePoint(influxdb2.NewPoint(remote, p.Tags, p.Fields, p.Time))
+		}
+	}
+	if in.localWrite != nil {
+		in.localWrite.Flush()
+	}
+	if in.remoteWrite != nil {
+		in.remoteWrite.Flush()
+	}
+}
+
+func (in *Influx) Close() {
+	in.local.Close()
+	if in.remote != nil {
+		in.remote.Close()
+	}
+}
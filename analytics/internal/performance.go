@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Window is one interval with inverter power, irradiance and module temperature joined by time.
+type Window struct {
+	Time        time.Time
+	Power       map[string]float64 // W per inverter that reported
+	Irradiance  float64            // W/m2, mean of the sensors that reported; NaN without a reading
+	Temperature float64            // degC, mean of the sensors that reported; NaN without a reading
+}
+
+// Join lines the series up by window time. Every time any source reported gets a window.
+func Join(power, irradiance, temperature Series) []Window {
+	byTime := map[time.Time]*Window{}
+	window := func(t time.Time) *Window {
+		w := byTime[t]
+		if w == nil {
+			w = &Window{Time: t, Power: map[string]float64{}, Irradiance: math.NaN(), Temperature: math.NaN()}
+			byTime[t] = w
+		}
+		return w
+	}
+	for name, samples := range power {
+		for _, s := range samples {
+			window(s.Time).Power[name] = s.Value
+		}
+	}
+	for t, v := range meanByTime(irradiance) {
+		window(t).Irradiance = v
+	}
+	for t, v := range meanByTime(temperature) {
+		window(t).Temperature = v
+	}
+	windows := make([]Window, 0, len(byTime))
+	for _, w := range byTime {
+		windows = append(windows, *w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Time.Before(windows[j].Time) })
+	return windows
+}
+
+// meanByTime averages the sensors of a series that reported in each window.
+func meanByTime(series Series) map[time.Time]float64 {
+	sum := map[time.Time]float64{}
+	count := map[time.Time]int{}
+	for _, samples := range series {
+		for _, s := range samples {
+			sum[s.Time] += s.Value
+			count[s.Time]++
+		}
+	}
+	for t := range sum {
+		sum[t] /= float64(count[t])
+	}
+	return sum
+}
+
+// Performance computes performance ratio and specific yield. PR is the AC energy over the energy
+// the DC capacity would give at the measured irradiance under STC (1000 W/m2); the temperature
+// corrected PR also scales that reference by 1 + gamma*(T - Tref).
+type Performance struct {
+	Capacity      map[string]float64 // kWp per inverter
+	Interval      time.Duration
+	MinIrradiance float64
+	Gamma         float64
+	TRef          float64
+}
+
+func NewPerformance(cfg Config) Performance {
+	return Performance{
+		Capacity:      cfg.Capacity(),
+		Interval:      cfg.Interval(),
+		MinIrradiance: cfg.Performance.MinIrradiance,
+		Gamma:         cfg.Performance.TemperatureCoefficient,
+		TRef:          cfg.Performance.ReferenceTemperature,
+	}
+}
+
+// tempFactor is the relative DC output at module temperature t.
+func (p Performance) tempFactor(t float64) float64 {
+	return 1 + p.Gamma*(t-p.TRef)
+}
+
+// Instant returns the interval PR of each inverter and of the plant for one window. Windows below
+// the minimum irradiance or without irradiance give nothing, since PR is meaningless there.
+func (p Performance) Instant(w Window) []Point {
+	if math.IsNaN(w.Irradiance) || w.Irradiance < p.MinIrradiance {
+		return nil
+	}
+	hasTemp := !math.IsNaN(w.Temperature)
+	var points []Point
+	var plantPower, plantCapacity float64
+	for _, name := range sortedKeys(w.Power) {
+		capacity, ok := p.Capacity[name]
+		if !ok {
+			continue
+		}
+		power := w.Power[name]
+		plantPower += power
+		plantCapacity += capacity
+		pr := power / (capacity * w.Irradiance)
+		fields := map[string]any{"ac_power": power, "specific_power": power / capacity, "pr": pr}
+		if hasTemp {
+			fields["pr_tc"] = pr / p.tempFactor(w.Temperature)
+		}
+		points = append(points, Point{
+			Tags:   map[string]string{"scope": "inverter", "inverter": name, "period": "interval"},
+			Fields: fields,
+			Time:   w.Time,
+		})
+	}
+	if plantCapacity == 0 {
+		return nil
+	}
+	pr := plantPower / (plantCapacity * w.Irradiance)
+	fields := map[string]any{
+		"ac_power":       plantPower,
+		"dc_capacity":    plantCapacity,
+		"specific_power": plantPower / plantCapacity,
+		"poa_irradiance": w.Irradiance,
+		"pr":             pr,
+	}
+	if hasTemp {
+		fields["module_temp"] = w.Temperature
+		fields["pr_tc"] = pr / p.tempFactor(w.Temperature)
+	}
+	return append(points, Point{
+		Tags:   map[string]string{"scope": "plant", "period": "interval"},
+		Fields: fields,
+		Time:   w.Time,
+	})
+}
+
+// dayTotals accumulates one inverter, or the plant, over a day. Energies are in Wh.
+type dayTotals struct {
+	energy   float64 // all windows with power
+	prActual float64 // windows with power and irradiance
+	prRef    float64
+	tcActual float64 // windows with power, irradiance and temperature
+	tcRef    float64
+}
+
+func (t *dayTotals) fields(capacity float64, counter *float64) map[string]any {
+	energy := t.energy / 1000
+	if counter != nil {
+		energy = *counter
+	}
+	fields := map[string]any{"energy": energy, "specific_yield": energy / capacity}
+	if t.prRef > 0 {
+		fields["pr"] = t.prActual / t.prRef
+	}
+	if t.tcRef > 0 {
+		fields["pr_tc"] = t.tcActual / t.tcRef
+	}
+	return fields
+}
+
+// Daily returns the day-to-date energy, specific yield and PR of each inverter and of the plant.
+// energy holds the daily yield counter per inverter when configured; without it the interval
+// power is integrated. day is the local midnight the points are stamped with.
+func (p Performance) Daily(day time.Time, windows []Window, energy map[string]float64) []Point {
+	hours := p.Interval.Hours()
+	totals := map[string]*dayTotals{}
+	var insolation float64 // Wh/m2
+	for _, w := range windows {
+		hasIrr := !math.IsNaN(w.Irradiance)
+		hasTemp := !math.IsNaN(w.Temperature)
+		if hasIrr {
+			insolation += w.Irradiance * hours
+		}
+		for name, power := range w.Power {
+			capacity, ok := p.Capacity[name]
+			if !ok {
+				continue
+			}
+			t := totals[name]
+			if t == nil {
+				t = &dayTotals{}
+				totals[name] = t
+			}
+			t.energy += power * hours
+			if !hasIrr {
+				continue
+			}
+			ref := capacity * w.Irradiance * hours
+			t.prActual += power * hours
+			t.prRef += ref
+			if hasTemp {
+				t.tcActual += power * hours
+				t.tcRef += ref * p.tempFactor(w.Temperature)
+			}
+		}
+	}
+	for name := range energy {
+		if _, ok := p.Capacity[name]; ok && totals[name] == nil {
+			totals[name] = &dayTotals{}
+		}
+	}
+
+	var points []Point
+	plant := dayTotals{}
+	var plantEnergy, plantCapacity float64
+	for _, name := range sortedKeys(totals) {
+		t := totals[name]
+		capacity := p.Capacity[name]
+		var counter *float64
+		if v, ok := energy[name]; ok {
+			counter = &v
+		}
+		fields := t.fields(capacity, counter)
+		plantEnergy += fields["energy"].(float64)
+		plantCapacity += capacity
+		plant.prActual += t.prActual
+		plant.prRef += t.prRef
+		plant.tcActual += t.tcActual
+		plant.tcRef += t.tcRef
+		points = append(points, Point{
+			Tags:   map[string]string{"scope": "inverter", "inverter": name, "period": "day"},
+			Fields: fields,
+			Time:   day,
+		})
+	}
+	if plantCapacity == 0 {
+		return nil
+	}
+	fields := plant.fields(plantCapacity, &plantEnergy)
+	fields["dc_capacity"] = plantCapacity
+	fields["insolation"] = insolation / 1000 // kWh/m2, equal to the reference yield in h
+	return append(points, Point{
+		Tags:   map[string]string{"scope": "plant", "period": "day"},
+		Fields: fields,
+		Time:   day,
+	})
+}
+
+// DailyEnergy takes the largest reading of each inverter's daily yield counter.
+func DailyEnergy(series Series) map[string]float64 {
+	energy := map[string]float64{}
+	for name, samples := range series {
+		for i, s := range samples {
+			if i == 0 || s.Value > energy[name] {
+				energy[name] = s.Value
+			}
+		}
+	}
+	return energy
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+var reportHeader = []string{"day", "scope", "inverter", "energy_kwh", "specific_yield_kwh_kwp", "pr", "pr_tc",
+	"irradiation_kwh_m2", "peak_power_kw", "availability", "downtime_minutes", "downtime_events"}
+
+// WriteCSV writes the daily rows followed by the period totals, whose day column is "total".
+// Values that cannot be computed are left empty.
+func WriteCSV(w io.Writer, r Report) error {
+	cw := csv.NewWriter(w)
+	cw.Write(reportHeader)
+	for _, row := range append(append([]ReportRow(nil), r.Days...), r.Totals...) {
+		day := "total"
+		if !row.Day.IsZero() {
+			day = row.Day.Format("2006-01-02")
+		}
+		scope := "inverter"
+		if row.Inverter == "" {
+			scope = "plant"
+		}
+		cw.Write([]string{day, scope, row.Inverter, csvFloat(row.Energy, 2), csvFloat(row.SpecificYield, 3),
+			csvFloat(row.PR, 4), csvFloat(row.PRTC, 4), csvFloat(row.Irradiation, 3), csvFloat(row.PeakPower, 2),
+			csvFloat(row.Availability, 4), csvFloat(row.Downtime, 0), strconv.Itoa(row.Events)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteDowntimeCSV writes the downtime events with local times.
+func WriteDowntimeCSV(w io.Writer, r Report, loc *time.Location) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"inverter", "start", "end", "downtime_minutes"})
+	for _, e := range r.Events {
+		cw.Write([]string{e.Inverter, e.Start.In(loc).Format(time.RFC3339), e.End.In(loc).Format(time.RFC3339), csvFloat(e.Minutes, 0)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvFloat(v float64, prec int) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
+
+// bar is one day of the energy chart of the HTML report.
+type bar struct {
+	X, Y, W, H float64
+	Label      string // day of the month, under the bar
+	Title      string
+}
+
+// WriteHTML writes the report as a single HTML page with inline styles and an SVG chart of the
+// daily plant energy, so it can be mailed or archived as is.
+func WriteHTML(w io.Writer, r Report, loc *time.Location) error {
+	var plantDays, inverterTotals []ReportRow
+	var plantTotal ReportRow
+	for _, row := range r.Days {
+		if row.Inverter == "" {
+			plantDays = append(plantDays, row)
+		}
+	}
+	for _, row := range r.Totals {
+		if row.Inverter == "" {
+			plantTotal = row
+		} else {
+			inverterTotals = append(inverterTotals, row)
+		}
+	}
+
+	const chartW, chartH = 760.0, 180.0
+	var maxEnergy float64
+	for _, row := range plantDays {
+		if !math.IsNaN(row.Energy) {
+			maxEnergy = math.Max(maxEnergy, row.Energy)
+		}
+	}
+	var bars []bar
+	if n := len(plantDays); n > 0 && maxEnergy > 0 {
+		step := chartW / float64(n)
+		round := func(v float64) float64 { return math.Round(v*10) / 10 }
+		for i, row := range plantDays {
+			h := 0.0
+			if !math.IsNaN(row.Energy) {
+				h = row.Energy / maxEnergy * chartH
+			}
+			bars = append(bars, bar{
+				X: round(float64(i)*step + step*0.1), Y: round(chartH - h), W: round(step * 0.8), H: round(h),
+				Label: row.Day.Format("02"),
+				Title: fmt.Sprintf("%s: %s kWh", row.Day.Format("2006-01-02"), num(row.Energy, 0)),
+			})
+		}
+	}
+
+	return reportTemplate.Execute(w, map[string]any{
+		"Report":    r,
+		"Generated": r.Generated.In(loc).Format("2006-01-02 15:04 MST"),
+		"Plant":     plantTotal,
+		"Inverters": inverterTotals,
+		"Days":      plantDays,
+		"Events":    r.Events,
+		"Loc":       loc,
+		"Bars":      bars,
+		"ChartW":    chartW,
+		"SVGH":      chartH + 16,
+		"TextY":     chartH + 12,
+		"MaxEnergy": maxEnergy,
+	})
+}
+
+// num formats v with prec decimals, or a dash when it cannot be computed.
+func num(v float64, prec int) string {
+	if math.IsNaN(v) {
+		return "–"
+	}
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
+
+func percent(v float64) string {
+	if math.IsNaN(v) {
+		return "–"
+	}
+	return strconv.FormatFloat(v*100, 'f', 1, 64) + " %"
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num":     num,
+	"percent": percent,
+	"mwh":     func(kwh float64) string { return num(kwh/1000, 2) },
+	"day":     func(t time.Time) string { return t.Format("Mon 2006-01-02") },
+	"local":   func(t time.Time, loc *time.Location) string { return t.In(loc).Format("2006-01-02 15:04") },
+	"hours":   func(minutes float64) string { return num(minutes/60, 1) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Report.Plant}} energy report {{.Report.From.Format "2006-01-02"}} – {{.Report.To.Format "2006-01-02"}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; margin: 2em auto; max-width: 880px; }
+h1 { font-size: 1.5em; margin-bottom: 0.2em; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ccc; padding-bottom: 0.2em; }
+.meta { color: #666; font-size: 0.9em; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { padding: 0.3em 0.6em; border-bottom: 1px solid #eee; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f4f6f8; }
+.kpis { display: flex; flex-wrap: wrap; gap: 0.8em; margin-top: 1em; }
+.kpi { flex: 1 1 150px; background: #f4f6f8; border-radius: 4px; padding: 0.6em 0.8em; }
+.kpi b { display: block; font-size: 1.4em; }
+.kpi span { color: #666; font-size: 0.85em; }
+svg text { font-size: 10px; fill: #666; }
+svg rect { fill: #f2a900; }
+</style>
+</head>
+<body>
+<h1>{{.Report.Plant}} energy report</h1>
+<div class="meta">{{.Report.From.Format "2006-01-02"}} to {{.Report.To.Format "2006-01-02"}} · generated {{.Generated}}</div>
+
+<div class="kpis">
+<div class="kpi"><b>{{mwh .Plant.Energy}} MWh</b><span>energy</span></div>
+<div class="kpi"><b>{{num .Plant.SpecificYield 1}} kWh/kWp</b><span>specific yield</span></div>
+<div class="kpi"><b>{{percent .Plant.PR}}</b><span>performance ratio</span></div>
+<div class="kpi"><b>{{num .Plant.Irradiation 1}} kWh/m²</b><span>irradiation (plane of array)</span></div>
+<div class="kpi"><b>{{percent .Plant.Availability}}</b><span>availability</span></div>
+<div class="kpi"><b>{{num .Plant.PeakPower 0}} kW</b><span>peak power</span></div>
+<div class="kpi"><b>{{.Plant.Events}}</b><span>downtime events, {{hours .Plant.Downtime}} inverter hours</span></div>
+</div>
+
+{{if .Bars}}
+<h2>Daily energy</h2>
+<svg width="100%" viewBox="0 0 {{.ChartW}} {{.SVGH}}" role="img" aria-label="daily plant energy">
+{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}"><title>{{.Title}}</title></rect>
+<text x="{{.X}}" y="{{$.TextY}}">{{.Label}}</text>
+{{end}}</svg>
+<div class="meta">bars scaled to the best day, {{num .MaxEnergy 0}} kWh</div>
+{{end}}
+
+<h2>Inverters</h2>
+<table>
+<tr><th>Inverter</th><th>Energy kWh</th><th>Yield kWh/kWp</th><th>PR</th><th>PR temp. corr.</th><th>Peak kW</th><th>Availability</th><th>Downtime h</th><th>Events</th></tr>
+{{range .Inverters}}<tr><td>{{.Inverter}}</td><td>{{num .Energy 0}}</td><td>{{num .SpecificYield 2}}</td><td>{{percent .PR}}</td><td>{{percent .PRTC}}</td><td>{{num .PeakPower 1}}</td><td>{{percent .Availability}}</td><td>{{hours .Downtime}}</td><td>{{.Events}}</td></tr>
+{{end}}<tr><th>Plant</th><th>{{num .Plant.Energy 0}}</th><th>{{num .Plant.SpecificYield 2}}</th><th>{{percent .Plant.PR}}</th><th>{{percent .Plant.PRTC}}</th><th>{{num .Plant.PeakPower 1}}</th><th>{{percent .Plant.Availability}}</th><th>{{hours .Plant.Downtime}}</th><th>{{.Plant.Events}}</th></tr>
+</table>
+
+<h2>Days</h2>
+<table>
+<tr><th>Day</th><th>Energy kWh</th><th>Yield kWh/kWp</th><th>PR</th><th>Irradiation kWh/m²</th><th>Peak kW</th><th>Availability</th><th>Events</th></tr>
+{{range .Days}}<tr><td>{{day .Day}}</td><td>{{num .Energy 0}}</td><td>{{num .SpecificYield 2}}</td><td>{{percent .PR}}</td><td>{{num .Irradiation 2}}</td><td>{{num .PeakPower 1}}</td><td>{{percent .Availability}}</td><td>{{.Events}}</td></tr>
+{{end}}</table>
+
+<h2>Downtime events</h2>
+{{if .Events}}<table>
+<tr><th>Inverter</th><th>Start</th><th>End</th><th>Downtime h</th></tr>
+{{range .Events}}<tr><td>{{.Inverter}}</td><td>{{local .Start $.Loc}}</td><td>{{local .End $.Loc}}</td><td>{{hours .Minutes}}</td></tr>
+{{end}}</table>
+{{else}}<p>No downtime events.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// ReportRow is one inverter, or the plant when Inverter is empty, over one day or, with a zero Day,
+// over the whole period. Values that cannot be computed are NaN.
+type ReportRow struct {
+	Day           time.Time
+	Inverter      string
+	Energy        float64 // kWh
+	SpecificYield float64 // kWh/kWp
+	PR            float64
+	PRTC          float64
+	Irradiation   float64 // kWh/m2 in the plane of array
+	PeakPower     float64 // kW
+	Availability  float64 // share of the production intervals with production; the plant's is weighted by capacity
+	Downtime      float64 // minutes of production intervals without production; the plant's is summed over the inverters
+	Events        int     // downtime events starting in the day or period
+}
+
+// DowntimeEvent is a run of production intervals without production of one inverter. Intervals
+// without irradiance (the night) do not end it.
+type DowntimeEvent struct {
+	Inverter string
+	Start    time.Time
+	End      time.Time
+	Minutes  float64 // production intervals lost
+}
+
+// Report holds the daily and period figures of a plant.
+type Report struct {
+	Plant     string
+	From, To  time.Time // first and last local day
+	Interval  time.Duration
+	Generated time.Time
+	Days      []ReportRow // per day with data: the inverters, then the plant
+	Totals    []ReportRow // the inverters, then the plant
+	Events    []DowntimeEvent
+}
+
+// invStats accumulates the availability and peak power of one inverter, or the plant ("").
+type invStats struct {
+	peak       float64 // W
+	production int
+	down       int
+}
+
+// BuildReport computes the report from the joined windows of the period and, when an energy
+// source is configured, the daily yield counters aggregated with max over the same windows.
+// Windows are stamped with their end and belong to the day they start in.
+func BuildReport(cfg Config, from, to time.Time, windows []Window, counters Series) Report {
+	loc := cfg.Location()
+	interval := cfg.Interval()
+	perf := NewPerformance(cfg)
+	dayOf := func(t time.Time) time.Time {
+		l := t.Add(-interval).In(loc)
+		return time.Date(l.Year(), l.Month(), l.Day(), 0, 0, 0, 0, loc)
+	}
+
+	byDay := map[time.Time][]Window{}
+	for _, w := range windows {
+		d := dayOf(w.Time)
+		byDay[d] = append(byDay[d], w)
+	}
+	var counterDays map[time.Time]Series
+	if counters != nil {
+		counterDays = map[time.Time]Series{}
+		for name, samples := range counters {
+			for _, s := range samples {
+				d := dayOf(s.Time)
+				if counterDays[d] == nil {
+					counterDays[d] = Series{}
+				}
+				counterDays[d][name] = append(counterDays[d][name], s)
+			}
+		}
+	}
+
+	r := Report{Plant: cfg.Plant.Name, From: from, To: to, Interval: interval, Generated: time.Now().In(loc)}
+	r.Events = downtimeEvents(cfg, windows)
+	eventsByDay := map[time.Time]map[string]int{}
+	for _, e := range r.Events {
+		d := dayOf(e.Start.Add(interval))
+		if eventsByDay[d] == nil {
+			eventsByDay[d] = map[string]int{}
+		}
+		eventsByDay[d][e.Inverter]++
+		eventsByDay[d][""]++
+	}
+
+	var periodEnergy map[string]float64
+	if counters != nil {
+		periodEnergy = map[string]float64{}
+	}
+	for d := from.In(loc); !d.After(to); d = d.AddDate(0, 0, 1) { // In: days are map keys, compared with their location
+		var energy map[string]float64
+		if counters != nil {
+			energy = DailyEnergy(counterDays[d])
+			for name, e := range energy {
+				periodEnergy[name] += e
+			}
+		}
+		points := perf.Daily(d, byDay[d], energy)
+		r.Days = append(r.Days, reportRows(cfg, d, points, byDay[d], eventsByDay[d])...)
+	}
+	periodEvents := map[string]int{}
+	for _, e := range r.Events {
+		periodEvents[e.Inverter]++
+		periodEvents[""]++
+	}
+	r.Totals = reportRows(cfg, time.Time{}, perf.Daily(from, windows, periodEnergy), windows, periodEvents)
+	return r
+}
+
+// reportRows completes the Performance.Daily points of a day or period with the peak power,
+// availability and downtime of its windows. Inverters that did not report at all still get a row
+// when they were expected to produce.
+func reportRows(cfg Config, day time.Time, points []Point, windows []Window, events map[string]int) []ReportRow {
+	byName := map[string]Point{}
+	for _, p := range points {
+		byName[p.Tags["inverter"]] = p
+	}
+	plant, ok := byName[""]
+	if !ok {
+		return nil
+	}
+	stats := availability(cfg, windows)
+	capacity := cfg.Capacity()
+	minutes := cfg.Interval().Minutes()
+	irradiation := field(plant, "insolation")
+	row := func(name string, p Point) ReportRow {
+		r := ReportRow{
+			Day:           day,
+			Inverter:      name,
+			Energy:        field(p, "energy"),
+			SpecificYield: field(p, "specific_yield"),
+			PR:            field(p, "pr"),
+			PRTC:          field(p, "pr_tc"),
+			Irradiation:   irradiation,
+			PeakPower:     math.NaN(),
+			Availability:  math.NaN(),
+			Events:        events[name],
+		}
+		if s := stats[name]; s != nil {
+			r.PeakPower = s.peak / 1000
+			r.Downtime = float64(s.down) * minutes
+			if s.production > 0 {
+				r.Availability = float64(s.production-s.down) / float64(s.production)
+			}
+		}
+		return r
+	}
+
+	var rows []ReportRow
+	var weighted, weights, downtime float64
+	for _, name := range sortedKeys(capacity) {
+		p, ok := byName[name]
+		if s := stats[name]; !ok && (s == nil || s.production == 0) {
+			continue
+		}
+		r := row(name, p)
+		downtime += r.Downtime
+		if !math.IsNaN(r.Availability) {
+			weighted += r.Availability * capacity[name]
+			weights += capacity[name]
+		}
+		rows = append(rows, r)
+	}
+	r := row("", plant)
+	r.Downtime = downtime
+	if weights > 0 {
+		r.Availability = weighted / weights
+	}
+	return append(rows, r)
+}
+
+// availability counts, per inverter, the production intervals and those it was down in, and
+// finds the peak power of each inverter and of the plant.
+func availability(cfg Config, windows []Window) map[string]*invStats {
+	capacity := cfg.Capacity()
+	stats := map[string]*invStats{"": {}}
+	for name := range capacity {
+		stats[name] = &invStats{}
+	}
+	for _, w := range windows {
+		var plant float64
+		for name, power := range w.Power {
+			if s, ok := stats[name]; ok && name != "" {
+				s.peak = math.Max(s.peak, power)
+				plant += power
+			}
+		}
+		stats[""].peak = math.Max(stats[""].peak, plant)
+		if !production(cfg, w) {
+			continue
+		}
+		for name, s := range stats {
+			if name == "" {
+				continue
+			}
+			s.production++
+			if down(cfg, w, name, capacity[name]) {
+				s.down++
+			}
+		}
+	}
+	return stats
+}
+
+// production reports whether the inverters are expected to produce in w. Intervals where no
+// inverter reported are data gaps, not downtime.
+func production(cfg Config, w Window) bool {
+	return !math.IsNaN(w.Irradiance) && w.Irradiance >= cfg.Report.AvailabilityIrradiance && len(w.Power) > 0
+}
+
+func down(cfg Config, w Window, name string, capacity float64) bool {
+	power, ok := w.Power[name]
+	return !ok || power < cfg.Report.MinPowerFraction*capacity*1000
+}
+
+// downtimeEvents lists the outages of every inverter lasting at least min_downtime_minutes.
+func downtimeEvents(cfg Config, windows []Window) []DowntimeEvent {
+	interval := cfg.Interval()
+	minMinutes := float64(cfg.Report.MinDowntimeMinutes)
+	var events []DowntimeEvent
+	for _, inv := range cfg.Plant.Inverters {
+		var cur *DowntimeEvent
+		flush := func() {
+			if cur != nil && cur.Minutes >= minMinutes {
+				events = append(events, *cur)
+			}
+			cur = nil
+		}
+		for _, w := range windows {
+			if !production(cfg, w) {
+				continue
+			}
+			if !down(cfg, w, inv.Name, inv.DCCapacityKWp) {
+				flush()
+				continue
+			}
+			if cur == nil {
+				cur = &DowntimeEvent{Inverter: inv.Name, Start: w.Time.Add(-interval)}
+			}
+			cur.End = w.Time
+			cur.Minutes += interval.Minutes()
+		}
+		flush()
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+func field(p Point, name string) float64 {
+	if v, ok := p.Fields[name].(float64); ok {
+		return v
+	}
+	return math.NaN()
+}
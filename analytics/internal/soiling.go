@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"common/solar"
+	"common/stats"
+)
+
+// SoilingDay is the soiling ratio of one sensor, or of the plant, on one local day.
+type SoilingDay struct {
+	Day     time.Time // local midnight
+	Ratio   float64   // %
+	Samples int       // stable intervals the ratio is the median of
+}
+
+// SensorDays are the daily ratios of one soiling ratio field of one device, in day order.
+type SensorDays struct {
+	Device string
+	Sensor string
+	Days   []SoilingDay
+}
+
+// Soiling estimates the daily soiling ratio of each sensor and of the plant, and from the sequence
+// of days the soiling rate and cleaning events. A rise of the ratio by cleaning_step from one day to
+// the next is a cleaning (or rain) and starts a new dry period; the soiling rate is the slope of a
+// least squares line through the ratios of the current dry period.
+type Soiling struct {
+	cfg      SoilingConfig
+	site     solar.Site
+	loc      *time.Location
+	interval time.Duration
+}
+
+func NewSoiling(cfg Config) Soiling {
+	return Soiling{
+		cfg:      cfg.Soiling,
+		site:     cfg.Plant.Site,
+		loc:      cfg.Location(),
+		interval: cfg.Interval(),
+	}
+}
+
+// day is the local midnight starting the day of t.
+func (s Soiling) day(t time.Time) time.Time {
+	l := t.In(s.loc)
+	return time.Date(l.Year(), l.Month(), l.Day(), 0, 0, 0, 0, s.loc)
+}
+
+// Stable returns the windows within midday_hours of solar noon where the mean irradiance is above
+// min_irradiance and changed by at most max_irradiance_change from both neighbouring windows.
+func (s Soiling) Stable(irradiance Series) map[time.Time]bool {
+	mean := meanByTime(irradiance)
+	noons := map[time.Time]time.Time{}
+	stable := map[time.Time]bool{}
+	for t, g := range mean {
+		if g < s.cfg.MinIrradiance {
+			continue
+		}
+		prev, okPrev := mean[t.Add(-s.interval)]
+		next, okNext := mean[t.Add(s.interval)]
+		limit := s.cfg.MaxIrradianceChange * g
+		if !okPrev || !okNext || math.Abs(g-prev) > limit || math.Abs(next-g) > limit {
+			continue
+		}
+		day := s.day(t)
+		noon, ok := noons[day]
+		if !ok {
+			noon = s.site.Noon(day)
+			noons[day] = noon
+		}
+		// Windows are stamped with their end.
+		if math.Abs(t.Add(-s.interval/2).Sub(noon).Hours()) > s.cfg.MiddayHours {
+			continue
+		}
+		stable[t] = true
+	}
+	return stable
+}
+
+// Daily reduces each series of a soiling ratio field to the median of its stable windows per day.
+// Days with fewer than min_samples stable windows, and readings that are not positive (sensor
+// faults), are left out.
+func (s Soiling) Daily(ratio Series, stable map[time.Time]bool) map[string][]SoilingDay {
+	daily := map[string][]SoilingDay{}
+	for name, samples := range ratio {
+		byDay := map[time.Time][]float64{}
+		for _, x := range samples {
+			if stable[x.Time] && x.Value > 0 {
+				d := s.day(x.Time)
+				byDay[d] = append(byDay[d], x.Value)
+			}
+		}
+		var days []SoilingDay
+		for d, values := range byDay {
+			if len(values) >= s.cfg.MinSamples {
+				days = append(days, SoilingDay{Day: d, Ratio: stats.Median(values), Samples: len(values)})
+			}
+		}
+		if len(days) == 0 {
+			continue
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Day.Before(days[j].Day) })
+		daily[name] = days
+	}
+	return daily
+}
+
+// Points returns the daily points of every sensor and of the plant, stamped with the local midnight.
+// The plant ratio is the mean of the sensors and is only computed on days every sensor has a ratio:
+// a mean over whichever sensors reported would step when one drops out or comes back, and trend would
+// take the step for a cleaning.
+func (s Soiling) Points(sensors []SensorDays) []Point {
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].Device != sensors[j].Device {
+			return sensors[i].Device < sensors[j].Device
+		}
+		return sensors[i].Sensor < sensors[j].Sensor
+	})
+	var points []Point
+	sum := map[time.Time]*SoilingDay{}
+	count := map[time.Time]int{}
+	for _, sd := range sensors {
+		tags := map[string]string{"scope": "sensor", "device": sd.Device, "sensor": sd.Sensor}
+		points = append(points, s.trend(sd.Days, tags)...)
+		for _, d := range sd.Days {
+			p := sum[d.Day]
+			if p == nil {
+				p = &SoilingDay{Day: d.Day}
+				sum[d.Day] = p
+			}
+			p.Ratio += d.Ratio
+			p.Samples += d.Samples
+			count[d.Day]++
+		}
+	}
+	plant := make([]SoilingDay, 0, len(sum))
+	for day, p := range sum {
+		if count[day] < len(sensors) {
+			continue
+		}
+		p.Ratio /= float64(count[day])
+		plant = append(plant, *p)
+	}
+	sort.Slice(plant, func(i, j int) bool { return plant[i].Day.Before(plant[j].Day) })
+	return append(points, s.trend(plant, map[string]string{"scope": "plant"})...)
+}
+
+// trend makes the points of a sequence of days. days_since_cleaning and, before the first cleaning
+// in the sequence, the dry period are only known from the first detected cleaning on; the soiling
+// rate needs 3 days in the period.
+func (s Soiling) trend(days []SoilingDay, tags map[string]string) []Point {
+	points := make([]Point, 0, len(days))
+	cleaned := -1 // index of the last cleaning day
+	for i, d := range days {
+		fields := map[string]any{
+			"soiling_ratio":  d.Ratio,
+			"soiling_loss":   100 - d.Ratio,
+			"samples":        float64(d.Samples),
+			"cleaning_event": 0.0,
+		}
+		if i > 0 {
+			if step := d.Ratio - days[i-1].Ratio; step >= s.cfg.CleaningStep {
+				cleaned = i
+				fields["cleaning_event"] = 1.0
+				fields["cleaning_step"] = step
+			}
+		}
+		if cleaned >= 0 {
+			fields["days_since_cleaning"] = daysBetween(days[cleaned].Day, d.Day)
+		}
+		cut := d.Day.AddDate(0, 0, -(s.cfg.RateDays - 1))
+		var xs, ys []float64
+		for j := max(cleaned, 0); j <= i; j++ {
+			if !days[j].Day.Before(cut) {
+				xs = append(xs, daysBetween(d.Day, days[j].Day))
+				ys = append(ys, days[j].Ratio)
+			}
+		}
+		if len(xs) >= 3 {
+			fields["soiling_rate"] = slope(xs, ys) // %/day, negative while soiling builds up
+		}
+		points = append(points, Point{Measurement: s.cfg.Measurement, Tags: tags, Fields: fields, Time: d.Day})
+	}
+	return points
+}
+
+// daysBetween counts calendar days from a to b, across daylight saving changes.
+func daysBetween(a, b time.Time) float64 {
+	return math.Round(b.Sub(a).Hours() / 24)
+}
+
+// slope is the least squares slope of ys over xs.
+func slope(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
@@ -0,0 +1,373 @@
+// Package alerts evaluates alert rules over the values of a poll cycle and notifies when an alert
+// fires or resolves. Variables are named as for site derived fields (<device>.<slave>.<register>
+// in the pollers, <port>.<slave_name>.<register> in moxa-nport) and rules pick them with globs.
+//
+// The pollers run once per cycle, so the state of every rule and series is kept in a JSON file
+// between runs.
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"common/expr"
+	"common/jsonfile"
+	"common/stats"
+)
+
+// Config is the `alerts:` section of a config.
+type Config struct {
+	StateFile string  `yaml:"state_file"` // default: <config>.alerts.json
+	Rules     []Rule  `yaml:"rules"`
+	Outputs   Outputs `yaml:"outputs"`
+}
+
+// Rule raises an alert for every matched series that meets its condition. Exactly one of the
+// conditions is set per rule.
+type Rule struct {
+	Name     string `yaml:"name"`
+	Match    string `yaml:"match"`    // glob over variable names, e.g. "Logger3000.*.total_active_power"
+	Severity string `yaml:"severity"` // default warning
+	When     string `yaml:"when"`     // optional expression over the cycle's variables (plus hour and minute, local time); the rule is only evaluated, and its alerts only stay firing, while it is true
+
+	Above          *float64 `yaml:"above"`
+	Below          *float64 `yaml:"below"`
+	RateAbove      *float64 `yaml:"rate_above"`      // change per minute since the last cycle
+	RateBelow      *float64 `yaml:"rate_below"`      // change per minute since the last cycle
+	PeerDeviation  *float64 `yaml:"peer_deviation"`  // relative distance from the median of the matched series (0.2 = 20%); needs 3 series
+	StuckCycles    int      `yaml:"stuck_cycles"`    // value unchanged (within stuck_tolerance) for this many cycles
+	StuckTolerance float64  `yaml:"stuck_tolerance"` // largest change still counted as unchanged
+	NoDataCycles   int      `yaml:"no_data_cycles"`  // series seen before and missing for this many of its own polling periods
+
+	Hysteresis  float64 `yaml:"hysteresis"`   // threshold conditions resolve this far back inside the threshold
+	HoldSeconds int     `yaml:"hold_seconds"` // the condition must hold this long before the alert fires
+
+	when *expr.Expr
+}
+
+// Event is an alert firing or resolving.
+type Event struct {
+	Rule     string    `json:"rule"`
+	Series   string    `json:"series"`
+	Severity string    `json:"severity"`
+	State    string    `json:"state"` // firing or resolved
+	Value    float64   `json:"value"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Measurement is the InfluxDB measurement events are stored in.
+const Measurement = "alerts"
+
+// Tags and Fields are the InfluxDB point of the event.
+func (e Event) Tags() map[string]string {
+	return map[string]string{"rule": e.Rule, "series": e.Series, "severity": e.Severity, "state": e.State}
+}
+
+func (e Event) Fields() map[string]any {
+	firing := 0
+	if e.State == StateFiring {
+		firing = 1
+	}
+	return map[string]any{"value": e.Value, "message": e.Message, "firing": firing}
+}
+
+// series is the state of one rule over one variable.
+type series struct {
+	Active   bool          `json:"active"`
+	Pending  time.Time     `json:"pending,omitzero"` // condition first met, while waiting out the hold time
+	Last     float64       `json:"last"`
+	LastTime time.Time     `json:"last_time,omitzero"`
+	Same     int           `json:"same,omitempty"`    // cycles without change (stuck)
+	Missing  int           `json:"missing,omitempty"` // polling periods without data (no data)
+	Period   time.Duration `json:"period,omitempty"`  // time between the last two values; zero until seen twice
+}
+
+// Engine evaluates the rules of a config.
+type Engine struct {
+	cfg   Config
+	path  string
+	state map[string]map[string]*series // rule -> variable
+	since map[string]time.Time          // rule -> first cycle it was evaluated in since startup or its when window opened
+}
+
+// Load compiles the rules and reads the state file, named by cfg or next to configPath. It returns
+// nil when no rules are configured.
+func Load(cfg Config, configPath string) (*Engine, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("alert rule %q: %w", r.Name, err)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("alert rule %q defined twice", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	if err := cfg.Outputs.validate(); err != nil {
+		return nil, err
+	}
+	e := &Engine{cfg: cfg, path: cfg.StateFile, state: make(map[string]map[string]*series), since: make(map[string]time.Time)}
+	if e.path == "" {
+		e.path = configPath + ".alerts.json"
+	}
+	data, err := os.ReadFile(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &e.state); err != nil {
+		return nil, fmt.Errorf("alert state %s: %w", e.path, err)
+	}
+	return e, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	if _, err := path.Match(r.Match, ""); err != nil || r.Match == "" {
+		return fmt.Errorf("match %q is not a valid glob", r.Match)
+	}
+	conditions := 0
+	for _, set := range []bool{r.Above != nil, r.Below != nil, r.RateAbove != nil, r.RateBelow != nil,
+		r.PeerDeviation != nil, r.StuckCycles > 0, r.NoDataCycles > 0} {
+		if set {
+			conditions++
+		}
+	}
+	if conditions != 1 {
+		return fmt.Errorf("needs exactly one of above, below, rate_above, rate_below, peer_deviation, stuck_cycles, no_data_cycles")
+	}
+	if r.Severity == "" {
+		r.Severity = "warning"
+	}
+	if r.When != "" {
+		e, err := expr.Compile(r.When)
+		if err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+		r.when = e
+	}
+	return nil
+}
+
+// Outputs returns the configured notification outputs.
+func (e *Engine) Outputs() Outputs {
+	return e.cfg.Outputs
+}
+
+// Evaluate runs every rule over the variables of one cycle and returns the alerts that fired or
+// resolved.
+func (e *Engine) Evaluate(vars map[string]float64, ts time.Time) []Event {
+	if e == nil {
+		return nil
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var events []Event
+	for i := range e.cfg.Rules {
+		r := &e.cfg.Rules[i]
+		if !r.active(vars, ts) {
+			events = append(events, e.suspend(r, ts)...)
+			continue
+		}
+		if _, ok := e.since[r.Name]; !ok {
+			e.since[r.Name] = ts
+		}
+		if e.state[r.Name] == nil {
+			e.state[r.Name] = make(map[string]*series)
+		}
+		states := e.state[r.Name]
+		var matched []string
+		for _, name := range names {
+			if ok, _ := path.Match(r.Match, name); ok {
+				matched = append(matched, name)
+			}
+		}
+		median := math.NaN()
+		if r.PeerDeviation != nil && len(matched) >= 3 {
+			values := make([]float64, len(matched))
+			for i, name := range matched {
+				values[i] = vars[name]
+			}
+			median = stats.Median(values)
+		}
+		present := make(map[string]bool, len(matched))
+		for _, name := range matched {
+			present[name] = true
+			s := states[name]
+			if s == nil {
+				s = &series{}
+				states[name] = s
+			}
+			v := vars[name]
+			bad, clear, msg := r.check(s, v, ts, median)
+			s.Missing = 0
+			if !s.LastTime.IsZero() && ts.After(s.LastTime) {
+				s.Period = ts.Sub(s.LastTime)
+			}
+			s.Last, s.LastTime = v, ts
+			if ev, ok := r.step(s, name, bad, clear, v, msg, ts); ok {
+				events = append(events, ev)
+			}
+		}
+		if r.NoDataCycles > 0 {
+			for name, s := range states {
+				if present[name] {
+					continue
+				}
+				s.Missing = s.missing(e.since[r.Name], ts)
+				msg := fmt.Sprintf("no data for %d cycles", s.Missing)
+				if ev, ok := r.step(s, name, s.Missing >= r.NoDataCycles, false, s.Last, msg, ts); ok {
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Series < events[j].Series })
+	return events
+}
+
+// missing counts the series' own polling periods without data at ts, so a device polled less often
+// than the others on its bus is not missing from the cycles between its polls. Nothing counts until
+// the series was seen twice and its period is known; the state file keeps it across restarts. Time
+// before since, while the poller was down or the rule suspended, is left out.
+func (s *series) missing(since, ts time.Time) int {
+	if s.Period <= 0 {
+		return 0
+	}
+	if s.LastTime.After(since) {
+		since = s.LastTime
+	}
+	return int(ts.Sub(since) / s.Period)
+}
+
+// suspend resolves the active alerts of a rule whose when expression is false, so an alert raised
+// just before the end of its window does not stay firing until the window opens again. Pending hold
+// times and stuck and no data counts start over.
+func (e *Engine) suspend(r *Rule, ts time.Time) []Event {
+	delete(e.since, r.Name)
+	var events []Event
+	for name, s := range e.state[r.Name] {
+		s.Pending, s.Same, s.Missing = time.Time{}, 0, 0
+		if !s.Active {
+			continue
+		}
+		s.Active = false
+		events = append(events, Event{Rule: r.Name, Series: name, Severity: r.Severity, State: StateResolved,
+			Value: s.Last, Message: name + ": resolved, outside " + r.When, Time: ts})
+	}
+	return events
+}
+
+// active evaluates the rule's when expression. A missing variable counts as false.
+func (r *Rule) active(vars map[string]float64, ts time.Time) bool {
+	if r.when == nil {
+		return true
+	}
+	scope := make(map[string]float64, len(vars)+2)
+	for k, v := range vars {
+		scope[k] = v
+	}
+	local := ts.Local()
+	scope["hour"] = float64(local.Hour())
+	scope["minute"] = float64(local.Minute())
+	v, err := r.when.Eval(scope)
+	return err == nil && v != 0
+}
+
+// check reports whether the series meets the rule's condition (bad) and whether it is far enough
+// from it to resolve (clear). Neither is set when it cannot be told this cycle.
+func (r *Rule) check(s *series, v float64, ts time.Time, median float64) (bad, clear bool, msg string) {
+	h := r.Hysteresis
+	switch {
+	case r.Above != nil:
+		return v > *r.Above, v <= *r.Above-h, fmt.Sprintf("%g above %g", v, *r.Above)
+	case r.Below != nil:
+		return v < *r.Below, v >= *r.Below+h, fmt.Sprintf("%g below %g", v, *r.Below)
+	case r.RateAbove != nil, r.RateBelow != nil:
+		if s.LastTime.IsZero() || !ts.After(s.LastTime) {
+			return false, false, ""
+		}
+		rate := (v - s.Last) / ts.Sub(s.LastTime).Minutes()
+		if r.RateAbove != nil {
+			return rate > *r.RateAbove, rate <= *r.RateAbove-h, fmt.Sprintf("rate %.4g/min above %g", rate, *r.RateAbove)
+		}
+		return rate < *r.RateBelow, rate >= *r.RateBelow+h, fmt.Sprintf("rate %.4g/min below %g", rate, *r.RateBelow)
+	case r.PeerDeviation != nil:
+		if math.IsNaN(median) || median == 0 {
+			return false, false, ""
+		}
+		dev := math.Abs(v-median) / math.Abs(median)
+		return dev > *r.PeerDeviation, dev <= *r.PeerDeviation-h,
+			fmt.Sprintf("%g deviates %.0f%% from the peer median %g", v, dev*100, median)
+	case r.StuckCycles > 0:
+		if !s.LastTime.IsZero() && math.Abs(v-s.Last) <= r.StuckTolerance {
+			s.Same++
+		} else {
+			s.Same = 0
+		}
+		return s.Same >= r.StuckCycles, s.Same == 0, fmt.Sprintf("%g unchanged for %d cycles", v, s.Same)
+	case r.NoDataCycles > 0:
+		return false, true, ""
+	}
+	return false, false, ""
+}
+
+// step advances the alert state of one series and returns the event, if any.
+func (r *Rule) step(s *series, name string, bad, clear bool, v float64, msg string, ts time.Time) (Event, bool) {
+	ev := Event{Rule: r.Name, Series: name, Severity: r.Severity, Value: v, Message: name + ": " + msg, Time: ts}
+	if s.Active {
+		if clear {
+			s.Active = false
+			ev.State = StateResolved
+			ev.Message = name + ": back to normal"
+			return ev, true
+		}
+		return ev, false
+	}
+	if !bad {
+		s.Pending = time.Time{}
+		return ev, false
+	}
+	if s.Pending.IsZero() {
+		s.Pending = ts
+	}
+	if ts.Sub(s.Pending) < time.Duration(r.HoldSeconds)*time.Second {
+		return ev, false
+	}
+	s.Active = true
+	s.Pending = time.Time{}
+	ev.State = StateFiring
+	return ev, true
+}
+
+// Save writes the state file, replacing it atomically.
+func (e *Engine) Save() error {
+	if e == nil {
+		return nil
+	}
+	return jsonfile.Save(e.path, e.state)
+}
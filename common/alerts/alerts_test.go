@@ -0,0 +1,68 @@
+package alerts
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// TestNoDataOwnPeriod runs 1 s bus cycles with a pyranometer in every cycle and a DustIQ polled
+// every 8 s. The DustIQ is only missing once it skips its own polls.
+func TestNoDataOwnPeriod(t *testing.T) {
+	e, err := Load(Config{Rules: []Rule{{Name: "no_data", Match: "com1.*.irr", NoDataCycles: 3}}},
+		filepath.Join(t.TempDir(), "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fired []string
+	for i := 0; i < 60; i++ {
+		vars := map[string]float64{"com1.smp.irr": 800}
+		if i%8 == 0 && i < 40 {
+			vars["com1.dustiq.irr"] = 790
+		}
+		for _, ev := range e.Evaluate(vars, t0.Add(time.Duration(i)*time.Second)) {
+			fired = append(fired, fmt.Sprintf("%s %s at %d", ev.Series, ev.State, i))
+		}
+	}
+	// Last heard at 32 s, missing three of its 8 s periods at 56 s.
+	want := "com1.dustiq.irr firing at 56"
+	if len(fired) != 1 || fired[0] != want {
+		t.Errorf("events = %q, want %q", fired, want)
+	}
+}
+
+// TestNoDataAfterRestart leaves out the time the poller was down: the state file still holds the
+// series' last value, but it is only missing once it skips its periods after startup.
+func TestNoDataAfterRestart(t *testing.T) {
+	cfg := Config{
+		StateFile: filepath.Join(t.TempDir(), "alerts.json"),
+		Rules:     []Rule{{Name: "no_data", Match: "*.irr", NoDataCycles: 3}},
+	}
+	e, err := Load(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Evaluate(map[string]float64{"a.irr": 1, "b.irr": 1}, t0)
+	e.Evaluate(map[string]float64{"a.irr": 1, "b.irr": 1}, t0.Add(time.Second))
+	if err := e.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = Load(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := t0.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if events := e.Evaluate(map[string]float64{"a.irr": 1}, start.Add(time.Duration(i)*time.Second)); len(events) != 0 {
+			t.Fatalf("cycle %d after the restart: events = %v, want none", i, events)
+		}
+	}
+	events := e.Evaluate(map[string]float64{"a.irr": 1}, start.Add(3*time.Second))
+	if len(events) != 1 || events[0].Series != "b.irr" || events[0].State != StateFiring {
+		t.Errorf("events = %v, want b.irr firing", events)
+	}
+}
@@ -0,0 +1,161 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outputs are the destinations of alert events. InfluxDB is written by the caller through its own
+// storage, as the Measurement measurement.
+type Outputs struct {
+	Webhook *WebhookOutput `yaml:"webhook"`
+	SMTP    *SMTPOutput    `yaml:"smtp"`
+	File    *FileOutput    `yaml:"file"`
+	Influx  bool           `yaml:"influx"`
+}
+
+// WebhookOutput posts each event as JSON.
+type WebhookOutput struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// SMTPOutput mails the events of a cycle in one message. The password is read from the
+// environment variable named by password_env; without a username no authentication is used.
+type SMTPOutput struct {
+	Host        string   `yaml:"host"`
+	Port        int      `yaml:"port"` // default 25
+	From        string   `yaml:"from"`
+	To          []string `yaml:"to"`
+	Username    string   `yaml:"username"`
+	PasswordEnv string   `yaml:"password_env"`
+	Subject     string   `yaml:"subject"` // prefix, default "[alerts]"
+}
+
+// FileOutput appends each event as a JSON line.
+type FileOutput struct {
+	Path string `yaml:"path"`
+}
+
+func (o Outputs) validate() error {
+	if o.Webhook != nil && o.Webhook.URL == "" {
+		return fmt.Errorf("alerts.outputs.webhook: url is empty")
+	}
+	if o.SMTP != nil && (o.SMTP.Host == "" || o.SMTP.From == "" || len(o.SMTP.To) == 0) {
+		return fmt.Errorf("alerts.outputs.smtp needs host, from and to")
+	}
+	if o.File != nil && o.File.Path == "" {
+		return fmt.Errorf("alerts.outputs.file: path is empty")
+	}
+	return nil
+}
+
+// Send delivers events to the webhook, SMTP and file outputs. Every output is tried; the errors are
+// joined.
+func (o Outputs) Send(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var errs []error
+	if o.File != nil {
+		if err := o.File.send(events); err != nil {
+			errs = append(errs, fmt.Errorf("alerts file: %w", err))
+		}
+	}
+	if o.Webhook != nil {
+		if err := o.Webhook.send(events); err != nil {
+			errs = append(errs, fmt.Errorf("alerts webhook: %w", err))
+		}
+	}
+	if o.SMTP != nil {
+		if err := o.SMTP.send(events); err != nil {
+			errs = append(errs, fmt.Errorf("alerts smtp: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *FileOutput) send(events []Event) error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w *WebhookOutput) send(events []Event) error {
+	for _, ev := range events {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range w.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s: %s", w.URL, resp.Status)
+		}
+	}
+	return nil
+}
+
+func (s *SMTPOutput) send(events []Event) error {
+	port := s.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(port))
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, os.Getenv(s.PasswordEnv), s.Host)
+	}
+	prefix := s.Subject
+	if prefix == "" {
+		prefix = "[alerts]"
+	}
+	firing := 0
+	var body strings.Builder
+	for _, ev := range events {
+		if ev.State == StateFiring {
+			firing++
+		}
+		fmt.Fprintf(&body, "%s  %-8s %-8s %s  %s\r\n", ev.Time.Format(time.RFC3339), strings.ToUpper(ev.State), ev.Severity, ev.Rule, ev.Message)
+	}
+	subject := fmt.Sprintf("%s %d firing, %d resolved", prefix, firing, len(events)-firing)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body.String())
+	return smtp.SendMail(addr, auth, s.From, s.To, []byte(msg.String()))
+}
@@ -0,0 +1,186 @@
+// Package counters turns cumulative and power registers into per-interval values for the Modbus
+// TCP pollers. The pollers run once per interval, so the last reading of every register is kept
+// in a JSON state file between runs.
+package counters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"common/jsonfile"
+)
+
+// Register kinds, set with `kind:` on a register.
+const (
+	// KindCounter is a cumulative register; it also yields <name>_delta since the last run and
+	// <name>_rate, the delta per hour (kW for a kWh counter).
+	KindCounter = "counter"
+	// KindPower is an instantaneous power register; it is integrated into <name>_energy and
+	// <name>_energy_delta, in the register unit times hours.
+	KindPower = "power"
+)
+
+// ValidKind reports whether kind is empty or one of the register kinds.
+func ValidKind(kind string) bool {
+	return kind == "" || kind == KindCounter || kind == KindPower
+}
+
+const defaultMaxGap = 15 * time.Minute
+
+// Config is the `counters:` section of a poller config.
+type Config struct {
+	StateFile     string `yaml:"state_file"`      // default: <config>.counters.json
+	MaxGapMinutes int    `yaml:"max_gap_minutes"` // readings further apart only rebaseline; default 15
+}
+
+// Output is one value derived from a counter or power register.
+type Output struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+type entry struct {
+	Value  float64   `json:"value"`            // last reading
+	Energy float64   `json:"energy,omitempty"` // power registers: energy integrated so far
+	Time   time.Time `json:"time"`
+}
+
+// State holds the last reading of every tracked register.
+type State struct {
+	path    string
+	maxGap  time.Duration
+	entries map[string]entry
+}
+
+// Load reads the state file named by cfg, or next to configPath when it sets none. A missing file
+// starts empty, so the first run only records baselines.
+func Load(cfg Config, configPath string) (*State, error) {
+	s := &State{path: cfg.StateFile, maxGap: defaultMaxGap, entries: make(map[string]entry)}
+	if s.path == "" {
+		s.path = configPath + ".counters.json"
+	}
+	if cfg.MaxGapMinutes > 0 {
+		s.maxGap = time.Duration(cfg.MaxGapMinutes) * time.Minute
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("counter state %s: %w", s.path, err)
+	}
+	return s, nil
+}
+
+// Save writes the state file, replacing it atomically.
+func (s *State) Save() error {
+	return jsonfile.Save(s.path, s.entries)
+}
+
+// Update records a reading of the register identified by key and returns the values derived from
+// it. note explains readings that yield nothing or were treated specially (baseline, gap, reset,
+// rollover); it is empty otherwise. width is the datatype width in bits (see Width) and gain the
+// factor applied to the raw register, both used to detect rollover.
+func (s *State) Update(key, name, kind, unit string, value, gain float64, width int, ts time.Time) (out []Output, note string) {
+	last, seen := s.entries[key]
+	next := entry{Value: value, Energy: last.Energy, Time: ts}
+	defer func() { s.entries[key] = next }()
+
+	if !seen {
+		return nil, "baseline"
+	}
+	dt := ts.Sub(last.Time)
+	if dt <= 0 {
+		next = last
+		return nil, "no time elapsed since " + last.Time.Format(time.RFC3339)
+	}
+	if dt > s.maxGap {
+		return nil, fmt.Sprintf("gap of %s, rebaselined", dt.Round(time.Second))
+	}
+	hours := dt.Hours()
+
+	switch kind {
+	case KindCounter:
+		delta := value - last.Value
+		if delta < 0 {
+			delta, note = wrap(last.Value, value, gain, width)
+		}
+		return []Output{
+			{Name: name + "_delta", Unit: unit, Value: delta},
+			{Name: name + "_rate", Unit: rateUnit(unit), Value: delta / hours},
+		}, note
+	case KindPower:
+		delta := (last.Value + value) / 2 * hours
+		next.Energy = last.Energy + delta
+		return []Output{
+			{Name: name + "_energy", Unit: unit + "h", Value: next.Energy},
+			{Name: name + "_energy_delta", Unit: unit + "h", Value: delta},
+		}, ""
+	}
+	return nil, "unknown kind " + kind
+}
+
+// wrap resolves a counter that went down. A reading near the top of the datatype range followed by
+// one near the bottom is a rollover and counts the distance across it; anything else is a device
+// reset (such as the Logger3000 daily counters at midnight), where the counter restarted from
+// zero and the new reading is the delta.
+func wrap(last, value, gain float64, width int) (float64, string) {
+	if gain <= 0 {
+		gain = 1
+	}
+	if width > 0 && width <= 64 {
+		span := math.Ldexp(1, width)
+		u0 := math.Mod(last/gain, span)
+		if u0 < 0 {
+			u0 += span
+		}
+		u1 := math.Mod(value/gain, span)
+		if u1 < 0 {
+			u1 += span
+		}
+		if u1 >= u0 {
+			// Signed counters cross from the largest positive to the most negative value.
+			return (u1 - u0) * gain, "rollover"
+		}
+		if u0 >= span*3/4 && u1 < span/4 {
+			return (span - u0 + u1) * gain, "rollover"
+		}
+	}
+	if value < 0 {
+		return 0, "reset"
+	}
+	return value, "reset"
+}
+
+func rateUnit(unit string) string {
+	if unit == "" {
+		return "1/h"
+	}
+	if n := len(unit); n > 1 && unit[n-1] == 'h' {
+		return unit[:n-1] // kWh per hour is kW
+	}
+	return unit + "/h"
+}
+
+// Width is the width in bits of a poller datatype, or 0 when it cannot roll over (floats).
+func Width(datatype string) int {
+	switch datatype {
+	case "U8":
+		return 8
+	case "U16", "S16":
+		return 16
+	case "U32", "S32", "U32LE", "S32LE":
+		return 32
+	case "U64BE", "S64BE":
+		return 64
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package counters
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func TestCounterUpdate(t *testing.T) {
+	tests := []struct {
+		name         string
+		datatype     string
+		gain         float64
+		last, value  float64
+		dt           time.Duration
+		delta, rate  float64
+		note         string
+		noOutput     bool
+		maxGapMinute int
+	}{
+		{name: "increase", datatype: "U32", gain: 1, last: 100, value: 110, dt: 15 * time.Minute, delta: 10, rate: 40},
+		{name: "unchanged", datatype: "U32", gain: 1, last: 100, value: 100, dt: 15 * time.Minute, delta: 0, rate: 0},
+		{name: "u16 rollover", datatype: "U16", gain: 1, last: 65530, value: 4, dt: 15 * time.Minute, delta: 10, rate: 40, note: "rollover"},
+		{name: "u32 rollover with gain", datatype: "U32", gain: 0.1, last: 429496729, value: 0.5, dt: 15 * time.Minute, delta: 1.1, rate: 4.4, note: "rollover"},
+		{name: "s16 crosses to negative", datatype: "S16", gain: 1, last: 32767, value: -32768, dt: 15 * time.Minute, delta: 1, rate: 4, note: "rollover"},
+		{name: "daily counter reset", datatype: "U32", gain: 1, last: 1234, value: 5, dt: 15 * time.Minute, delta: 5, rate: 20, note: "reset"},
+		{name: "u16 drop far from the top is a reset", datatype: "U16", gain: 1, last: 30000, value: 20, dt: 15 * time.Minute, delta: 20, rate: 80, note: "reset"},
+		{name: "float counter reset", datatype: "F32", gain: 1, last: 99.5, value: 0.5, dt: 15 * time.Minute, delta: 0.5, rate: 2, note: "reset"},
+		{name: "reset to a negative reading", datatype: "F32", gain: 1, last: 10, value: -1, dt: 15 * time.Minute, delta: 0, rate: 0, note: "reset"},
+		{name: "gap rebaselines", datatype: "U32", gain: 1, last: 100, value: 500, dt: 20 * time.Minute, note: "gap of 20m0s, rebaselined", noOutput: true},
+		{name: "configured max gap", datatype: "U32", gain: 1, last: 100, value: 500, dt: 20 * time.Minute, delta: 400, rate: 1200, maxGapMinute: 60},
+		{name: "no time elapsed", datatype: "U32", gain: 1, last: 100, value: 500, dt: 0, note: "no time elapsed", noOutput: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Load(Config{MaxGapMinutes: tt.maxGapMinute}, filepath.Join(t.TempDir(), "config.yml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			width := Width(tt.datatype)
+			out, note := s.Update("dev.slave.energy", "energy", KindCounter, "kWh", tt.last, tt.gain, width, t0)
+			if out != nil || note != "baseline" {
+				t.Fatalf("first reading = %v, %q, want baseline", out, note)
+			}
+			out, note = s.Update("dev.slave.energy", "energy", KindCounter, "kWh", tt.value, tt.gain, width, t0.Add(tt.dt))
+			if !strings.HasPrefix(note, tt.note) || (tt.note == "" && note != "") {
+				t.Errorf("note = %q, want %q", note, tt.note)
+			}
+			if tt.noOutput {
+				if out != nil {
+					t.Errorf("out = %v, want none", out)
+				}
+				return
+			}
+			if len(out) != 2 || out[0].Name != "energy_delta" || out[1].Name != "energy_rate" {
+				t.Fatalf("out = %v, want energy_delta and energy_rate", out)
+			}
+			if math.Abs(out[0].Value-tt.delta) > 1e-6 {
+				t.Errorf("delta = %v, want %v", out[0].Value, tt.delta)
+			}
+			if math.Abs(out[1].Value-tt.rate) > 1e-6 {
+				t.Errorf("rate = %v, want %v", out[1].Value, tt.rate)
+			}
+			if out[1].Unit != "kW" {
+				t.Errorf("rate unit = %q, want kW", out[1].Unit)
+			}
+		})
+	}
+}
+
+func TestNoTimeElapsedKeepsLastReading(t *testing.T) {
+	s, err := Load(Config{}, filepath.Join(t.TempDir(), "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("k", "energy", KindCounter, "kWh", 100, 1, 32, t0)
+	s.Update("k", "energy", KindCounter, "kWh", 500, 1, 32, t0)
+	out, _ := s.Update("k", "energy", KindCounter, "kWh", 110, 1, 32, t0.Add(10*time.Minute))
+	if len(out) == 0 || out[0].Value != 10 {
+		t.Errorf("out = %v, want a delta of 10 from the first reading", out)
+	}
+}
+
+func TestPowerIntegration(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Load(Config{StateFile: filepath.Join(dir, "state.json"), MaxGapMinutes: 60}, filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("p", "p_ac", KindPower, "W", 1000, 1, 0, t0)
+	out, _ := s.Update("p", "p_ac", KindPower, "W", 3000, 1, 0, t0.Add(30*time.Minute))
+	if len(out) != 2 || out[0].Value != 1000 || out[1].Value != 1000 || out[0].Unit != "Wh" {
+		t.Fatalf("out = %v, want 1000 Wh energy and delta", out)
+	}
+
+	// The integrated energy survives a restart.
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Load(Config{StateFile: filepath.Join(dir, "state.json"), MaxGapMinutes: 60}, filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = s.Update("p", "p_ac", KindPower, "W", 3000, 1, 0, t0.Add(45*time.Minute))
+	if len(out) != 2 || out[0].Value != 1750 || out[1].Value != 750 {
+		t.Errorf("out = %v, want 1750 Wh energy and 750 Wh delta", out)
+	}
+}
+
+func TestRateUnit(t *testing.T) {
+	for unit, want := range map[string]string{"kWh": "kW", "Wh": "W", "": "1/h", "m3": "m3/h", "h": "h/h"} {
+		if got := rateUnit(unit); got != want {
+			t.Errorf("rateUnit(%q) = %q, want %q", unit, got, want)
+		}
+	}
+}
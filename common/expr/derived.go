@@ -0,0 +1,101 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Field is a derived field as configured under `derived:`.
+type Field struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+	Unit string `yaml:"unit"` // optional
+}
+
+// Result is the value of one derived field in a cycle.
+type Result struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Set is a compiled list of derived fields. Fields are evaluated in order and each result is
+// visible to the fields after it.
+type Set struct {
+	fields []Field
+	exprs  []*Expr
+}
+
+// CompileSet compiles fields. A nil set is returned for an empty list.
+func CompileSet(fields []Field) (*Set, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	s := &Set{fields: fields}
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("derived field with expr %q has no name", f.Expr)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("derived field %q defined twice", f.Name)
+		}
+		seen[f.Name] = true
+		e, err := Compile(f.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("derived field %q: %w", f.Name, err)
+		}
+		s.exprs = append(s.exprs, e)
+	}
+	return s, nil
+}
+
+// Fields is a `derived:` list in a config. It compiles as the config is decoded, so expression
+// errors are reported when the config is loaded.
+type Fields struct {
+	set *Set
+}
+
+// UnmarshalYAML decodes and compiles the list.
+func (f *Fields) UnmarshalYAML(node *yaml.Node) error {
+	var fields []Field
+	if err := node.Decode(&fields); err != nil {
+		return err
+	}
+	set, err := CompileSet(fields)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	f.set = set
+	return nil
+}
+
+// Eval computes the fields from vars, as Set.Eval does.
+func (f Fields) Eval(vars map[string]float64) ([]Result, error) {
+	return f.set.Eval(vars)
+}
+
+// Eval computes the fields from vars and adds each result to vars. Fields that cannot be computed
+// this cycle are skipped and reported in the returned error.
+func (s *Set) Eval(vars map[string]float64) ([]Result, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var (
+		results []Result
+		errs    []error
+	)
+	for i, e := range s.exprs {
+		f := s.fields[i]
+		v, err := e.Eval(vars)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Name, err))
+			continue
+		}
+		vars[f.Name] = v
+		results = append(results, Result{Name: f.Name, Unit: f.Unit, Value: v})
+	}
+	return results, errors.Join(errs...)
+}
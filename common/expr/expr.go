@@ -0,0 +1,520 @@
+// Package expr evaluates the arithmetic expressions of derived fields.
+//
+// An expression combines numbers and variable names with + - * / % ^, comparisons (== != < <= > >=),
+// logic (&& || !), the conditional `cond ? a : b` and the functions min, max, avg, sum, abs, sqrt,
+// round and if(cond, a, b). Comparisons and logic yield 1 or 0; any non-zero value is true.
+// Variable names may contain dots, so `inverter_1.p_ac` can name a register of another slave.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrMissing is returned, wrapped with the variable name, when an expression refers to a value
+// that is not available in this cycle.
+var ErrMissing = errors.New("missing value")
+
+// Expr is a compiled expression.
+type Expr struct {
+	src  string
+	root node
+	vars []string
+}
+
+// Compile parses src.
+func Compile(src string) (*Expr, error) {
+	p := &parser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%q: unexpected %q", src, p.tokens[p.pos].text)
+	}
+	e := &Expr{src: src, root: root}
+	seen := make(map[string]bool)
+	collectVars(root, func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			e.vars = append(e.vars, name)
+		}
+	})
+	return e, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string { return e.src }
+
+// Vars lists the variable names the expression refers to, in order of appearance.
+func (e *Expr) Vars() []string { return e.vars }
+
+// Eval computes the expression. Missing variables, division by zero and non-finite results are errors.
+func (e *Expr) Eval(vars map[string]float64) (float64, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%q: result is not a finite number", e.src)
+	}
+	return v, nil
+}
+
+type node interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) { return float64(n), nil }
+
+type varNode string
+
+func (n varNode) eval(vars map[string]float64) (float64, error) {
+	v, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrMissing, string(n))
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+func (n unaryNode) eval(vars map[string]float64) (float64, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return boolValue(x == 0), nil
+	}
+	return -x, nil
+}
+
+type binaryNode struct {
+	op   string
+	l, r node
+}
+
+func (n binaryNode) eval(vars map[string]float64) (float64, error) {
+	l, err := n.l.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	// && and || only look at the right side when it decides the result.
+	switch n.op {
+	case "&&":
+		if l == 0 {
+			return 0, nil
+		}
+	case "||":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+	r, err := n.r.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	case "^":
+		return math.Pow(l, r), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	case "<":
+		return boolValue(l < r), nil
+	case "<=":
+		return boolValue(l <= r), nil
+	case ">":
+		return boolValue(l > r), nil
+	case ">=":
+		return boolValue(l >= r), nil
+	case "&&", "||":
+		return boolValue(r != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type condNode struct {
+	cond, then, els node
+}
+
+func (n condNode) eval(vars map[string]float64) (float64, error) {
+	c, err := n.cond.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if c != 0 {
+		return n.then.eval(vars)
+	}
+	return n.els.eval(vars)
+}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+func (n callNode) eval(vars map[string]float64) (float64, error) {
+	if n.name == "if" {
+		return condNode{cond: n.args[0], then: n.args[1], els: n.args[2]}.eval(vars)
+	}
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	switch n.name {
+	case "min":
+		v := args[0]
+		for _, a := range args[1:] {
+			v = math.Min(v, a)
+		}
+		return v, nil
+	case "max":
+		v := args[0]
+		for _, a := range args[1:] {
+			v = math.Max(v, a)
+		}
+		return v, nil
+	case "sum", "avg":
+		sum := 0.0
+		for _, a := range args {
+			sum += a
+		}
+		if n.name == "avg" {
+			return sum / float64(len(args)), nil
+		}
+		return sum, nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "sqrt":
+		return math.Sqrt(args[0]), nil
+	case "round":
+		scale := 1.0
+		if len(args) == 2 {
+			scale = math.Pow(10, args[1])
+		}
+		return math.Round(args[0]*scale) / scale, nil
+	}
+	return 0, fmt.Errorf("unknown function %q", n.name)
+}
+
+// arity is the accepted argument count per function; -1 means one or more.
+var arity = map[string][2]int{
+	"min":   {1, -1},
+	"max":   {1, -1},
+	"sum":   {1, -1},
+	"avg":   {1, -1},
+	"abs":   {1, 1},
+	"sqrt":  {1, 1},
+	"round": {1, 2},
+	"if":    {3, 3},
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func collectVars(n node, add func(string)) {
+	switch n := n.(type) {
+	case varNode:
+		add(string(n))
+	case unaryNode:
+		collectVars(n.x, add)
+	case binaryNode:
+		collectVars(n.l, add)
+		collectVars(n.r, add)
+	case condNode:
+		collectVars(n.cond, add)
+		collectVars(n.then, add)
+		collectVars(n.els, add)
+	case callNode:
+		for _, a := range n.args {
+			collectVars(a, add)
+		}
+	}
+}
+
+type tokenKind int
+
+const (
+	tokNumber tokenKind = iota
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+}
+
+var twoCharOps = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+func (p *parser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			// exponent, e.g. 1e-3
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				k := j + 1
+				if k < len(s) && (s[k] == '+' || s[k] == '-') {
+					k++
+				}
+				if k < len(s) && unicode.IsDigit(rune(s[k])) {
+					for k < len(s) && unicode.IsDigit(rune(s[k])) {
+						k++
+					}
+					j = k
+				}
+			}
+			v, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("%q: invalid number %q", p.src, s[i:j])
+			}
+			p.tokens = append(p.tokens, token{kind: tokNumber, text: s[i:j], num: v})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: strings.TrimRight(s[i:j], ".")})
+			i = j
+		default:
+			op := ""
+			for _, two := range twoCharOps {
+				if strings.HasPrefix(s[i:], two) {
+					op = two
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%^<>!?:(),", c) {
+					return fmt.Errorf("%q: unexpected character %q", p.src, c)
+				}
+				op = string(c)
+			}
+			p.tokens = append(p.tokens, token{kind: tokOp, text: op})
+			i += len(op)
+		}
+	}
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+	return nil
+}
+
+func (p *parser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.peekOp(op); !ok {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("%q: expected %q at end", p.src, op)
+		}
+		return fmt.Errorf("%q: expected %q, found %q", p.src, op, p.tokens[p.pos].text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) parseTernary() (node, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.peekOp("?"); !ok {
+		return cond, nil
+	}
+	p.pos++
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return condNode{cond: cond, then: then, els: els}, nil
+}
+
+// precedence lists binary operators from loosest to tightest binding.
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp(precedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, l: left, r: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, ok := p.peekOp("-", "+", "!"); ok {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return x, nil
+		}
+		return unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePower()
+}
+
+// parsePower binds ^ tighter than unary minus on its left and right-associatively: -2^2 is -4.
+func (p *parser) parsePower() (node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.peekOp("^"); !ok {
+		return base, nil
+	}
+	p.pos++
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: "^", l: base, r: exp}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("%q: unexpected end", p.src)
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokNumber:
+		return numberNode(t.num), nil
+	case tokIdent:
+		if _, ok := p.peekOp("("); !ok {
+			return varNode(t.text), nil
+		}
+		return p.parseCall(t.text)
+	}
+	if t.text == "(" {
+		x, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return nil, fmt.Errorf("%q: unexpected %q", p.src, t.text)
+}
+
+func (p *parser) parseCall(name string) (node, error) {
+	name = strings.ToLower(name)
+	limits, ok := arity[name]
+	if !ok {
+		return nil, fmt.Errorf("%q: unknown function %q", p.src, name)
+	}
+	p.pos++ // (
+	var args []node
+	if _, ok := p.peekOp(")"); !ok {
+		for {
+			a, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+			if _, ok := p.peekOp(","); !ok {
+				break
+			}
+			p.pos++
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) < limits[0] || (limits[1] >= 0 && len(args) > limits[1]) {
+		return nil, fmt.Errorf("%q: wrong number of arguments to %s", p.src, name)
+	}
+	return callNode{name: name, args: args}, nil
+}
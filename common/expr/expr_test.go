@@ -0,0 +1,169 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestEval(t *testing.T) {
+	vars := map[string]float64{"a": 2, "b": 3, "inv_1.p_ac": 1500, "zero": 0}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"7 % 4 * 2", 6},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"-a * b", -6},
+		{"1 + 2 < 4", 1},
+		{"1 < 2 == 1", 1},
+		{"1 || 0 && 0", 1},
+		{"(1 || 0) && 0", 0},
+		{"!zero + 1", 2},
+		{"!(a > 1)", 0},
+		{"a > b ? 10 : b > 2 ? 20 : 30", 20},
+		{"zero ? 1 : a ? 2 : 3", 2},
+		{"inv_1.p_ac / 1000", 1.5},
+		{"1e3 + 2.5E-1", 1000.25},
+		{"min(a, b, 1)", 1},
+		{"max(a, b)", 3},
+		{"avg(a, b, 4)", 3},
+		{"sum(a, b)", 5},
+		{"abs(a - b)", 1},
+		{"sqrt(16)", 4},
+		{"round(2.345, 2)", 2.35},
+		{"round(2.5)", 3},
+		{"if(a > b, 1, 0)", 0},
+		{"MAX(a, b)", 3},
+		// && and || only evaluate the right side when it decides the result.
+		{"zero && missing", 0},
+		{"a || missing", 1},
+		{"zero ? missing : 4", 4},
+	}
+	for _, tt := range tests {
+		e, err := Compile(tt.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(vars)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		message string
+	}{
+		{"", "empty expression"},
+		{"   ", "empty expression"},
+		{"1 +", "unexpected end"},
+		{"(1 + 2", `expected ")"`},
+		{"1 + 2)", `unexpected ")"`},
+		{"a b", `unexpected "b"`},
+		{"1 ? 2", `expected ":"`},
+		{"1 $ 2", "unexpected character"},
+		{"1..2", "invalid number"},
+		{"foo(1)", "unknown function"},
+		{"abs(1, 2)", "wrong number of arguments"},
+		{"min()", "wrong number of arguments"},
+		{"if(1, 2)", "wrong number of arguments"},
+		{"round(1, 2, 3)", "wrong number of arguments"},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.src)
+		if err == nil {
+			t.Errorf("Compile(%q) succeeded, want error containing %q", tt.src, tt.message)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("Compile(%q) error = %q, want it to contain %q", tt.src, err, tt.message)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	vars := map[string]float64{"a": 1, "zero": 0}
+	tests := []struct {
+		src     string
+		missing bool
+		message string
+	}{
+		{"a + b", true, `"b"`},
+		{"a / zero", false, "division by zero"},
+		{"a % zero", false, "division by zero"},
+		{"sqrt(-1)", false, "not a finite number"},
+		{"10 ^ 400", false, "not a finite number"},
+	}
+	for _, tt := range tests {
+		e, err := Compile(tt.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		_, err = e.Eval(vars)
+		if err == nil {
+			t.Errorf("Eval(%q) succeeded, want error containing %q", tt.src, tt.message)
+			continue
+		}
+		if errors.Is(err, ErrMissing) != tt.missing {
+			t.Errorf("Eval(%q) error = %q, errors.Is(ErrMissing) = %v, want %v", tt.src, err, !tt.missing, tt.missing)
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("Eval(%q) error = %q, want it to contain %q", tt.src, err, tt.message)
+		}
+	}
+}
+
+func TestVars(t *testing.T) {
+	e, err := Compile("max(inv_1.p_ac, inv_2.p_ac) / inv_1.p_ac + irr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"inv_1.p_ac", "inv_2.p_ac", "irr"}
+	if got := e.Vars(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Vars() = %q, want %q", got, want)
+	}
+}
+
+func TestFieldsYAML(t *testing.T) {
+	var cfg struct {
+		Derived Fields `yaml:"derived"`
+	}
+	src := "derived:\n  - {name: p, expr: \"a * 2\"}\n  - {name: q, expr: \"p + 1\"}\n"
+	if err := yaml.Unmarshal([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	results, err := cfg.Derived.Eval(map[string]float64{"a": 2})
+	if err != nil || len(results) != 2 || results[1].Value != 5 {
+		t.Errorf("Eval = %v, %v, want p = 4 and q = 5", results, err)
+	}
+
+	err = yaml.Unmarshal([]byte("derived:\n  - {name: p, expr: \"a *\"}\n"), &cfg)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), `derived field "p"`) {
+		t.Errorf("error = %v, want the field and its line", err)
+	}
+
+	var empty struct {
+		Derived Fields `yaml:"derived"`
+	}
+	if results, err := empty.Derived.Eval(map[string]float64{}); results != nil || err != nil {
+		t.Errorf("unset derived: %v, %v, want nothing", results, err)
+	}
+}
@@ -0,0 +1,51 @@
+// Package poller holds the output steps the Modbus TCP pollers share: derived fields and the
+// per-interval values of counter and power registers, printed and written like register values.
+package poller
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"common/counters"
+	"common/expr"
+)
+
+// Output prints and writes the values of one poller run.
+type Output struct {
+	TS    time.Time
+	Test  bool                                                // print only, as the pollers' test mode
+	Write func(tags map[string]string, fields map[string]any) // stores one point at TS
+}
+
+// Derived evaluates derived fields over vars and writes them like register values.
+func (o Output) Derived(indent string, eval func(map[string]float64) ([]expr.Result, error), vars map[string]float64, tags map[string]string) []expr.Result {
+	results, err := eval(vars)
+	if err != nil {
+		log.Printf("%sderived: %v", indent, err)
+	}
+	for _, r := range results {
+		fmt.Printf("%s[%s] %-28s -> %.6f %s (derived)\n", indent, o.TS, r.Name, r.Value, r.Unit)
+		if !o.Test {
+			o.Write(tags, map[string]any{r.Name: r.Value})
+		}
+	}
+	return results
+}
+
+// Counter derives the per-interval values of a counter or power register (kind:) from its value v,
+// adds them to vars and writes them like register values. tags name the device and slave.
+func (o Output) Counter(state *counters.State, name, kind, unit, datatype string, v, gain float64, tags map[string]string, vars map[string]float64) {
+	key := tags["device"] + "/" + tags["slave"] + "/" + name
+	outputs, note := state.Update(key, name, kind, unit, v, gain, counters.Width(datatype), o.TS)
+	if note != "" {
+		fmt.Printf("    [%s] %-28s    %s\n", o.TS, name, note)
+	}
+	for _, out := range outputs {
+		vars[out.Name] = out.Value
+		fmt.Printf("    [%s] %-28s -> %.6f %s (%s)\n", o.TS, out.Name, out.Value, out.Unit, kind)
+		if !o.Test {
+			o.Write(tags, map[string]any{out.Name: out.Value})
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package profiles
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Value is a decoded, converted register value.
+type Value struct {
+	Register int
+	Name     string
+	Type     string // source type, or "float" when conversions were applied
+	Value    float64
+	Unit     string
+}
+
+// converters are the named conversion steps usable in a register's convert list.
+// scale_factor is handled separately because it needs another register's value.
+var converters = map[string]func(float64) float64{
+	"div10":                  func(v float64) float64 { return v / 10 },
+	"div100":                 func(v float64) float64 { return v / 100 },
+	"div1000":                func(v float64) float64 { return v / 1000 },
+	"mul10":                  func(v float64) float64 { return v * 10 },
+	"kelvin_to_celsius":      func(v float64) float64 { return v - 273.15 },
+	"millivolt_to_volt":      func(v float64) float64 { return v / 1000 },
+	"microvolt_to_millivolt": func(v float64) float64 { return v / 1000 },
+}
+
+// multiplicative holds the factor of converters that are a plain multiplication.
+var multiplicative = map[string]float64{
+	"div10":                  0.1,
+	"div100":                 0.01,
+	"div1000":                0.001,
+	"mul10":                  10,
+	"millivolt_to_volt":      0.001,
+	"microvolt_to_millivolt": 0.001,
+}
+
+// TypeWidth returns the number of 16-bit registers used by a type, or 0 if unknown.
+func TypeWidth(typ string) int {
+	switch strings.ToLower(typ) {
+	case "uint8", "uint16", "int16", "string":
+		return 1
+	case "uint32", "int32", "float32":
+		return 2
+	case "uint64", "int64", "float64":
+		return 4
+	}
+	return 0
+}
+
+// WordCount returns the number of registers read for r.
+func (r Register) WordCount() int {
+	if r.Words > 0 {
+		return r.Words
+	}
+	return TypeWidth(r.Type)
+}
+
+// Raw decodes the unconverted register value from raw big-endian register bytes.
+func (r Register) Raw(raw []byte) (float64, bool) {
+	typ := strings.ToLower(r.Type)
+	width := TypeWidth(typ) * 2
+	if typ == "string" || len(raw) < width {
+		return 0, false
+	}
+	b := raw[:width]
+	if width > 2 && strings.EqualFold(r.WordOrder, "little") {
+		b = swapWords(b)
+	}
+	switch typ {
+	case "uint8":
+		return float64(b[1]), true
+	case "uint16":
+		return float64(binary.BigEndian.Uint16(b)), true
+	case "int16":
+		return float64(int16(binary.BigEndian.Uint16(b))), true
+	case "uint32":
+		return float64(binary.BigEndian.Uint32(b)), true
+	case "int32":
+		return float64(int32(binary.BigEndian.Uint32(b))), true
+	case "float32":
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), true
+	case "uint64":
+		return float64(binary.BigEndian.Uint64(b)), true
+	case "int64":
+		return float64(int64(binary.BigEndian.Uint64(b))), true
+	case "float64":
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), true
+	}
+	return 0, false
+}
+
+// Apply converts a raw value using gain, offset and the convert steps. scale is the value of
+// scale_register, used by the scale_factor step.
+func (r Register) Apply(raw float64, scale int) float64 {
+	v := raw
+	if r.Gain != 0 {
+		v *= r.Gain
+	}
+	v += r.Offset
+	for _, step := range r.Convert {
+		if step == "scale_factor" {
+			v /= math.Pow(10, float64(scale))
+			continue
+		}
+		if fn, ok := converters[step]; ok {
+			v = fn(v)
+		}
+	}
+	return v
+}
+
+// OutputType is the stored type: the source integer type when no conversion applies, otherwise "float".
+func (r Register) OutputType() string {
+	typ := strings.ToLower(r.Type)
+	if (r.Gain != 0 && r.Gain != 1) || r.Offset != 0 || len(r.Convert) > 0 {
+		return "float"
+	}
+	switch typ {
+	case "float32", "float64":
+		return "float"
+	case "uint8":
+		return "uint16"
+	}
+	return typ
+}
+
+// DecodeBlock decodes every profile register fully contained in a block of registers starting at
+// address start. Registers restricted to other models (by the identify register) are skipped.
+func (p *Profile) DecodeBlock(start int, data []byte) ([]Value, []string) {
+	if len(data)%2 != 0 {
+		return nil, []string{"odd data length"}
+	}
+	words := make(map[int]uint16, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		words[start+i/2] = binary.BigEndian.Uint16(data[i:])
+	}
+	return p.DecodeWords(words)
+}
+
+// DecodeWords decodes every profile register whose words are all present in words, keyed by
+// register address. Registers restricted to other models (by the identify register) are skipped.
+func (p *Profile) DecodeWords(words map[int]uint16) ([]Value, []string) {
+	model, haveModel := -1, false
+	if p.Identify != nil {
+		if v, ok := words[p.Identify.Register]; ok {
+			model, haveModel = int(v), true
+		}
+	}
+
+	var (
+		values   []Value
+		warnings []string
+	)
+	for _, r := range p.Registers {
+		if len(r.Models) > 0 && (!haveModel || !containsInt(r.Models, model)) {
+			continue
+		}
+		if strings.EqualFold(r.Type, "string") {
+			continue
+		}
+		width := r.WordCount()
+		raw := make([]byte, 0, width*2)
+		for a := r.Register; a < r.Register+width; a++ {
+			w, ok := words[a]
+			if !ok {
+				raw = nil
+				break
+			}
+			raw = binary.BigEndian.AppendUint16(raw, w)
+		}
+		if raw == nil {
+			continue
+		}
+		v, ok := r.Raw(raw)
+		if !ok {
+			continue
+		}
+		scale := 0
+		if r.ScaleRegister != nil {
+			sv, ok := words[*r.ScaleRegister]
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: scale register %d not in block", r.Name, *r.ScaleRegister))
+				continue
+			}
+			scale = int(int16(sv))
+			if scale < -1 || scale > 2 {
+				warnings = append(warnings, fmt.Sprintf("%s: unexpected scale factor %d", r.Name, scale))
+			}
+		}
+		values = append(values, Value{
+			Register: r.Register,
+			Name:     r.Name,
+			Type:     r.OutputType(),
+			Value:    r.Apply(v, scale),
+			Unit:     r.Unit,
+		})
+	}
+	return values, warnings
+}
+
+// PollerDatatype maps a profile type to the datatype names used by the Modbus TCP pollers.
+func (r Register) PollerDatatype() (string, error) {
+	little := strings.EqualFold(r.WordOrder, "little")
+	switch strings.ToLower(r.Type) {
+	case "uint8":
+		return "U8", nil
+	case "uint16":
+		return "U16", nil
+	case "int16":
+		return "S16", nil
+	case "string":
+		return "UTF-8", nil
+	case "uint32":
+		if little {
+			return "U32LE", nil
+		}
+		return "U32", nil
+	case "int32":
+		if little {
+			return "S32LE", nil
+		}
+		return "S32", nil
+	case "float32":
+		if little {
+			return "F32LE", nil
+		}
+		return "F32BE", nil
+	case "uint64":
+		if !little {
+			return "U64BE", nil
+		}
+	case "int64":
+		if !little {
+			return "S64BE", nil
+		}
+	case "float64":
+		if !little {
+			return "F64BE", nil
+		}
+	}
+	return "", fmt.Errorf("register %q: type %s/%s has no poller datatype", r.Name, r.Type, r.WordOrder)
+}
+
+// PollerGain folds gain and multiplicative convert steps into the single gain the pollers apply.
+func (r Register) PollerGain() (float64, error) {
+	if r.Offset != 0 {
+		return 0, fmt.Errorf("register %q: offset is not supported by the pollers", r.Name)
+	}
+	gain := r.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	for _, step := range r.Convert {
+		f, ok := multiplicative[step]
+		if !ok {
+			return 0, fmt.Errorf("register %q: converter %q is not supported by the pollers", r.Name, step)
+		}
+		gain *= f
+	}
+	return gain, nil
+}
+
+func swapWords(b []byte) []byte {
+	out := make([]byte, len(b))
+	words := len(b) / 2
+	for i := 0; i < words; i++ {
+		j := words - 1 - i
+		out[i*2], out[i*2+1] = b[j*2], b[j*2+1]
+	}
+	return out
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
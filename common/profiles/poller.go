@@ -0,0 +1,104 @@
+package profiles
+
+import (
+	"fmt"
+	"strings"
+
+	"common/counters"
+)
+
+// PollerRegister is a profile register in the form of the Modbus TCP pollers' modbus_registers.
+type PollerRegister struct {
+	Register     int
+	FunctionCode int
+	Name         string
+	Description  string
+	Words        int
+	Datatype     string
+	Unit         string
+	Gain         float64
+	Kind         string
+}
+
+// PollerRegisters converts the profile's registers for the pollers.
+func (p *Profile) PollerRegisters() ([]PollerRegister, error) {
+	regs := make([]PollerRegister, 0, len(p.Registers))
+	for _, r := range p.Registers {
+		datatype, err := r.PollerDatatype()
+		if err != nil {
+			return nil, err
+		}
+		gain, err := r.PollerGain()
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, PollerRegister{
+			Register:     r.Register,
+			FunctionCode: p.FunctionCodeFor(r),
+			Name:         r.Name,
+			Description:  r.Description,
+			Words:        r.WordCount(),
+			Datatype:     datatype,
+			Unit:         r.Unit,
+			Gain:         gain,
+			Kind:         r.Kind,
+		})
+	}
+	return regs, nil
+}
+
+// Poller resolves the device_type of the pollers' slaves. The library is only loaded once a slave
+// sets device_type.
+type Poller struct {
+	dirs []string
+	lib  *Library
+}
+
+// NewPoller returns a Poller over the built-in profiles and dirs.
+func NewPoller(dirs []string) *Poller {
+	return &Poller{dirs: dirs}
+}
+
+// Expand returns the registers of a poller slave: those of its device_type profile, built into the
+// poller's register type with build, followed by its explicit registers, which override profile
+// registers with the same name. It also rejects register kinds the counter state does not handle.
+func Expand[R any](p *Poller, slave, deviceType string, explicit []R, build func(PollerRegister) R, info func(R) (name, kind string)) ([]R, error) {
+	regs := explicit
+	if strings.TrimSpace(deviceType) != "" {
+		if p.lib == nil {
+			lib, err := Load(p.dirs...)
+			if err != nil {
+				return nil, err
+			}
+			p.lib = lib
+		}
+		prof, ok := p.lib.Get(deviceType)
+		if !ok {
+			return nil, fmt.Errorf("slave %s: unknown device_type %q (profiles: %s)", slave, deviceType, strings.Join(p.lib.Names(), ", "))
+		}
+		base, err := prof.PollerRegisters()
+		if err != nil {
+			return nil, fmt.Errorf("slave %s: %w", slave, err)
+		}
+		regs = make([]R, 0, len(base)+len(explicit))
+		byName := make(map[string]int, len(base))
+		for i, r := range base {
+			byName[r.Name] = i
+			regs = append(regs, build(r))
+		}
+		for _, r := range explicit {
+			name, _ := info(r)
+			if i, ok := byName[name]; ok {
+				regs[i] = r
+				continue
+			}
+			regs = append(regs, r)
+		}
+	}
+	for _, r := range regs {
+		if name, kind := info(r); !counters.ValidKind(kind) {
+			return nil, fmt.Errorf("slave %s register %s: unknown kind %q", slave, name, kind)
+		}
+	}
+	return regs, nil
+}
@@ -0,0 +1,42 @@
+package profiles
+
+import (
+	"strings"
+	"testing"
+)
+
+type testRegister struct {
+	name, kind string
+	gain       float64
+}
+
+func buildTest(r PollerRegister) testRegister {
+	return testRegister{name: r.Name, kind: r.Kind, gain: r.Gain}
+}
+
+func infoTest(r testRegister) (string, string) {
+	return r.name, r.kind
+}
+
+func TestExpand(t *testing.T) {
+	p := NewPoller(nil)
+	explicit := []testRegister{{name: "current_c", gain: 2}, {name: "extra", kind: "counter"}}
+	regs, err := Expand(p, "meter", "ion7400", explicit, buildTest, infoTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs[0].name != "current_a" || regs[2] != explicit[0] || regs[len(regs)-1] != explicit[1] {
+		t.Errorf("registers = %v, want the profile's with current_c overridden and extra appended", regs)
+	}
+
+	if regs, err := Expand(p, "meter", "", explicit, buildTest, infoTest); err != nil || len(regs) != 2 {
+		t.Errorf("without device_type: %v, %v, want the explicit registers", regs, err)
+	}
+	if _, err := Expand(p, "meter", "nope", explicit, buildTest, infoTest); err == nil || !strings.Contains(err.Error(), "unknown device_type") {
+		t.Errorf("unknown device_type: error = %v", err)
+	}
+	bad := []testRegister{{name: "energy", kind: "energy"}}
+	if _, err := Expand(p, "meter", "", bad, buildTest, infoTest); err == nil || !strings.Contains(err.Error(), `unknown kind "energy"`) {
+		t.Errorf("unknown kind: error = %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package profiles loads device register profiles shared by moxa-nport and the Modbus TCP pollers.
+//
+// A profile describes a device's register layout once (addresses, types, word order, unit and
+// conversion steps) so that a config only has to name it with `device_type`. Built-in profiles are
+// embedded from builtin/*.yml; files in user profile directories override them by name.
+package profiles
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"common/counters"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed builtin/*.yml
+var builtinFS embed.FS
+
+// Profile is the register layout of one device model.
+type Profile struct {
+	Name         string     `yaml:"name"`
+	Description  string     `yaml:"description"`
+	FunctionCode int        `yaml:"function_code"` // default for registers that do not set one
+	Identify     *Marker    `yaml:"identify"`      // register that must match for a block to belong to this device
+	Cycle        bool       `yaml:"cycle"`         // registers are polled by several requests and assembled per slave
+	Registers    []Register `yaml:"registers"`
+}
+
+// Marker matches the value of a single register, either exactly or within [Min, Max].
+type Marker struct {
+	Register int  `yaml:"register"`
+	Value    *int `yaml:"value"`
+	Min      *int `yaml:"min"`
+	Max      *int `yaml:"max"`
+}
+
+// Register describes one value in a profile.
+type Register struct {
+	Register      int      `yaml:"register"`
+	Name          string   `yaml:"name"`
+	Description   string   `yaml:"description"`
+	FunctionCode  int      `yaml:"function_code"`
+	Type          string   `yaml:"type"`           // uint8, uint16, int16, uint32, int32, float32, uint64, int64, float64, string
+	WordOrder     string   `yaml:"word_order"`     // 32/64-bit types: big (high word first, default) or little
+	Words         int      `yaml:"words"`          // registers read; defaults to the type width
+	Unit          string   `yaml:"unit"`           // engineering unit after conversion
+	Gain          float64  `yaml:"gain"`           // multiplier applied before Convert (default 1)
+	Offset        float64  `yaml:"offset"`         // added after Gain
+	Convert       []string `yaml:"convert"`        // named conversion steps, applied in order
+	ScaleRegister *int     `yaml:"scale_register"` // register holding a power-of-ten divisor (scale_factor step)
+	Models        []int    `yaml:"models"`         // only decoded when the identify register holds one of these values
+	Kind          string   `yaml:"kind"`           // counter or power: the pollers also emit per-interval deltas (see common/counters)
+}
+
+// Matches reports whether v satisfies the marker.
+func (m *Marker) Matches(v int) bool {
+	if m == nil {
+		return true
+	}
+	if m.Value != nil && v != *m.Value {
+		return false
+	}
+	if m.Min != nil && v < *m.Min {
+		return false
+	}
+	if m.Max != nil && v > *m.Max {
+		return false
+	}
+	return true
+}
+
+// Library holds profiles by lower-case name.
+type Library struct {
+	profiles map[string]*Profile
+	sources  map[string]string
+}
+
+// Load returns the built-in profiles overridden by any *.yml/*.yaml files found in dirs.
+// Later directories take precedence over earlier ones.
+func Load(dirs ...string) (*Library, error) {
+	lib := &Library{profiles: make(map[string]*Profile), sources: make(map[string]string)}
+	builtin, _ := fs.Sub(builtinFS, "builtin")
+	if err := lib.addFS(builtin, "builtin"); err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if strings.TrimSpace(dir) == "" {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("profile dir %q: %w", dir, err)
+		}
+		if err := lib.addFS(os.DirFS(dir), dir); err != nil {
+			return nil, err
+		}
+	}
+	return lib, nil
+}
+
+func (l *Library) addFS(fsys fs.FS, label string) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return fmt.Errorf("read profiles in %s: %w", label, err)
+	}
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		raw, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return err
+		}
+		var p Profile
+		if err := yaml.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("profile %s/%s: %w", label, e.Name(), err)
+		}
+		if p.Name == "" {
+			p.Name = strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %s/%s: %w", label, e.Name(), err)
+		}
+		key := strings.ToLower(p.Name)
+		l.profiles[key] = &p
+		l.sources[key] = label
+	}
+	return nil
+}
+
+// Get returns the profile selected by a device_type value.
+func (l *Library) Get(deviceType string) (*Profile, bool) {
+	if l == nil {
+		return nil, false
+	}
+	p, ok := l.profiles[strings.ToLower(strings.TrimSpace(deviceType))]
+	return p, ok
+}
+
+// Source reports where a profile was loaded from ("builtin" or a directory).
+func (l *Library) Source(deviceType string) string {
+	return l.sources[strings.ToLower(strings.TrimSpace(deviceType))]
+}
+
+// Names lists the available profiles.
+func (l *Library) Names() []string {
+	names := make([]string, 0, len(l.profiles))
+	for _, p := range l.profiles {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *Profile) validate() error {
+	if len(p.Registers) == 0 {
+		return fmt.Errorf("no registers")
+	}
+	// A name may repeat when several registers report the same quantity (e.g. the SG250HX
+	// total yield at 5004 and, with more resolution, 5144); the later register wins when stored.
+	for _, r := range p.Registers {
+		if r.Name == "" {
+			return fmt.Errorf("register %d has no name", r.Register)
+		}
+		if TypeWidth(r.Type) == 0 {
+			return fmt.Errorf("register %q: unknown type %q", r.Name, r.Type)
+		}
+		for _, step := range r.Convert {
+			if _, ok := converters[step]; !ok && step != "scale_factor" {
+				return fmt.Errorf("register %q: unknown converter %q", r.Name, step)
+			}
+		}
+		if !counters.ValidKind(r.Kind) {
+			return fmt.Errorf("register %q: unknown kind %q", r.Name, r.Kind)
+		}
+		if containsStep(r.Convert, "scale_factor") && r.ScaleRegister == nil {
+			return fmt.Errorf("register %q: scale_factor needs scale_register", r.Name)
+		}
+	}
+	return nil
+}
+
+// Addresses returns every register address covered by the profile, in ascending order.
+func (p *Profile) Addresses() []int {
+	seen := make(map[int]struct{})
+	var addrs []int
+	for _, r := range p.Registers {
+		for a := r.Register; a < r.Register+r.WordCount(); a++ {
+			if _, ok := seen[a]; !ok {
+				seen[a] = struct{}{}
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	sort.Ints(addrs)
+	return addrs
+}
+
+// Span returns the lowest register and the number of registers covered by the profile.
+func (p *Profile) Span() (first int, count int) {
+	first, last := -1, -1
+	for _, r := range p.Registers {
+		end := r.Register + r.WordCount() - 1
+		if first < 0 || r.Register < first {
+			first = r.Register
+		}
+		if end > last {
+			last = end
+		}
+	}
+	return first, last - first + 1
+}
+
+// FunctionCodeFor returns the register's function code or the profile default (4, input registers).
+func (p *Profile) FunctionCodeFor(r Register) int {
+	if r.FunctionCode != 0 {
+		return r.FunctionCode
+	}
+	if p.FunctionCode != 0 {
+		return p.FunctionCode
+	}
+	return 4
+}
+
+func containsStep(steps []string, name string) bool {
+	for _, s := range steps {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+// Package solar computes the position of the sun at a site and the ideal rotation of a single-axis
+// tracker. The sun's coordinates follow Meeus, Astronomical Algorithms ch. 25 (about 0.01 deg), with
+// the topocentric parallax and refraction corrections of the NREL SPA; that is well within what
+// tracker and irradiance analysis can resolve.
+package solar
+
+import (
+	"math"
+	"time"
+
+	"common/expr"
+)
+
+// Config is the `solar:` section of a config. When set, sun_elevation, sun_azimuth and, with a
+// tracker, tracker_angle are emitted as site derived fields every cycle.
+type Config struct {
+	Site    `yaml:",inline"`
+	Tracker *Tracker `yaml:"tracker"`
+}
+
+// Site is the location of the plant.
+type Site struct {
+	Latitude    float64  `yaml:"latitude"`    // deg, north positive
+	Longitude   float64  `yaml:"longitude"`   // deg, east positive
+	Altitude    float64  `yaml:"altitude"`    // m above sea level
+	Pressure    float64  `yaml:"pressure"`    // hPa, for refraction; default from the altitude
+	Temperature *float64 `yaml:"temperature"` // degC, for refraction; default 15
+	DeltaT      float64  `yaml:"delta_t"`     // TT - UT in seconds, default 69
+}
+
+// Tracker is the geometry of a single-axis tracker.
+type Tracker struct {
+	AxisAzimuth  float64 `yaml:"axis_azimuth_deg"` // direction of the axis, default 0 (north-south)
+	AxisTilt     float64 `yaml:"axis_tilt_deg"`
+	MaxAngle     float64 `yaml:"max_angle_deg"` // rotation limit, default 60
+	GCR          float64 `yaml:"gcr"`           // ground coverage ratio; enables backtracking
+	EastPositive bool    `yaml:"east_positive"` // by default positive angles face west (afternoon)
+}
+
+// Position is the topocentric position of the sun. Angles are in degrees; the azimuth is measured
+// from north towards east.
+type Position struct {
+	Zenith      float64
+	Elevation   float64 // refraction corrected
+	Azimuth     float64
+	Declination float64
+	HourAngle   float64
+	Distance    float64 // earth-sun distance in AU
+}
+
+const deg = math.Pi / 180
+
+func sin(d float64) float64 { return math.Sin(d * deg) }
+func cos(d float64) float64 { return math.Cos(d * deg) }
+
+// norm360 reduces an angle to [0, 360).
+func norm360(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// julianDay is the Julian day of t (UT).
+func julianDay(t time.Time) float64 {
+	return float64(t.UnixNano())/86400e9 + 2440587.5
+}
+
+// Position returns the position of the sun at t.
+func (s Site) Position(t time.Time) Position {
+	deltaT := s.DeltaT
+	if deltaT == 0 {
+		deltaT = 69
+	}
+	jd := julianDay(t)
+	jc := (jd + deltaT/86400 - 2451545) / 36525 // Julian centuries (TT)
+
+	// Geocentric apparent coordinates.
+	l0 := norm360(280.46646 + jc*(36000.76983+jc*0.0003032))
+	m := norm360(357.52911 + jc*(35999.05029-jc*0.0001537))
+	e := 0.016708634 - jc*(0.000042037+jc*0.0000001267)
+	c := (1.914602-jc*(0.004817+jc*0.000014))*sin(m) + (0.019993-jc*0.000101)*sin(2*m) + 0.000289*sin(3*m)
+	nu := m + c
+	r := 1.000001018 * (1 - e*e) / (1 + e*cos(nu))
+	omega := 125.04 - 1934.136*jc
+	lambda := l0 + c - 0.00569 - 0.00478*sin(omega)
+	eps := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60 + 0.00256*cos(omega)
+	alpha := norm360(math.Atan2(cos(eps)*sin(lambda), cos(lambda)) / deg)
+	delta := math.Asin(sin(eps)*sin(lambda)) / deg
+
+	// Apparent sidereal time and local hour angle.
+	ju := (jd - 2451545) / 36525
+	gmst := 280.46061837 + 360.98564736629*(jd-2451545) + ju*ju*(0.000387933-ju/38710000)
+	dpsi := (-17.20*sin(omega) - 1.32*sin(2*l0)) / 3600
+	h := norm360(gmst + dpsi*cos(eps) + s.Longitude - alpha)
+
+	// Topocentric correction (SPA 3.12-3.13).
+	phi := s.Latitude
+	xi := 8.794 / 3600 / r
+	u := math.Atan(0.99664719 * math.Tan(phi*deg))
+	x := math.Cos(u) + s.Altitude/6378140*cos(phi)
+	y := 0.99664719*math.Sin(u) + s.Altitude/6378140*sin(phi)
+	dAlpha := math.Atan2(-x*sin(xi)*sin(h), cos(delta)-x*sin(xi)*cos(h)) / deg
+	deltaP := math.Atan2((sin(delta)-y*sin(xi))*cos(dAlpha), cos(delta)-x*sin(xi)*cos(h)) / deg
+	hp := h - dAlpha
+
+	e0 := math.Asin(sin(phi)*sin(deltaP)+cos(phi)*cos(deltaP)*cos(hp)) / deg
+	pressure := s.Pressure
+	if pressure == 0 {
+		pressure = 1013.25 * math.Pow(1-2.25577e-5*s.Altitude, 5.25588)
+	}
+	temp := 15.0
+	if s.Temperature != nil {
+		temp = *s.Temperature
+	}
+	elevation := e0
+	if e0 >= -(0.26667 + 0.5667) {
+		elevation += pressure / 1010 * 283 / (273 + temp) * 1.02 / (60 * math.Tan((e0+10.3/(e0+5.11))*deg))
+	}
+	azimuth := norm360(math.Atan2(sin(hp), cos(hp)*sin(phi)-math.Tan(deltaP*deg)*cos(phi))/deg + 180)
+
+	return Position{
+		Zenith:      90 - elevation,
+		Elevation:   elevation,
+		Azimuth:     azimuth,
+		Declination: deltaP,
+		HourAngle:   hp,
+		Distance:    r,
+	}
+}
+
+// Noon returns the solar noon, when the sun crosses the local meridian, on the calendar day of t
+// in t's location.
+func (s Site) Noon(t time.Time) time.Time {
+	y, m, d := t.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC).Add(-time.Duration(s.Longitude / 15 * float64(time.Hour)))
+	for range 2 {
+		h := math.Mod(s.Position(noon).HourAngle+540, 360) - 180 // (-180, 180]
+		noon = noon.Add(-time.Duration(h / 15 * float64(time.Hour)))
+	}
+	return noon.In(t.Location())
+}
+
+// SolarConstant is the total solar irradiance at 1 AU, W/m2.
+const SolarConstant = 1361.0
+
+// Extraterrestrial is the irradiance at the top of the atmosphere, normal to the sun, in W/m2.
+func (p Position) Extraterrestrial() float64 {
+	return SolarConstant / (p.Distance * p.Distance)
+}
+
+// Angle is the rotation of the tracker that points it at the sun, with backtracking when gcr is
+// set, limited to max_angle_deg. It is 0 (flat) while the sun is below the horizon.
+func (tr Tracker) Angle(p Position) float64 {
+	if p.Elevation <= 0 {
+		return 0
+	}
+	// Sun vector (east, north, up) in the frame of the tracker axis.
+	x := sin(p.Zenith) * sin(p.Azimuth)
+	y := sin(p.Zenith) * cos(p.Azimuth)
+	z := cos(p.Zenith)
+	xp := x*cos(tr.AxisAzimuth) - y*sin(tr.AxisAzimuth)
+	zp := x*sin(tr.AxisAzimuth)*sin(tr.AxisTilt) + y*cos(tr.AxisAzimuth)*sin(tr.AxisTilt) + z*cos(tr.AxisTilt)
+	theta := math.Atan2(xp, zp) // facing east is positive here
+
+	if tr.GCR > 0 {
+		if c := math.Abs(math.Cos(theta) / tr.GCR); c < 1 {
+			theta -= math.Copysign(math.Acos(c), theta)
+		}
+	}
+	angle := theta / deg
+	limit := tr.MaxAngle
+	if limit <= 0 {
+		limit = 60
+	}
+	angle = math.Max(-limit, math.Min(limit, angle))
+	if !tr.EastPositive {
+		angle = -angle
+	}
+	return angle
+}
+
+// Fields returns the sun position, and the tracker angle when a tracker is configured, as site
+// derived fields. It returns nil when c is nil.
+func (c *Config) Fields(t time.Time) []expr.Result {
+	if c == nil {
+		return nil
+	}
+	p := c.Position(t)
+	results := []expr.Result{
+		{Name: "sun_elevation", Unit: "deg", Value: p.Elevation},
+		{Name: "sun_azimuth", Unit: "deg", Value: p.Azimuth},
+	}
+	if c.Tracker != nil {
+		results = append(results, expr.Result{Name: "tracker_angle", Unit: "deg", Value: c.Tracker.Angle(p)})
+	}
+	return results
+}
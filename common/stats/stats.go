@@ -0,0 +1,21 @@
+// Package stats holds the small statistics shared by the pollers and the analytics.
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+// Median returns the median of values without reordering them, or NaN when there are none.
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -9,6 +9,9 @@ import (
 	"strconv"
 	"time"
 
+	"common/alerts"
+	"common/counters"
+	"common/poller"
 	"ion-7400/internal"
 
 	"github.com/goburrow/modbus"
@@ -53,6 +56,14 @@ func main() {
 	if err := internal.LoadRegisters(*configPath, &devices); err != nil {
 		log.Fatalf("Error loading registers file: %v", err)
 	}
+	counterState, err := counters.Load(devices.Counters, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading counter state: %v", err)
+	}
+	alertEngine, err := alerts.Load(devices.Alerts, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading alert rules: %v", err)
+	}
 
 	// Load storage config
 	var storageConfig internal.StorageConfig
@@ -102,6 +113,17 @@ func main() {
 		}
 	}()
 
+	// Derived fields and counter values are printed and written like register values.
+	out := poller.Output{TS: ts, Test: test, Write: func(tags map[string]string, fields map[string]any) {
+		if localAvailable {
+			localInfluxWriteAPI.WritePoint(influxdb2.NewPoint(localInfluxMeasurement, tags, fields, ts))
+		}
+		if remoteAvailable {
+			remoteInfluxWriteAPI.WritePoint(influxdb2.NewPoint(remoteInfluxMeasurement, tags, fields, ts))
+		}
+	}}
+	siteVars := map[string]float64{}
+
 	for _, devItem := range devices.Devices {
 		dev := devItem.Device
 		fmt.Println("Device:", dev.Name)
@@ -111,13 +133,17 @@ func main() {
 		handler.Timeout = 5 * time.Second
 
 		if err := handler.Connect(); err != nil {
-			log.Fatalf("Error connecting to Modbus (%s): %v", addr, err)
+			// Keep polling the other devices; alert rules see this one's registers as missing.
+			log.Printf("Error connecting to Modbus (%s): %v", addr, err)
+			continue
 		}
 		client := modbus.NewClient(handler)
+		deviceVars := map[string]float64{}
 
 		for _, slave := range dev.Slaves {
 			fmt.Println("  Slave:", slave.Name)
 			handler.SlaveId = byte(slave.SlaveID)
+			slaveVars := map[string]float64{}
 
 			for _, reg := range slave.Registers {
 				var resp []byte
@@ -188,6 +214,12 @@ func main() {
 					log.Printf("    unknown datatype=%q at addr=%d (raw=% x)", reg.Datatype, reg.Register, resp)
 					continue
 				}
+				if reg.Datatype != "UTF-8" && reg.Datatype != "STRING" {
+					slaveVars[reg.Name] = v
+					if reg.Kind != "" {
+						out.Counter(counterState, reg.Name, reg.Kind, reg.Unit, reg.Datatype, v, reg.Gain, map[string]string{"device": dev.Name, "slave": slave.Name}, slaveVars)
+					}
+				}
 				if test {
 					fmt.Println(reg.Name, v)
 				} else {
@@ -209,11 +241,20 @@ func main() {
 				}
 			}
 
+			out.Derived("    ", slave.Derived.Eval, slaveVars, map[string]string{"device": dev.Name, "slave": slave.Name})
+			for name, v := range slaveVars {
+				deviceVars[slave.Name+"."+name] = v
+				siteVars[dev.Name+"."+slave.Name+"."+name] = v
+			}
+
 			// Close TCP for this device before moving to the next
 			if err := handler.Close(); err != nil {
 				log.Printf("close error for device %s: %v", dev.Name, err)
 			}
 		}
+		for _, r := range out.Derived("  ", dev.Derived.Eval, deviceVars, map[string]string{"device": dev.Name}) {
+			siteVars[dev.Name+"."+r.Name] = r.Value
+		}
 		if !test {
 			if localAvailable {
 				fmt.Println("Flushing local InfluxDB")
@@ -226,4 +267,45 @@ func main() {
 		}
 		fmt.Println("Time taken:", time.Since(begin))
 	}
-}
\ No newline at end of file
+	if results := out.Derived("", devices.Derived.Eval, siteVars, map[string]string{"scope": "site"}); len(results) > 0 && !test {
+		if localAvailable {
+			localInfluxWriteAPI.Flush()
+		}
+		if remoteAvailable {
+			remoteInfluxWriteAPI.Flush()
+		}
+	}
+
+	if events := alertEngine.Evaluate(siteVars, ts); len(events) > 0 {
+		for _, ev := range events {
+			fmt.Printf("ALERT %-8s %-8s %s: %s\n", ev.State, ev.Severity, ev.Rule, ev.Message)
+			if !test && alertEngine.Outputs().Influx {
+				if localAvailable {
+					localInfluxWriteAPI.WritePoint(influxdb2.NewPoint(alerts.Measurement, ev.Tags(), ev.Fields(), ev.Time))
+				}
+				if remoteAvailable {
+					remoteInfluxWriteAPI.WritePoint(influxdb2.NewPoint(alerts.Measurement, ev.Tags(), ev.Fields(), ev.Time))
+				}
+			}
+		}
+		if !test {
+			if localAvailable {
+				localInfluxWriteAPI.Flush()
+			}
+			if remoteAvailable {
+				remoteInfluxWriteAPI.Flush()
+			}
+			if err := alertEngine.Outputs().Send(events); err != nil {
+				log.Printf("Error sending alerts: %v", err)
+			}
+		}
+	}
+	if !test {
+		if err := counterState.Save(); err != nil {
+			log.Printf("Error saving counter state: %v", err)
+		}
+		if err := alertEngine.Save(); err != nil {
+			log.Printf("Error saving alert state: %v", err)
+		}
+	}
+}
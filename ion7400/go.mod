@@ -17,3 +17,7 @@ require (
 	github.com/oapi-codegen/runtime v1.0.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
 )
+
+require common v0.0.0
+
+replace common => ../common
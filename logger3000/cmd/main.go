@@ -9,6 +9,10 @@ import (
 	"strconv"
 	"time"
 
+	"common/alerts"
+	"common/counters"
+	"common/expr"
+	"common/poller"
 	"logger3000/internal"
 
 	"github.com/goburrow/modbus"
@@ -47,6 +51,18 @@ func main() {
 	if err := internal.LoadRegisters(*configPath, &devices); err != nil {
 		log.Fatalf("Error loading registers file: %v", err)
 	}
+	counterState, err := counters.Load(devices.Counters, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading counter state: %v", err)
+	}
+	alertEngine, err := alerts.Load(devices.Alerts, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading alert rules: %v", err)
+	}
+	peers, err := internal.LoadPeers(devices.Peers, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading peer comparison: %v", err)
+	}
 
 	// Load storage config
 	var storageConfig internal.StorageConfig
@@ -104,6 +120,17 @@ func main() {
 		}
 	}()
 
+	// Derived fields and counter values are printed and written like register values.
+	out := poller.Output{TS: ts, Test: test, Write: func(tags map[string]string, fields map[string]any) {
+		if localAvailable {
+			localInfluxWriteAPI.WritePoint(influxdb2.NewPoint(localInfluxMeasurement, tags, fields, ts))
+		}
+		if remoteAvailable {
+			remoteInfluxWriteAPI.WritePoint(influxdb2.NewPoint(remoteInfluxMeasurement, tags, fields, ts))
+		}
+	}}
+	siteVars := map[string]float64{}
+
 	for _, devItem := range devices.Devices {
 		dev := devItem.Device
 		if !test {
@@ -118,12 +145,14 @@ func main() {
 			log.Fatalf("Error connecting to Modbus (%s): %v", addr, err)
 		}
 		client := modbus.NewClient(handler)
+		deviceVars := map[string]float64{}
 
 		for _, slave := range dev.Slaves {
 			if !test {
 				fmt.Println("  Slave:", slave.Name)
 			}
 			handler.SlaveId = byte(slave.SlaveID)
+			slaveVars := map[string]float64{}
 
 			for _, reg := range slave.Registers {
 				// En modo test, solo procesar el registro "sn"
@@ -209,6 +238,12 @@ func main() {
 					log.Printf("    unknown datatype=%q at addr=%d (raw=% x)", reg.Datatype, reg.Register, resp)
 					continue
 				}
+				if reg.Datatype != "UTF-8" && reg.Datatype != "STRING" {
+					slaveVars[reg.Name] = v
+					if reg.Kind != "" {
+						out.Counter(counterState, reg.Name, reg.Kind, reg.Unit, reg.Datatype, v, reg.Gain, map[string]string{"device": dev.Name, "slave": slave.Name}, slaveVars)
+					}
+				}
 				if !test {
 					flags := map[string]string{}
 					flags["device"] = dev.Name
@@ -228,11 +263,20 @@ func main() {
 				}
 			}
 
+			out.Derived("    ", slave.Derived.Eval, slaveVars, map[string]string{"device": dev.Name, "slave": slave.Name})
+			for name, v := range slaveVars {
+				deviceVars[slave.Name+"."+name] = v
+				siteVars[dev.Name+"."+slave.Name+"."+name] = v
+			}
+
 			// Close TCP for this device before moving to the next
 			if err := handler.Close(); err != nil {
 				log.Printf("close error for device %s: %v", dev.Name, err)
 			}
 		}
+		for _, r := range out.Derived("  ", dev.Derived.Eval, deviceVars, map[string]string{"device": dev.Name}) {
+			siteVars[dev.Name+"."+r.Name] = r.Value
+		}
 		if !test {
 			if localAvailable {
 				fmt.Println("Flushing local InfluxDB")
@@ -245,4 +289,92 @@ func main() {
 			fmt.Println("Time taken:", time.Since(begin))
 		}
 	}
+	// Sun position (solar:) as site fields, visible to the site derived fields and alert rules.
+	sun := out.Derived("", func(map[string]float64) ([]expr.Result, error) { return devices.Solar.Fields(ts), nil }, nil, map[string]string{"scope": "site"})
+	for _, r := range sun {
+		siteVars[r.Name] = r.Value
+	}
+	if results := out.Derived("", devices.Derived.Eval, siteVars, map[string]string{"scope": "site"}); len(sun)+len(results) > 0 && !test {
+		if localAvailable {
+			localInfluxWriteAPI.Flush()
+		}
+		if remoteAvailable {
+			remoteInfluxWriteAPI.Flush()
+		}
+	}
+
+	// Peer comparison: deviation from the median and sustained underperformance flags, stored per
+	// slave and visible to the alert rules as <device>.<slave>.<name>_deviation and _flag.
+	if results := peers.Compare(siteVars, ts); len(results) > 0 {
+		for _, r := range results {
+			flag := 0
+			status := ""
+			switch {
+			case r.Flagged:
+				flag = 1
+				status = "UNDERPERFORMING since " + r.Below.Format(time.RFC3339)
+			case !r.Below.IsZero():
+				status = "below since " + r.Below.Format(time.RFC3339)
+			}
+			fmt.Printf("  [%s] %-16s %-28s -> %+.4f (%.4g vs median %.4g) %s\n", ts, r.Slave, r.Name+"_deviation", r.Deviation, r.Value, r.Median, status)
+			prefix := r.Device + "." + r.Slave + "." + r.Name
+			siteVars[prefix+"_deviation"] = r.Deviation
+			siteVars[prefix+"_flag"] = float64(flag)
+			if test {
+				continue
+			}
+			flags := map[string]string{"device": r.Device, "slave": r.Slave}
+			fields := map[string]any{r.Name + "_deviation": r.Deviation, r.Name + "_flag": flag}
+			if localAvailable {
+				localInfluxWriteAPI.WritePoint(influxdb2.NewPoint(localInfluxMeasurement, flags, fields, ts))
+			}
+			if remoteAvailable {
+				remoteInfluxWriteAPI.WritePoint(influxdb2.NewPoint(remoteInfluxMeasurement, flags, fields, ts))
+			}
+		}
+		if !test {
+			if localAvailable {
+				localInfluxWriteAPI.Flush()
+			}
+			if remoteAvailable {
+				remoteInfluxWriteAPI.Flush()
+			}
+		}
+	}
+
+	if events := alertEngine.Evaluate(siteVars, ts); len(events) > 0 {
+		for _, ev := range events {
+			fmt.Printf("ALERT %-8s %-8s %s: %s\n", ev.State, ev.Severity, ev.Rule, ev.Message)
+			if !test && alertEngine.Outputs().Influx {
+				if localAvailable {
+					localInfluxWriteAPI.WritePoint(influxdb2.NewPoint(alerts.Measurement, ev.Tags(), ev.Fields(), ev.Time))
+				}
+				if remoteAvailable {
+					remoteInfluxWriteAPI.WritePoint(influxdb2.NewPoint(alerts.Measurement, ev.Tags(), ev.Fields(), ev.Time))
+				}
+			}
+		}
+		if !test {
+			if localAvailable {
+				localInfluxWriteAPI.Flush()
+			}
+			if remoteAvailable {
+				remoteInfluxWriteAPI.Flush()
+			}
+			if err := alertEngine.Outputs().Send(events); err != nil {
+				log.Printf("Error sending alerts: %v", err)
+			}
+		}
+	}
+	if !test {
+		if err := counterState.Save(); err != nil {
+			log.Printf("Error saving counter state: %v", err)
+		}
+		if err := alertEngine.Save(); err != nil {
+			log.Printf("Error saving alert state: %v", err)
+		}
+		if err := peers.Save(); err != nil {
+			log.Printf("Error saving peer state: %v", err)
+		}
+	}
 }
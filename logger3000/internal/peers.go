@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"common/jsonfile"
+	"common/stats"
+)
+
+// PeersConfig is the optional `peers:` section. Every run each inverter's AC power per kW of
+// nameplate, and each MPPT input's DC current, is compared with the median of its peers. Inputs are
+// compared with all the matched inputs, so they should carry the same number of strings; unused
+// ones are listed in ignore.
+type PeersConfig struct {
+	Match          string             `yaml:"match"`           // glob over <device>.<slave>; default every slave
+	Power          string             `yaml:"power"`           // AC power register, default total_active_power
+	Nameplate      string             `yaml:"nameplate"`       // register holding the nameplate, default nominal_active_power
+	NameplateKW    map[string]float64 `yaml:"nameplate_kw"`    // per slave name, overrides the register
+	Currents       string             `yaml:"currents"`        // glob over register names, default mppt*_current
+	Ignore         []string           `yaml:"ignore"`          // <device>.<slave>.<register> left out of the comparison
+	Shortfall      float64            `yaml:"shortfall"`       // flag when below the median by more than this fraction, default 0.1
+	SustainMinutes int                `yaml:"sustain_minutes"` // ... continuously for this long, default 30
+	MinPower       float64            `yaml:"min_power"`       // median AC power (register unit) below which power is not compared
+	MinCurrent     float64            `yaml:"min_current"`     // median MPPT current below which currents are not compared, default 1 A
+	StateFile      string             `yaml:"state_file"`      // default: <config>.peers.json
+}
+
+// PeerResult is the comparison of one inverter (Name peer_power) or MPPT input (Name
+// <register>_peer) with the median of its peers. It is stored as <Name>_deviation, the relative
+// difference from the median, and <Name>_flag.
+type PeerResult struct {
+	Device    string
+	Slave     string
+	Name      string
+	Value     float64 // power per kW of nameplate, or the MPPT current
+	Median    float64
+	Deviation float64
+	Below     time.Time // below the shortfall since, zero when not below
+	Flagged   bool      // below for at least sustain_minutes
+}
+
+// Peers compares inverters with their peers and keeps, between runs, since when each series has
+// been below the shortfall.
+type Peers struct {
+	cfg     PeersConfig
+	path    string
+	sustain time.Duration
+	ignore  map[string]bool
+	below   map[string]time.Time // <device>.<slave>.<name> -> below since
+}
+
+// LoadPeers applies the defaults and reads the state file. It returns nil when cfg is nil.
+func LoadPeers(cfg *PeersConfig, configPath string) (*Peers, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	c := *cfg
+	if c.Match == "" {
+		c.Match = "*"
+	}
+	if c.Power == "" {
+		c.Power = "total_active_power"
+	}
+	if c.Nameplate == "" {
+		c.Nameplate = "nominal_active_power"
+	}
+	if c.Currents == "" {
+		c.Currents = "mppt*_current"
+	}
+	if c.Shortfall <= 0 {
+		c.Shortfall = 0.1
+	}
+	if c.SustainMinutes <= 0 {
+		c.SustainMinutes = 30
+	}
+	if c.MinCurrent <= 0 {
+		c.MinCurrent = 1
+	}
+	for _, glob := range []string{c.Match, c.Currents} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("peers: %q is not a valid glob", glob)
+		}
+	}
+	p := &Peers{
+		cfg:     c,
+		path:    c.StateFile,
+		sustain: time.Duration(c.SustainMinutes) * time.Minute,
+		ignore:  make(map[string]bool),
+		below:   make(map[string]time.Time),
+	}
+	for _, name := range c.Ignore {
+		p.ignore[name] = true
+	}
+	if p.path == "" {
+		p.path = configPath + ".peers.json"
+	}
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.below); err != nil {
+		return nil, fmt.Errorf("peer state %s: %w", p.path, err)
+	}
+	return p, nil
+}
+
+type peerInput struct {
+	device, slave, name string
+	value               float64
+}
+
+// Compare runs the comparison over the values of a run, named <device>.<slave>.<register> as for
+// site derived fields. Groups with fewer than 3 inputs, or with a median under min_power or
+// min_current, are not compared and their series start over.
+func (p *Peers) Compare(vars map[string]float64, ts time.Time) []PeerResult {
+	if p == nil {
+		return nil
+	}
+	var power, currents []peerInput
+	var powers []float64
+	for key, v := range vars {
+		parts := strings.SplitN(key, ".", 3)
+		if len(parts) != 3 || p.ignore[key] {
+			continue
+		}
+		dev, slave, reg := parts[0], parts[1], parts[2]
+		if ok, _ := path.Match(p.cfg.Match, dev+"."+slave); !ok {
+			continue
+		}
+		switch {
+		case reg == p.cfg.Power:
+			nameplate, ok := p.cfg.NameplateKW[slave]
+			if !ok {
+				nameplate = vars[dev+"."+slave+"."+p.cfg.Nameplate]
+			}
+			if nameplate <= 0 {
+				continue
+			}
+			power = append(power, peerInput{dev, slave, "peer_power", v / nameplate})
+			powers = append(powers, v)
+		default:
+			if ok, _ := path.Match(p.cfg.Currents, reg); ok {
+				currents = append(currents, peerInput{dev, slave, reg + "_peer", v})
+			}
+		}
+	}
+
+	var results []PeerResult
+	seen := make(map[string]bool)
+	if len(power) >= 3 && stats.Median(powers) >= p.cfg.MinPower {
+		results = p.compare(results, power, ts, seen)
+	}
+	if len(currents) >= 3 {
+		values := make([]float64, len(currents))
+		for i, in := range currents {
+			values[i] = in.value
+		}
+		if stats.Median(values) >= p.cfg.MinCurrent {
+			results = p.compare(results, currents, ts, seen)
+		}
+	}
+	for series := range p.below {
+		if !seen[series] {
+			delete(p.below, series)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Device+"."+a.Slave != b.Device+"."+b.Slave {
+			return a.Device+"."+a.Slave < b.Device+"."+b.Slave
+		}
+		return a.Name < b.Name
+	})
+	return results
+}
+
+func (p *Peers) compare(results []PeerResult, inputs []peerInput, ts time.Time, seen map[string]bool) []PeerResult {
+	values := make([]float64, len(inputs))
+	for i, in := range inputs {
+		values[i] = in.value
+	}
+	med := stats.Median(values)
+	if med <= 0 {
+		return results
+	}
+	for _, in := range inputs {
+		series := in.device + "." + in.slave + "." + in.name
+		seen[series] = true
+		r := PeerResult{Device: in.device, Slave: in.slave, Name: in.name, Value: in.value, Median: med,
+			Deviation: (in.value - med) / med}
+		if r.Deviation < -p.cfg.Shortfall {
+			since, ok := p.below[series]
+			if !ok {
+				since = ts
+				p.below[series] = ts
+			}
+			r.Below = since
+			r.Flagged = ts.Sub(since) >= p.sustain
+		} else {
+			delete(p.below, series)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// Save writes the state file, replacing it atomically.
+func (p *Peers) Save() error {
+	if p == nil {
+		return nil
+	}
+	return jsonfile.Save(p.path, p.below)
+}
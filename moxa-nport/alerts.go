@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"common/alerts"
+)
+
+// alertSaveInterval is how often the alert state file is rewritten while no alert fires or resolves;
+// cycles come about once a second and the state usually lives on an SD card.
+const alertSaveInterval = time.Minute
+
+// Alerter evaluates the alert rules over every stored cycle. Variables are <port>.<slave_name>.<register>
+// for slave values, <port>.<field> for port derived fields and <field> for site derived fields.
+// Notifications are sent from a worker so a slow SMTP server or webhook does not hold up the store.
+type Alerter struct {
+	engine  *alerts.Engine
+	storage *StorageManager
+	mu      sync.Mutex
+	closed  bool
+	saved   time.Time // last write of the state file
+	sends   chan []alerts.Event
+	wg      sync.WaitGroup
+}
+
+// NewAlerter loads the alert rules and their state file. It returns nil when no rules are configured.
+func NewAlerter(cfg Config, configPath string, storage *StorageManager) (*Alerter, error) {
+	engine, err := alerts.Load(cfg.Alerts, configPath)
+	if err != nil || engine == nil {
+		return nil, err
+	}
+	a := &Alerter{engine: engine, storage: storage, sends: make(chan []alerts.Event, 16)}
+	a.wg.Add(1)
+	go a.sendLoop()
+	return a, nil
+}
+
+// Cycle evaluates the rules over the sets and derived fields stored together in one cycle.
+func (a *Alerter) Cycle(batches []storeBatch, ts time.Time) {
+	if a == nil {
+		return
+	}
+	vars := make(map[string]float64)
+	for _, b := range batches {
+		for _, v := range b.values {
+			switch {
+			case !b.derived:
+				vars[b.port+"."+batchSlaveName(b)+"."+v.Name] = derivedInput(v)
+			case b.port != "":
+				vars[b.port+"."+v.Name] = v.Value
+			default:
+				vars[v.Name] = v.Value
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	events := a.engine.Evaluate(vars, ts)
+	if len(events) > 0 || time.Since(a.saved) >= alertSaveInterval {
+		a.save()
+	}
+	if len(events) == 0 {
+		return
+	}
+	for _, ev := range events {
+		fmt.Printf("ALERT %-8s %-8s %s: %s\n", ev.State, ev.Severity, ev.Rule, ev.Message)
+	}
+	if a.engine.Outputs().Influx {
+		a.storage.StoreAlerts(events)
+	}
+	select {
+	case a.sends <- events:
+	default:
+		fmt.Printf("alerts: notification queue full, %d events not sent\n", len(events))
+	}
+}
+
+func (a *Alerter) sendLoop() {
+	defer a.wg.Done()
+	outputs := a.engine.Outputs()
+	for events := range a.sends {
+		if err := outputs.Send(events); err != nil {
+			fmt.Printf("alerts: %v\n", err)
+		}
+	}
+}
+
+// save writes the state file. a.mu must be held.
+func (a *Alerter) save() {
+	a.saved = time.Now()
+	if err := a.engine.Save(); err != nil {
+		fmt.Printf("alerts: save state: %v\n", err)
+	}
+}
+
+// Close saves the alert state and waits for pending notifications to be sent.
+func (a *Alerter) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.save()
+	}
+	a.closed = true
+	close(a.sends)
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+// batchSlaveName is the name a slave's registers are prefixed with in port and site variables.
+func batchSlaveName(b storeBatch) string {
+	if b.slaveName != "" {
+		return b.slaveName
+	}
+	return fmt.Sprintf("slave_%d", b.slaveID)
+}
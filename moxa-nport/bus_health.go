@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minFrameBytes is the shortest Modbus RTU frame: address, function code and CRC.
+const minFrameBytes = 4
+
+// defaultLatencyBucketsMS are the upper bounds of the response time histogram.
+var defaultLatencyBucketsMS = []int{10, 20, 50, 100, 200, 500, 1000}
+
+// BusHealthMonitor counts line quality per port and slave over fixed windows and stores each
+// closed window as a bus_health point. Windows follow frame receive times, like the aggregation
+// windows of the StoreCoordinator, so captures replay the same way live traffic is measured.
+type BusHealthMonitor struct {
+	storage  *StorageManager
+	interval time.Duration
+	buckets  []time.Duration
+	ports    map[string]*busWindow
+	serial   map[string]SerialSettings
+	known    map[string]map[uint8]struct{} // slaves seen in CRC-valid frames, to attribute CRC errors
+	mu       sync.Mutex
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// busWindow holds the counters of one port during the open window.
+type busWindow struct {
+	start       time.Time
+	first, last time.Time
+	seen        time.Time // wall time of the last frame, to close windows of ports that went quiet
+	traffic     busCounters
+	bytes       int
+	shortFrames int
+	slaves      map[uint8]*busCounters
+}
+
+type busCounters struct {
+	frames     int
+	crcErrors  int
+	requests   int
+	responses  int
+	unanswered int
+	exceptions int
+	latency    latencyStats
+	histogram  []int // responses per latency bucket; the last entry counts those above all bounds
+}
+
+func NewBusHealthMonitor(cfg Config, storage *StorageManager) *BusHealthMonitor {
+	if cfg.BusHealth.IntervalSeconds <= 0 {
+		return nil
+	}
+	bounds := cfg.BusHealth.LatencyBucketsMS
+	if len(bounds) == 0 {
+		bounds = defaultLatencyBucketsMS
+	}
+	bounds = append([]int(nil), bounds...)
+	sort.Ints(bounds)
+	m := &BusHealthMonitor{
+		storage:  storage,
+		interval: time.Duration(cfg.BusHealth.IntervalSeconds) * time.Second,
+		ports:    make(map[string]*busWindow),
+		serial:   make(map[string]SerialSettings),
+		known:    make(map[string]map[uint8]struct{}),
+		stop:     make(chan struct{}),
+	}
+	for _, ms := range bounds {
+		m.buckets = append(m.buckets, time.Duration(ms)*time.Millisecond)
+	}
+	for _, np := range cfg.NPorts {
+		m.serial[np.Name] = np.Serial
+	}
+	m.wg.Add(1)
+	go m.intervalLoop()
+	return m
+}
+
+// Observe counts one frame of a port. The frame must already be summarized and paired.
+func (m *BusHealthMonitor) Observe(port string, s FrameSummary) {
+	if m == nil || s.Length == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := s.ReceivedAt.Truncate(m.interval)
+	w := m.ports[port]
+	if w != nil && start.After(w.start) {
+		m.closeWindow(port, w, w.start.Add(m.interval))
+		w = nil
+	}
+	if w == nil {
+		w = &busWindow{start: start, first: s.ReceivedAt, slaves: make(map[uint8]*busCounters)}
+		m.ports[port] = w
+	}
+	if s.ReceivedAt.After(w.last) {
+		w.last = s.ReceivedAt
+	}
+	w.seen = time.Now()
+	w.bytes += s.Length
+	w.traffic.frames++
+	if s.Length < minFrameBytes {
+		w.shortFrames++
+		return
+	}
+	if s.CRCValid == nil || !*s.CRCValid {
+		w.traffic.crcErrors++
+		// The address byte of a corrupted frame is only trusted for slaves already seen intact.
+		if _, ok := m.known[port][s.SlaveID]; ok {
+			st := w.slave(s.SlaveID)
+			st.frames++
+			st.crcErrors++
+		}
+		return
+	}
+	if m.known[port] == nil {
+		m.known[port] = make(map[uint8]struct{})
+	}
+	m.known[port][s.SlaveID] = struct{}{}
+	st := w.slave(s.SlaveID)
+	st.frames++
+	for _, id := range s.Unanswered {
+		w.traffic.unanswered++
+		w.slave(id).unanswered++
+	}
+	switch {
+	case s.IsRequest:
+		w.traffic.requests++
+		st.requests++
+	case s.ExceptionCode != nil:
+		w.traffic.exceptions++
+		st.exceptions++
+	case s.IsResponse:
+		w.traffic.responses++
+		st.responses++
+		m.addLatency(&w.traffic, s.Latency)
+		m.addLatency(st, s.Latency)
+	}
+}
+
+func (w *busWindow) slave(id uint8) *busCounters {
+	st := w.slaves[id]
+	if st == nil {
+		st = &busCounters{}
+		w.slaves[id] = st
+	}
+	return st
+}
+
+func (m *BusHealthMonitor) addLatency(c *busCounters, d time.Duration) {
+	if c.histogram == nil {
+		c.histogram = make([]int, len(m.buckets)+1)
+	}
+	c.latency.add(d)
+	i := sort.Search(len(m.buckets), func(i int) bool { return d <= m.buckets[i] })
+	c.histogram[i]++
+}
+
+// intervalLoop closes the windows of ports that sent nothing for two intervals. Busy ports close
+// their windows as frames of the next one arrive.
+func (m *BusHealthMonitor) intervalLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for port, w := range m.ports {
+				if now.Sub(w.seen) >= 2*m.interval {
+					m.closeWindow(port, w, w.start.Add(m.interval))
+					delete(m.ports, port)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the interval loop and stores the open windows, measured up to their last frame.
+func (m *BusHealthMonitor) Close() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ports := make([]string, 0, len(m.ports))
+	for port := range m.ports {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		w := m.ports[port]
+		m.closeWindow(port, w, w.last)
+		delete(m.ports, port)
+	}
+}
+
+// closeWindow stores the window, stamped at its start, or prints it when no storage is configured.
+// Bus utilization is the share of the window, from its first frame to end, the line spent
+// transmitting. Callers hold m.mu.
+func (m *BusHealthMonitor) closeWindow(port string, w *busWindow, end time.Time) {
+	from := w.start
+	if w.first.After(from) {
+		from = w.first
+	}
+	utilization := -1.0
+	if baud := m.serial[port].Baud; baud > 0 && end.After(from) {
+		bits := float64(w.bytes) * bitsPerChar(m.serial[port])
+		utilization = bits / float64(baud) / end.Sub(from).Seconds()
+	}
+
+	ids := make([]int, 0, len(w.slaves))
+	for id := range w.slaves {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	var b strings.Builder
+	ts := w.start.UnixNano()
+	fmt.Fprintf(&b, "bus_health,port=%s %s,bytes=%di,short_frames=%di", escapeTag(port), m.fields(w.traffic), w.bytes, w.shortFrames)
+	if utilization >= 0 {
+		b.WriteString(",utilization=" + strconv.FormatFloat(utilization, 'f', -1, 64))
+	}
+	fmt.Fprintf(&b, " %d\n", ts)
+	for _, id := range ids {
+		fmt.Fprintf(&b, "bus_health,port=%s,slave=%d %s %d\n", escapeTag(port), id, m.fields(*w.slaves[uint8(id)]), ts)
+	}
+
+	if m.storage == nil {
+		util := "n/a"
+		if utilization >= 0 {
+			util = fmt.Sprintf("%.1f%%", utilization*100)
+		}
+		fmt.Printf("[%s] bus health %s: frames=%d crc_errors=%d short=%d unanswered=%d exceptions=%d utilization=%s\n",
+			port, w.start.Format(time.RFC3339), w.traffic.frames, w.traffic.crcErrors, w.shortFrames,
+			w.traffic.unanswered, w.traffic.exceptions, util)
+		return
+	}
+	m.storage.StoreBusHealth(b.String())
+}
+
+// fields formats the counters of a port or slave. Ratios are omitted when their denominator is zero;
+// latency_le_<ms> buckets are cumulative like a Prometheus histogram.
+func (m *BusHealthMonitor) fields(c busCounters) string {
+	f := []string{
+		fmt.Sprintf("frames=%di", c.frames),
+		fmt.Sprintf("crc_errors=%di", c.crcErrors),
+		fmt.Sprintf("requests=%di", c.requests),
+		fmt.Sprintf("responses=%di", c.responses),
+		fmt.Sprintf("unanswered=%di", c.unanswered),
+		fmt.Sprintf("exceptions=%di", c.exceptions),
+	}
+	ratio := func(name string, n, d int) {
+		if d > 0 {
+			f = append(f, name+"="+strconv.FormatFloat(float64(n)/float64(d), 'f', -1, 64))
+		}
+	}
+	ratio("crc_error_ratio", c.crcErrors, c.frames)
+	ratio("unanswered_ratio", c.unanswered, c.requests)
+	ratio("exception_ratio", c.exceptions, c.responses+c.exceptions)
+	if c.latency.count > 0 {
+		f = append(f,
+			"latency_mean_ms="+strconv.FormatFloat(durationMS(c.latency.sum/time.Duration(c.latency.count)), 'f', -1, 64),
+			"latency_max_ms="+strconv.FormatFloat(durationMS(c.latency.max), 'f', -1, 64),
+		)
+		cumulative := 0
+		for i, bound := range m.buckets {
+			cumulative += c.histogram[i]
+			f = append(f, fmt.Sprintf("latency_le_%d=%di", bound.Milliseconds(), cumulative))
+		}
+		f = append(f, fmt.Sprintf("latency_le_inf=%di", c.latency.count))
+	}
+	return strings.Join(f, ",")
+}
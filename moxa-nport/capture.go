@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"common/profiles"
+)
+
+const defaultCaptureFileBytes = 64 << 20
+
+// captureHeader is the first line of every capture file. Chunk offsets are relative to Session.
+type captureHeader struct {
+	Format  string    `json:"format"`
+	Session time.Time `json:"session"`
+}
+
+// captureRecord is one received TCP chunk. MonoNS is a monotonic offset from the session start.
+type captureRecord struct {
+	MonoNS int64  `json:"mono_ns"`
+	Port   string `json:"port"`
+	Data   []byte `json:"data"`
+}
+
+const captureFormat = "moxa-nport-capture/1"
+
+// Recorder appends received chunks from all ports to rotating JSONL capture files.
+type Recorder struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxFiles int
+	session  time.Time
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+}
+
+// NewRecorder returns nil when recording is not configured.
+func NewRecorder(cfg RecordConfig) (*Recorder, error) {
+	if strings.TrimSpace(cfg.Dir) == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	maxBytes := cfg.MaxFileBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureFileBytes
+	}
+	return &Recorder{
+		dir:      cfg.Dir,
+		maxBytes: maxBytes,
+		maxFiles: cfg.MaxFiles,
+		session:  time.Now(),
+	}, nil
+}
+
+// Record writes one chunk. Errors are logged and do not interrupt acquisition.
+func (r *Recorder) Record(port string, data []byte, at time.Time) {
+	if r == nil || len(data) == 0 {
+		return
+	}
+	line, err := json.Marshal(captureRecord{MonoNS: int64(at.Sub(r.session)), Port: port, Data: data})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil || r.size >= r.maxBytes {
+		if err := r.rotate(at); err != nil {
+			fmt.Printf("recorder: %v\n", err)
+			return
+		}
+	}
+	n, err := r.w.Write(append(line, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		fmt.Printf("recorder: write failed: %v\n", err)
+	}
+}
+
+// Close flushes and closes the current capture file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+func (r *Recorder) rotate(at time.Time) error {
+	if err := r.closeFile(); err != nil {
+		fmt.Printf("recorder: close failed: %v\n", err)
+	}
+	name := filepath.Join(r.dir, "capture-"+at.UTC().Format("20060102T150405.000Z")+".jsonl")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.w = bufio.NewWriter(f)
+	r.size = 0
+	header, _ := json.Marshal(captureHeader{Format: captureFormat, Session: r.session.UTC()})
+	n, err := r.w.Write(append(header, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recorder: writing %s\n", name)
+	r.prune()
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	flushErr := r.w.Flush()
+	closeErr := r.file.Close()
+	r.file, r.w = nil, nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// prune removes the oldest capture files beyond maxFiles.
+func (r *Recorder) prune() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(r.dir, "capture-*.jsonl"))
+	if err != nil || len(files) <= r.maxFiles {
+		return
+	}
+	sort.Strings(files)
+	for _, old := range files[:len(files)-r.maxFiles] {
+		if err := os.Remove(old); err != nil {
+			fmt.Printf("recorder: remove %s: %v\n", old, err)
+		}
+	}
+}
+
+// recordingSource copies every chunk read from src into the recorder.
+type recordingSource struct {
+	src      chunkSource
+	port     string
+	recorder *Recorder
+}
+
+func (r recordingSource) readChunk(buf []byte, idleGap time.Duration) (int, time.Time, error) {
+	n, at, err := r.src.readChunk(buf, idleGap)
+	if n > 0 {
+		r.recorder.Record(r.port, buf[:n], at)
+	}
+	return n, at, err
+}
+
+// runCaptureReplay feeds recorded chunks for one port back through the frame pipeline.
+func runCaptureReplay(ctx context.Context, cfg ReplayConfig, np NPortConfig, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, health *BusHealthMonitor, lib *profiles.Library, subMode string) {
+	files, err := expandCaptureFiles(cfg.Files)
+	if err != nil {
+		fmt.Printf("[%s] replay: %v\n", np.Name, err)
+		return
+	}
+	src := newReplaySource(ctx, files, np.Name, cfg.Speed)
+	defer src.Close()
+
+	idleGap, readBufSize, maxFrame := streamLimits(np)
+	handler := newFrameHandler(np, subMode, storage, storeCoord, lib)
+
+	fmt.Printf("[%s] replaying %d capture file(s) at speed %s\n", np.Name, len(files), replaySpeedLabel(cfg.Speed))
+	err = streamFrames(ctx, src, np, idleGap, readBufSize, maxFrame, collector, storage, storeCoord, health, handler)
+	switch {
+	case errors.Is(err, errHandlerComplete):
+		fmt.Printf("[%s] handler completed; stopping replay\n", np.Name)
+	case errors.Is(err, io.EOF):
+		fmt.Printf("[%s] replay finished: %d chunks\n", np.Name, src.chunks)
+	case err != nil:
+		fmt.Printf("[%s] replay stopped: %v\n", np.Name, err)
+	}
+}
+
+func expandCaptureFiles(patterns []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]struct{})
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if _, dup := seen[m]; dup {
+				continue
+			}
+			seen[m] = struct{}{}
+			files = append(files, m)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no capture files matched replay.files")
+	}
+	return files, nil
+}
+
+func replaySpeedLabel(speed float64) string {
+	if speed <= 0 {
+		return "max"
+	}
+	return trimFloat(speed) + "x"
+}
+
+// replaySource reads capture files in order and yields the chunks recorded for one port.
+type replaySource struct {
+	timedSource
+	ctx     context.Context
+	files   []string
+	port    string
+	speed   float64
+	file    *os.File
+	scanner *bufio.Scanner
+	session time.Time
+	chunks  int
+
+	// pacing anchors: the first replayed chunk time and the wall clock when it was replayed
+	firstAt   time.Time
+	wallStart time.Time
+}
+
+func newReplaySource(ctx context.Context, files []string, port string, speed float64) *replaySource {
+	src := &replaySource{ctx: ctx, files: files, port: port, speed: speed}
+	src.next = src.nextRecord
+	return src
+}
+
+func (r *replaySource) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *replaySource) nextRecord() ([]byte, time.Time, error) {
+	for {
+		if r.scanner == nil {
+			if err := r.openNext(); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				fmt.Printf("[%s] replay: %s: %v\n", r.port, r.file.Name(), err)
+			}
+			_ = r.Close()
+			r.scanner = nil
+			continue
+		}
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec captureRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Port == "" {
+			continue
+		}
+		at := r.session.Add(time.Duration(rec.MonoNS))
+		if rec.Port != r.port || len(rec.Data) == 0 {
+			continue
+		}
+		if err := r.pace(at); err != nil {
+			return nil, time.Time{}, err
+		}
+		r.chunks++
+		return rec.Data, at, nil
+	}
+}
+
+// openNext opens the next capture file and reads its header.
+func (r *replaySource) openNext() error {
+	if len(r.files) == 0 {
+		return io.EOF
+	}
+	name := r.files[0]
+	r.files = r.files[1:]
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Printf("[%s] replay: %v\n", r.port, err)
+		return nil
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	var header captureHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Format != captureFormat {
+		fmt.Printf("[%s] replay: %s is not a capture file; skipping\n", r.port, name)
+		_ = f.Close()
+		return nil
+	}
+	r.file = f
+	r.scanner = scanner
+	r.session = header.Session
+	return nil
+}
+
+// pace sleeps so chunks are delivered with their original spacing divided by speed.
+func (r *replaySource) pace(at time.Time) error {
+	if r.speed <= 0 {
+		return nil
+	}
+	if r.firstAt.IsZero() {
+		r.firstAt = at
+		r.wallStart = time.Now()
+		return nil
+	}
+	due := r.wallStart.Add(time.Duration(float64(at.Sub(r.firstAt)) / r.speed))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,31 +1,154 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// maxRangesPerSlave bounds the distinct request ranges remembered for one slave.
+const maxRangesPerSlave = 256
+
 type SlaveCollector struct {
-	mu  sync.Mutex
-	ids map[string]map[uint8]struct{}
+	mu    sync.Mutex
+	ids   map[string]map[uint8]struct{}
+	ports map[string]*portTraffic
+}
+
+// portTraffic accumulates what was observed on one port for the discovery report.
+type portTraffic struct {
+	first, last time.Time
+	frames      int
+	crcErrors   int
+	requests    int
+	responses   int
+	unanswered  int
+	exceptions  int
+	slaves      map[uint8]*slaveTraffic
+}
+
+type slaveTraffic struct {
+	frames     int
+	requests   int
+	responses  int
+	unanswered int
+	functions  map[uint8]int
+	ranges     map[registerRange]int
+	exceptions map[uint8]int
+	latency    latencyStats
+}
+
+type registerRange struct {
+	function uint8
+	start    int
+	count    int
+}
+
+type latencyStats struct {
+	count    int
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if l.count == 0 || d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.sum += d
 }
 
 func NewSlaveCollector() *SlaveCollector {
-	return &SlaveCollector{ids: make(map[string]map[uint8]struct{})}
+	return &SlaveCollector{ids: make(map[string]map[uint8]struct{}), ports: make(map[string]*portTraffic)}
 }
 
-func (c *SlaveCollector) Record(port string, slave uint8) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *SlaveCollector) record(port string, slave uint8) {
 	if c.ids[port] == nil {
 		c.ids[port] = make(map[uint8]struct{})
 	}
 	c.ids[port][slave] = struct{}{}
 }
 
+// Observe counts a frame for the discovery report. Slave IDs are only taken from CRC-valid frames.
+func (c *SlaveCollector) Observe(port string, s FrameSummary) {
+	if c == nil || s.Length == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.ports[port]
+	if pt == nil {
+		pt = &portTraffic{slaves: make(map[uint8]*slaveTraffic)}
+		c.ports[port] = pt
+	}
+	if pt.first.IsZero() || s.ReceivedAt.Before(pt.first) {
+		pt.first = s.ReceivedAt
+	}
+	if s.ReceivedAt.After(pt.last) {
+		pt.last = s.ReceivedAt
+	}
+	pt.frames++
+	if s.CRCValid == nil || !*s.CRCValid {
+		pt.crcErrors++
+		return
+	}
+	c.record(port, s.SlaveID)
+
+	st := pt.slave(s.SlaveID)
+	st.frames++
+	st.functions[s.FunctionCode&^0x80]++
+	for _, id := range s.Unanswered {
+		pt.unanswered++
+		pt.slave(id).unanswered++
+	}
+	switch {
+	case s.IsRequest:
+		pt.requests++
+		st.requests++
+		r := registerRange{function: s.FunctionCode, start: *s.StartRegister, count: s.RegisterCount}
+		if _, ok := st.ranges[r]; ok || len(st.ranges) < maxRangesPerSlave {
+			st.ranges[r]++
+		}
+	case s.ExceptionCode != nil:
+		pt.exceptions++
+		st.exceptions[*s.ExceptionCode]++
+		if s.Latency > 0 {
+			st.latency.add(s.Latency)
+		}
+	case s.IsResponse:
+		pt.responses++
+		st.responses++
+		st.latency.add(s.Latency)
+	}
+}
+
+func (pt *portTraffic) slave(id uint8) *slaveTraffic {
+	st := pt.slaves[id]
+	if st == nil {
+		st = &slaveTraffic{
+			functions:  make(map[uint8]int),
+			ranges:     make(map[registerRange]int),
+			exceptions: make(map[uint8]int),
+		}
+		pt.slaves[id] = st
+	}
+	return st
+}
+
 func (c *SlaveCollector) Report() map[string][]uint8 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -60,3 +183,227 @@ func (c *SlaveCollector) WriteFile(path string) error {
 	}
 	return os.WriteFile(path, []byte(b.String()), 0644)
 }
+
+// DiscoveryReport is the structured result of a discovery (test) run.
+type DiscoveryReport struct {
+	GeneratedAt time.Time          `json:"generated_at" yaml:"generated_at"`
+	Ports       []PortDiscovery    `json:"ports" yaml:"ports"`
+	Skeleton    *DiscoverySkeleton `json:"config_skeleton,omitempty" yaml:"config_skeleton,omitempty"`
+}
+
+type PortDiscovery struct {
+	Name            string           `json:"name" yaml:"name"`
+	FirstFrame      time.Time        `json:"first_frame" yaml:"first_frame"`
+	LastFrame       time.Time        `json:"last_frame" yaml:"last_frame"`
+	DurationSeconds float64          `json:"duration_seconds" yaml:"duration_seconds"`
+	Frames          int              `json:"frames" yaml:"frames"`
+	CRCErrors       int              `json:"crc_errors" yaml:"crc_errors"`
+	CRCErrorRate    float64          `json:"crc_error_rate" yaml:"crc_error_rate"`
+	Requests        int              `json:"requests" yaml:"requests"`
+	RequestRate     float64          `json:"requests_per_second" yaml:"requests_per_second"`
+	Responses       int              `json:"responses" yaml:"responses"`
+	Unanswered      int              `json:"unanswered" yaml:"unanswered"`
+	Exceptions      int              `json:"exceptions" yaml:"exceptions"`
+	Slaves          []SlaveDiscovery `json:"slaves" yaml:"slaves"`
+}
+
+type SlaveDiscovery struct {
+	ID            uint8            `json:"id" yaml:"id"`
+	Frames        int              `json:"frames" yaml:"frames"`
+	Requests      int              `json:"requests" yaml:"requests"`
+	Responses     int              `json:"responses" yaml:"responses"`
+	Unanswered    int              `json:"unanswered" yaml:"unanswered"`
+	FunctionCodes []int            `json:"function_codes" yaml:"function_codes,flow"`
+	Ranges        []RangeDiscovery `json:"register_ranges,omitempty" yaml:"register_ranges,omitempty"`
+	Exceptions    map[uint8]int    `json:"exceptions,omitempty" yaml:"exceptions,omitempty"`
+	LatencyMS     *LatencySummary  `json:"latency_ms,omitempty" yaml:"latency_ms,omitempty"`
+}
+
+type RangeDiscovery struct {
+	FunctionCode uint8 `json:"function_code" yaml:"function_code"`
+	Start        int   `json:"start" yaml:"start"`
+	Count        int   `json:"count" yaml:"count"`
+	Requests     int   `json:"requests" yaml:"requests"`
+}
+
+// LatencySummary is measured from the start of a request to the start of its response.
+type LatencySummary struct {
+	Min   float64 `json:"min" yaml:"min"`
+	Mean  float64 `json:"mean" yaml:"mean"`
+	Max   float64 `json:"max" yaml:"max"`
+	Count int     `json:"count" yaml:"count"`
+}
+
+// DiscoverySkeleton is a starting point for the nports section of a store config.
+type DiscoverySkeleton struct {
+	NPorts []SkeletonPort `json:"nports" yaml:"nports"`
+}
+
+type SkeletonPort struct {
+	Name           string          `json:"name" yaml:"name"`
+	DetectedSlaves []int           `json:"detected_slaves" yaml:"detected_slaves,flow"`
+	Slaves         []SkeletonSlave `json:"slaves" yaml:"slaves"`
+}
+
+type SkeletonSlave struct {
+	Address   uint8              `json:"address" yaml:"address"`
+	Name      string             `json:"name" yaml:"name"`
+	Registers []SkeletonRegister `json:"registers,omitempty" yaml:"registers,omitempty"`
+}
+
+// SkeletonRegister follows RegisterConfig: Register is the offset within the response data.
+type SkeletonRegister struct {
+	Register     int    `json:"register" yaml:"register"`
+	RegisterName string `json:"register_name" yaml:"register_name"`
+	RegisterType string `json:"register_type" yaml:"register_type"`
+}
+
+// Discovery builds the structured report, including a config skeleton for the slaves that answered.
+func (c *SlaveCollector) Discovery() DiscoveryReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := DiscoveryReport{GeneratedAt: time.Now().UTC(), Skeleton: &DiscoverySkeleton{}}
+	names := make([]string, 0, len(c.ports))
+	for name := range c.ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pt := c.ports[name]
+		pd := PortDiscovery{
+			Name:       name,
+			FirstFrame: pt.first.UTC(),
+			LastFrame:  pt.last.UTC(),
+			Frames:     pt.frames,
+			CRCErrors:  pt.crcErrors,
+			Requests:   pt.requests,
+			Responses:  pt.responses,
+			Unanswered: pt.unanswered,
+			Exceptions: pt.exceptions,
+		}
+		pd.DurationSeconds = pt.last.Sub(pt.first).Seconds()
+		if pt.frames > 0 {
+			pd.CRCErrorRate = float64(pt.crcErrors) / float64(pt.frames)
+		}
+		if pd.DurationSeconds > 0 {
+			pd.RequestRate = float64(pt.requests) / pd.DurationSeconds
+		}
+
+		sp := SkeletonPort{Name: name}
+		ids := make([]int, 0, len(pt.slaves))
+		for id := range pt.slaves {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, i := range ids {
+			id := uint8(i)
+			st := pt.slaves[id]
+			sd := SlaveDiscovery{
+				ID:         id,
+				Frames:     st.frames,
+				Requests:   st.requests,
+				Responses:  st.responses,
+				Unanswered: st.unanswered,
+			}
+			for fc := range st.functions {
+				sd.FunctionCodes = append(sd.FunctionCodes, int(fc))
+			}
+			sort.Ints(sd.FunctionCodes)
+			for r, n := range st.ranges {
+				sd.Ranges = append(sd.Ranges, RangeDiscovery{FunctionCode: r.function, Start: r.start, Count: r.count, Requests: n})
+			}
+			sort.Slice(sd.Ranges, func(a, b int) bool {
+				ra, rb := sd.Ranges[a], sd.Ranges[b]
+				if ra.FunctionCode != rb.FunctionCode {
+					return ra.FunctionCode < rb.FunctionCode
+				}
+				if ra.Start != rb.Start {
+					return ra.Start < rb.Start
+				}
+				return ra.Count < rb.Count
+			})
+			if len(st.exceptions) > 0 {
+				sd.Exceptions = st.exceptions
+			}
+			if st.latency.count > 0 {
+				sd.LatencyMS = &LatencySummary{
+					Min:   durationMS(st.latency.min),
+					Mean:  durationMS(st.latency.sum / time.Duration(st.latency.count)),
+					Max:   durationMS(st.latency.max),
+					Count: st.latency.count,
+				}
+			}
+			pd.Slaves = append(pd.Slaves, sd)
+
+			// Slaves that never answered are most likely addresses the master polls in vain.
+			if st.responses == 0 {
+				continue
+			}
+			sp.DetectedSlaves = append(sp.DetectedSlaves, i)
+			sp.Slaves = append(sp.Slaves, SkeletonSlave{
+				Address:   id,
+				Name:      fmt.Sprintf("%s_slave_%d", strings.ToLower(name), id),
+				Registers: skeletonRegisters(sd.Ranges),
+			})
+		}
+		report.Ports = append(report.Ports, pd)
+		report.Skeleton.NPorts = append(report.Skeleton.NPorts, sp)
+	}
+	return report
+}
+
+// skeletonRegisters lists the registers of the most requested range, named by their address.
+func skeletonRegisters(ranges []RangeDiscovery) []SkeletonRegister {
+	var best *RangeDiscovery
+	for i := range ranges {
+		if best == nil || ranges[i].Requests > best.Requests {
+			best = &ranges[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	regs := make([]SkeletonRegister, 0, best.Count)
+	for i := 0; i < best.Count; i++ {
+		regs = append(regs, SkeletonRegister{
+			Register:     i,
+			RegisterName: fmt.Sprintf("reg_%d", best.Start+i),
+			RegisterType: "uint16",
+		})
+	}
+	return regs
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// WriteDiscovery writes the discovery report as JSON when path ends in .json, otherwise as YAML.
+func (c *SlaveCollector) WriteDiscovery(path string) error {
+	report := c.Discovery()
+	var (
+		data []byte
+		err  error
+	)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		data, err = json.MarshalIndent(report, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// WriteSkeleton writes only the config skeleton, ready to paste into a store config.
+func (c *SlaveCollector) WriteSkeleton(path string) error {
+	data, err := yaml.Marshal(c.Discovery().Skeleton)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
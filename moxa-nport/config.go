@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
+	"common/alerts"
+	"common/expr"
+	"common/solar"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -11,10 +16,59 @@ type Config struct {
 	Mode    string `yaml:"mode"`
 	SubMode string `yaml:"sub_mode"`
 	// TestDurationSeconds applies to test sub-mode; if >0 the program stops after this many seconds.
-	TestDurationSeconds int           `yaml:"test_duration_seconds"`
-	TestOnlyValidCRC    bool          `yaml:"test_only_valid_crc"`
-	NPorts              []NPortConfig `yaml:"nports"`
-	Storage             StorageConfig `yaml:"storage"`
+	TestDurationSeconds int  `yaml:"test_duration_seconds"`
+	TestOnlyValidCRC    bool `yaml:"test_only_valid_crc"`
+	// StoreDeadlineSeconds applies to store sub-mode; if >0, what was received is stored after this many
+	// seconds even when some detected_slaves never answered, and the missing ones are recorded.
+	StoreDeadlineSeconds int              `yaml:"store_deadline_seconds"`
+	NPorts               []NPortConfig    `yaml:"nports"`
+	Storage              StorageConfig    `yaml:"storage"`
+	ProfileDirs          []string         `yaml:"profile_dirs"` // device profile directories overriding the built-in ones
+	Record               RecordConfig     `yaml:"record"`       // optional raw chunk recorder
+	Replay               ReplayConfig     `yaml:"replay"`       // input for the replay sub-mode
+	Continuous           ContinuousConfig `yaml:"continuous"`
+	Aggregate            AggregateConfig  `yaml:"aggregate"`  // optional windowed statistics for store, continuous and replay
+	BusHealth            BusHealthConfig  `yaml:"bus_health"` // optional line quality metrics per port and slave
+	Derived              []expr.Field     `yaml:"derived"`    // optional site fields over <port>.<slave_name>.<register>
+	Alerts               alerts.Config    `yaml:"alerts"`     // optional alert rules over every stored cycle
+	Solar                *solar.Config    `yaml:"solar"`      // optional site location; adds sun position site fields
+}
+
+// BusHealthConfig enables bus_health points: CRC errors, short frames, unanswered requests, exceptions,
+// response time histogram and bus utilization against the port's baud rate, per port and slave.
+// Without storage (test sub-mode) a summary is printed per window instead.
+type BusHealthConfig struct {
+	IntervalSeconds  int   `yaml:"interval_seconds"`   // 0 disables bus health monitoring
+	LatencyBucketsMS []int `yaml:"latency_buckets_ms"` // histogram upper bounds (default 10, 20, 50, 100, 200, 500, 1000)
+}
+
+// AggregateConfig aggregates each register over a window aligned to the wall clock. At the window end
+// the selected statistics are stored as <name>_<stat> fields; without stats, float registers store
+// their mean under the register name and integer registers a <name>_mean field. QC flags store every
+// check that failed in the window.
+type AggregateConfig struct {
+	WindowSeconds int      `yaml:"window_seconds"` // 0 disables windowing
+	Stats         []string `yaml:"stats"`          // mean, min, max, last, count, stddev (default mean)
+}
+
+// ContinuousConfig controls the continuous sub-mode, which keeps listening and storing until stopped.
+// The replay sub-mode stores the same way, through the whole recording.
+type ContinuousConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds"` // 0 writes every cycle; >0 writes one aggregate per slave per interval (aggregate.window_seconds takes precedence)
+	QueueSize       int `yaml:"queue_size"`       // pending writes kept while storage is slow (default 256); oldest are dropped
+}
+
+// RecordConfig enables recording of every received TCP chunk into rotating JSONL capture files.
+type RecordConfig struct {
+	Dir          string `yaml:"dir"`            // empty disables recording
+	MaxFileBytes int64  `yaml:"max_file_bytes"` // rotate after this size (default 64 MiB)
+	MaxFiles     int    `yaml:"max_files"`      // keep at most this many files; 0 keeps all
+}
+
+// ReplayConfig selects recorded capture files and the playback speed for the replay sub-mode.
+type ReplayConfig struct {
+	Files []string `yaml:"files"` // file paths or glob patterns, played in name order
+	Speed float64  `yaml:"speed"` // 1 = original timing, 10 = ten times faster, 0 = as fast as possible
 }
 
 // NPortConfig defines connection parameters for a single NPort device.
@@ -22,7 +76,7 @@ type NPortConfig struct {
 	Name              string         `yaml:"name"`
 	Host              string         `yaml:"host"`
 	Port              int            `yaml:"port"`
-	DeviceType        string         `yaml:"device_type"` // optional hint for parsing payloads
+	DeviceType        string         `yaml:"device_type"` // optional profile name (e.g. dustiq, kipp_smp) used to decode frames
 	IdleGapMS         int            `yaml:"idle_gap_ms"` // gap of silence that delimits a frame
 	Serial            SerialSettings `yaml:"serial"`
 	DialTimeoutMS     int            `yaml:"dial_timeout_ms"`     // timeout for establishing the TCP connection
@@ -33,13 +87,18 @@ type NPortConfig struct {
 	ConnectionKeepLog bool           `yaml:"connection_keep_log"` // log heartbeat while connected
 	SkipInvalidCRC    bool           `yaml:"skip_invalid_crc"`    // if true, ignore frames with bad CRC
 	Slaves            []SlaveConfig  `yaml:"slaves"`              // optional per-slave register maps
-	DetectedSlaves    []uint8        `yaml:"detected_slaves"`     // expected slaves for store sub-mode
+	DetectedSlaves    []uint8        `yaml:"detected_slaves"`     // expected slaves for store sub-mode; in continuous and replay, limits which slaves are stored
+	Derived           []expr.Field   `yaml:"derived"`             // optional port fields over <slave_name>.<register>
+	Quality           *QualityConfig `yaml:"quality"`             // optional irradiance QC flags, needs solar
 }
 
 // StorageConfig defines local and remote storage destinations.
 type StorageConfig struct {
 	Local   []StorageTarget `yaml:"local"`
 	Remotes []StorageTarget `yaml:"remotes"`
+	// TimestampGridSeconds truncates stored timestamps to this grid (60 = whole minute, like the pollers);
+	// 0 keeps the receive time of each frame.
+	TimestampGridSeconds int `yaml:"timestamp_grid_seconds"`
 }
 
 // StorageTarget represents a single database destination.
@@ -63,17 +122,24 @@ type SerialSettings struct {
 
 // SlaveConfig holds a Modbus slave address and its known registers.
 type SlaveConfig struct {
-	Address   uint8            `yaml:"address"`
-	Name      string           `yaml:"name"`
-	Registers []RegisterConfig `yaml:"registers"`
+	Address    uint8            `yaml:"address"`
+	Name       string           `yaml:"name"`
+	DeviceType string           `yaml:"device_type"` // optional profile overriding the port's device_type
+	Registers  []RegisterConfig `yaml:"registers"`
+	Derived    []expr.Field     `yaml:"derived"` // optional fields computed from this slave's registers
 }
 
 // RegisterConfig describes a known register mapping for easier decoding.
+// The decoded value is raw*gain + offset; scaled and floating point registers are stored as float fields.
 type RegisterConfig struct {
-	Register      int    `yaml:"register"`
-	RegisterName  string `yaml:"register_name"`
-	RegisterType  string `yaml:"register_type"`  // supported: int16, uint16 (default int16)
-	RegisterCount int    `yaml:"register_count"` // currently only 1 is supported
+	Register      int     `yaml:"register"`
+	RegisterName  string  `yaml:"register_name"`
+	RegisterType  string  `yaml:"register_type"`  // int16, uint16, int32, uint32, float32 (default int16)
+	RegisterCount int     `yaml:"register_count"` // optional; must match the type width (1 or 2)
+	WordOrder     string  `yaml:"word_order"`     // 32-bit types: "big" (high word first, default) or "little"
+	Gain          float64 `yaml:"gain"`           // optional multiplier (default 1)
+	Offset        float64 `yaml:"offset"`         // optional value added after gain
+	Unit          string  `yaml:"unit"`           // optional unit, stored as a tag
 }
 
 func loadConfig(path string) (Config, error) {
@@ -86,6 +152,20 @@ func loadConfig(path string) (Config, error) {
 	if err := yaml.Unmarshal(raw, &cfg); err != nil {
 		return Config{}, err
 	}
+	for _, st := range cfg.Aggregate.Stats {
+		if !validAggregateStat(st) {
+			return Config{}, fmt.Errorf("aggregate: unknown stat %q (mean, min, max, last, count, stddev)", st)
+		}
+	}
+	for _, np := range cfg.NPorts {
+		for _, slave := range np.Slaves {
+			for _, reg := range slave.Registers {
+				if err := validateRegister(reg); err != nil {
+					return Config{}, fmt.Errorf("nport %s slave %d (%s) register %s: %w", np.Name, slave.Address, slave.Name, reg.RegisterName, err)
+				}
+			}
+		}
+	}
 
 	return cfg, nil
 }
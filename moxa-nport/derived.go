@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"common/expr"
+	"common/solar"
+)
+
+// Deriver computes the derived fields configured per slave, per port and for the site.
+// Slave fields see the slave's register names. Port fields see <slave_name>.<register> of the
+// port's slaves; site fields see <port>.<slave_name>.<register>, <port>.<field> and the sun position
+// fields of the solar section.
+type Deriver struct {
+	slaves map[string]map[uint8]*expr.Set
+	ports  map[string]*expr.Set
+	site   *expr.Set
+	solar  *solar.Config
+
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// NewDeriver compiles the derived sections of cfg. It returns nil when none are configured.
+func NewDeriver(cfg Config) (*Deriver, error) {
+	d := &Deriver{
+		slaves: make(map[string]map[uint8]*expr.Set),
+		ports:  make(map[string]*expr.Set),
+		solar:  cfg.Solar,
+		warned: make(map[string]bool),
+	}
+	var err error
+	if d.site, err = expr.CompileSet(cfg.Derived); err != nil {
+		return nil, fmt.Errorf("site derived: %w", err)
+	}
+	configured := d.site != nil || d.solar != nil
+	for _, np := range cfg.NPorts {
+		set, err := expr.CompileSet(np.Derived)
+		if err != nil {
+			return nil, fmt.Errorf("nport %s derived: %w", np.Name, err)
+		}
+		if set != nil {
+			d.ports[np.Name] = set
+			configured = true
+		}
+		for _, sl := range np.Slaves {
+			set, err := expr.CompileSet(sl.Derived)
+			if err != nil {
+				return nil, fmt.Errorf("nport %s slave %d derived: %w", np.Name, sl.Address, err)
+			}
+			if set == nil {
+				continue
+			}
+			if d.slaves[np.Name] == nil {
+				d.slaves[np.Name] = make(map[uint8]*expr.Set)
+			}
+			d.slaves[np.Name][sl.Address] = set
+			configured = true
+		}
+	}
+	if !configured {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// Slave returns values followed by the slave's derived fields.
+func (d *Deriver) Slave(port string, slaveID uint8, values []RegisterValue) []RegisterValue {
+	if d == nil {
+		return values
+	}
+	set := d.slaves[port][slaveID]
+	if set == nil {
+		return values
+	}
+	vars := make(map[string]float64, len(values))
+	for _, v := range values {
+		vars[v.Name] = derivedInput(v)
+	}
+	results, err := set.Eval(vars)
+	d.warn(fmt.Sprintf("[%s] slave %d", port, slaveID), err)
+	if len(results) == 0 {
+		return values
+	}
+	out := make([]RegisterValue, 0, len(values)+len(results))
+	out = append(out, values...)
+	return append(out, derivedValues(results)...)
+}
+
+// Cycle computes the port and site fields from the sets stored together in one cycle. The returned
+// batches are flagged derived; the site batch has an empty port.
+func (d *Deriver) Cycle(batches []storeBatch, ts time.Time) []storeBatch {
+	if d == nil || (len(d.ports) == 0 && d.site == nil && d.solar == nil) {
+		return nil
+	}
+	portVars := make(map[string]map[string]float64)
+	siteVars := make(map[string]float64)
+	for _, b := range batches {
+		name := batchSlaveName(b)
+		if portVars[b.port] == nil {
+			portVars[b.port] = make(map[string]float64)
+		}
+		for _, v := range b.values {
+			x := derivedInput(v)
+			portVars[b.port][name+"."+v.Name] = x
+			siteVars[b.port+"."+name+"."+v.Name] = x
+		}
+	}
+
+	ports := make([]string, 0, len(d.ports))
+	for port := range d.ports {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	var out []storeBatch
+	for _, port := range ports {
+		vars := portVars[port]
+		if vars == nil {
+			vars = make(map[string]float64)
+		}
+		results, err := d.ports[port].Eval(vars)
+		d.warn(fmt.Sprintf("[%s]", port), err)
+		if len(results) == 0 {
+			continue
+		}
+		for _, r := range results {
+			siteVars[port+"."+r.Name] = r.Value
+		}
+		out = append(out, storeBatch{port: port, values: derivedValues(results), ts: ts, derived: true})
+	}
+	site := d.solar.Fields(ts)
+	for _, r := range site {
+		siteVars[r.Name] = r.Value
+	}
+	if d.site != nil {
+		results, err := d.site.Eval(siteVars)
+		d.warn("site", err)
+		site = append(site, results...)
+	}
+	if len(site) > 0 {
+		out = append(out, storeBatch{values: derivedValues(site), ts: ts, derived: true})
+	}
+	return out
+}
+
+// warn prints each distinct evaluation problem once, since a slave that stays silent would
+// otherwise repeat it every cycle.
+func (d *Deriver) warn(scope string, err error) {
+	if err == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(err.Error(), "\n") {
+		msg := scope + " derived " + line
+		if !d.warned[msg] {
+			d.warned[msg] = true
+			fmt.Println(msg)
+		}
+	}
+}
+
+// derivedInput is the value a register contributes to expressions: its window mean when one was
+// computed, otherwise its value.
+func derivedInput(v RegisterValue) float64 {
+	for _, st := range v.Stats {
+		if st.Name == "mean" {
+			return st.Value
+		}
+	}
+	return v.Value
+}
+
+func derivedValues(results []expr.Result) []RegisterValue {
+	values := make([]RegisterValue, len(results))
+	for i, r := range results {
+		values[i] = RegisterValue{Register: -1, Name: r.Name, Type: "float", Value: r.Value, Unit: r.Unit}
+	}
+	return values
+}
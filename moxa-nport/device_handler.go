@@ -1,17 +1,13 @@
 package main
 
-import "strings"
+import "common/profiles"
 
 // FrameHandler consumes frames for device-specific decoding.
 type FrameHandler interface {
 	HandleFrame(frame []byte, summary FrameSummary) bool
 }
 
-func newFrameHandler(np NPortConfig, subMode string, storage *StorageManager, storeCoord *StoreCoordinator) FrameHandler {
-	switch strings.ToLower(strings.TrimSpace(np.DeviceType)) {
-	case "dustiq":
-		return NewDustIQHandler(np.Name, subMode, storage, storeCoord)
-	default:
-		return nil
-	}
+// newFrameHandler selects a decoder from the device_type profiles configured for the port or its slaves.
+func newFrameHandler(np NPortConfig, subMode string, storage *StorageManager, storeCoord *StoreCoordinator, lib *profiles.Library) FrameHandler {
+	return NewProfileHandler(np, subMode, storage, storeCoord, lib)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // FrameSummary holds a minimal parse of a Modbus RTU-like frame (address, function, length, CRC).
@@ -14,6 +15,88 @@ type FrameSummary struct {
 	ByteCount    *int
 	CRC          uint16
 	CRCValid     *bool
+	ReceivedAt   time.Time // when the first byte of the frame arrived
+
+	// Read requests (function 3/4) and the responses paired with them carry the requested range.
+	IsRequest     bool
+	StartRegister *int
+	RegisterCount int
+	IsResponse    bool          // a response paired with the preceding request
+	Latency       time.Duration // paired responses and exceptions: request start to response start
+	ExceptionCode *uint8        // exception responses (function code with the high bit set)
+	Unanswered    []uint8       // requests: slaves whose earlier request got no response
+}
+
+type requestKey struct {
+	slave    uint8
+	function uint8
+}
+
+type pendingRequest struct {
+	start int
+	count int
+	at    time.Time
+}
+
+// requestTracker pairs read-register responses with the request that preceded them on the same
+// port, so decoders know which register a response starts at and how long the slave took.
+type requestTracker struct {
+	pending map[requestKey]pendingRequest
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{pending: make(map[requestKey]pendingRequest)}
+}
+
+// observe classifies a CRC-valid frame as request or response and fills the register range.
+// A read request is always 8 bytes; a read response is 5+2n bytes, so the two cannot be confused.
+// With a single master on the line, a new request means any request still pending went unanswered.
+func (t *requestTracker) observe(frame []byte, s *FrameSummary) {
+	if t == nil || s.CRCValid == nil || !*s.CRCValid || len(frame) < 5 {
+		return
+	}
+	fc := s.FunctionCode &^ 0x80
+	if fc != 3 && fc != 4 {
+		return
+	}
+	key := requestKey{slave: s.SlaveID, function: fc}
+	if s.FunctionCode&0x80 != 0 {
+		code := frame[2]
+		s.ExceptionCode = &code
+		s.ByteCount = nil
+		if req, ok := t.pending[key]; ok {
+			s.Latency = s.ReceivedAt.Sub(req.at)
+			delete(t.pending, key)
+		}
+		return
+	}
+	if len(frame) == 8 {
+		start := int(frame[2])<<8 | int(frame[3])
+		count := int(frame[4])<<8 | int(frame[5])
+		s.IsRequest = true
+		s.StartRegister = &start
+		s.RegisterCount = count
+		s.ByteCount = nil
+		for k := range t.pending {
+			s.Unanswered = append(s.Unanswered, k.slave)
+			delete(t.pending, k)
+		}
+		t.pending[key] = pendingRequest{start: start, count: count, at: s.ReceivedAt}
+		return
+	}
+	req, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	delete(t.pending, key)
+	if s.ByteCount == nil || *s.ByteCount != req.count*2 || *s.ByteCount != len(frame)-5 {
+		return
+	}
+	start := req.start
+	s.StartRegister = &start
+	s.RegisterCount = req.count
+	s.IsResponse = true
+	s.Latency = s.ReceivedAt.Sub(req.at)
 }
 
 // summarizeFrame attempts a light parse to help fingerprint traffic.
@@ -65,7 +148,19 @@ func formatSummary(s FrameSummary) string {
 		byteCountPart = fmt.Sprintf(" byte_count=%d", *s.ByteCount)
 	}
 
-	return fmt.Sprintf("len=%d addr=%d func=0x%02X data_len=%d%s %s", s.Length, s.SlaveID, s.FunctionCode, s.DataLength, byteCountPart, crcPart)
+	rangePart := ""
+	if s.ExceptionCode != nil {
+		rangePart = fmt.Sprintf(" exception=%d", *s.ExceptionCode)
+	}
+	if s.StartRegister != nil {
+		kind := "resp"
+		if s.IsRequest {
+			kind = "req"
+		}
+		rangePart = fmt.Sprintf(" %s=%d+%d", kind, *s.StartRegister, s.RegisterCount)
+	}
+
+	return fmt.Sprintf("len=%d addr=%d func=0x%02X data_len=%d%s%s %s", s.Length, s.SlaveID, s.FunctionCode, s.DataLength, byteCountPart, rangePart, crcPart)
 }
 
 // modbusCRC16 computes the Modbus RTU CRC16 over the given bytes.
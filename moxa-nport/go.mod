@@ -3,3 +3,7 @@ module moxa-nport
 go 1.24.4
 
 require gopkg.in/yaml.v3 v3.0.1
+
+require common v0.0.0
+
+replace common => ../common
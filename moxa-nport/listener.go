@@ -4,30 +4,102 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"common/profiles"
 )
 
-var errHandlerComplete = errors.New("frame handler complete")
+var (
+	errHandlerComplete = errors.New("frame handler complete")
+	// errIdle is returned by a chunkSource when idleGap elapsed without new bytes.
+	errIdle = errors.New("idle gap")
+)
 
-// runPassiveListeningTest connects and prints frames observed on the socket without sending polls.
-func runPassiveListeningTest(ctx context.Context, np NPortConfig, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, subMode string) {
-	addr := fmt.Sprintf("%s:%d", np.Host, np.Port)
-	idleGap := deriveIdleGap(np, 5*time.Millisecond)
-	reconnectDelay := durationOrDefault(np.ReconnectDelayMS, 2*time.Second)
-	dialTimeout := durationOrDefault(np.DialTimeoutMS, 2*time.Second)
-	readBufSize := np.ReadBufferBytes
+// chunkSource yields raw bytes as received from an NPort port.
+type chunkSource interface {
+	// readChunk fills buf with the next bytes received and reports when they arrived.
+	// It returns errIdle once idleGap passes without data and io.EOF when the source is exhausted.
+	readChunk(buf []byte, idleGap time.Duration) (int, time.Time, error)
+}
+
+// connSource reads chunks from a live TCP connection, using read deadlines to detect idle gaps.
+type connSource struct {
+	conn net.Conn
+}
+
+func (c connSource) readChunk(buf []byte, idleGap time.Duration) (int, time.Time, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(idleGap))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, time.Time{}, errIdle
+		}
+		return n, time.Now(), err
+	}
+	return n, time.Now(), nil
+}
+
+// timedSource turns a sequence of timestamped payloads (from a capture file or recording) into chunks.
+// Idle gaps are derived from the recorded timestamps instead of wall-clock read deadlines.
+type timedSource struct {
+	next      func() ([]byte, time.Time, error)
+	pending   []byte
+	pendingAt time.Time
+	lastAt    time.Time
+	idleSent  bool
+}
+
+// readChunk returns payload bytes in recorded order. When the next payload was received more than
+// idleGap after the previous one, errIdle is returned first.
+func (t *timedSource) readChunk(buf []byte, idleGap time.Duration) (int, time.Time, error) {
+	for len(t.pending) == 0 {
+		payload, at, err := t.next()
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		t.pending = payload
+		t.pendingAt = at
+		t.idleSent = false
+	}
+
+	if !t.lastAt.IsZero() && !t.idleSent && t.pendingAt.Sub(t.lastAt) > idleGap {
+		t.idleSent = true
+		return 0, time.Time{}, errIdle
+	}
+
+	n := copy(buf, t.pending)
+	t.pending = t.pending[n:]
+	t.lastAt = t.pendingAt
+	return n, t.pendingAt, nil
+}
+
+// streamLimits returns the idle gap, read buffer size and maximum frame size configured for a port.
+func streamLimits(np NPortConfig) (idleGap time.Duration, readBufSize int, maxFrame int) {
+	idleGap = deriveIdleGap(np, 5*time.Millisecond)
+	readBufSize = np.ReadBufferBytes
 	if readBufSize <= 0 {
 		readBufSize = 1024
 	}
-	maxFrame := np.MaxFrameBytes
+	maxFrame = np.MaxFrameBytes
 	if maxFrame <= 0 {
 		maxFrame = 4096
 	}
+	return idleGap, readBufSize, maxFrame
+}
 
-	handler := newFrameHandler(np, subMode, storage, storeCoord)
+// runPassiveListeningTest connects and prints frames observed on the socket without sending polls.
+func runPassiveListeningTest(ctx context.Context, np NPortConfig, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, health *BusHealthMonitor, recorder *Recorder, lib *profiles.Library, subMode string) {
+	addr := net.JoinHostPort(np.Host, strconv.Itoa(np.Port))
+	idleGap, readBufSize, maxFrame := streamLimits(np)
+	reconnectDelay := durationOrDefault(np.ReconnectDelayMS, 2*time.Second)
+	dialTimeout := durationOrDefault(np.DialTimeoutMS, 2*time.Second)
+
+	handler := newFrameHandler(np, subMode, storage, storeCoord, lib)
 
 	for {
 		if ctx.Err() != nil {
@@ -46,7 +118,11 @@ func runPassiveListeningTest(ctx context.Context, np NPortConfig, collector *Sla
 		}
 
 		fmt.Printf("[%s] connected to %s\n", np.Name, addr)
-		if err := streamFrames(ctx, conn, np, idleGap, readBufSize, maxFrame, collector, storage, storeCoord, handler); err != nil {
+		var src chunkSource = connSource{conn: conn}
+		if recorder != nil {
+			src = recordingSource{src: src, port: np.Name, recorder: recorder}
+		}
+		if err := streamFrames(ctx, src, np, idleGap, readBufSize, maxFrame, collector, storage, storeCoord, health, handler); err != nil {
 			if errors.Is(err, errHandlerComplete) {
 				fmt.Printf("[%s] handler completed; stopping acquisition\n", np.Name)
 				_ = conn.Close()
@@ -66,58 +142,78 @@ func runPassiveListeningTest(ctx context.Context, np NPortConfig, collector *Sla
 }
 
 // streamFrames groups incoming bytes into frames separated by idleGap and logs them.
-func streamFrames(ctx context.Context, conn net.Conn, np NPortConfig, idleGap time.Duration, readBufSize int, maxFrame int, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, handler FrameHandler) error {
+// When the source is exhausted the pending frame is flushed and io.EOF is returned.
+func streamFrames(ctx context.Context, src chunkSource, np NPortConfig, idleGap time.Duration, readBufSize int, maxFrame int, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, health *BusHealthMonitor, handler FrameHandler) error {
 	buf := make([]byte, readBufSize)
-	var frame []byte
+	var (
+		frame   []byte
+		frameAt time.Time
+	)
+	requests := newRequestTracker()
+
+	emit := func() bool {
+		summary := logFrame(np, frame, frameAt, requests, collector, storage, storeCoord, health)
+		complete := handler != nil && handler.HandleFrame(frame, summary)
+		frame = frame[:0]
+		return complete
+	}
 
 	for {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
-		_ = conn.SetReadDeadline(time.Now().Add(idleGap))
-		n, err := conn.Read(buf)
+		n, at, err := src.readChunk(buf, idleGap)
+		if n > 0 {
+			if len(frame) == 0 {
+				frameAt = at
+			}
+			frame = append(frame, buf[:n]...)
+		}
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if errors.Is(err, errIdle) {
 				if len(frame) > 0 {
-					summary := logFrame(np, frame, collector, storage, storeCoord)
-					if handler != nil && handler.HandleFrame(frame, summary) {
+					if emit() {
 						return errHandlerComplete
 					}
-					frame = frame[:0]
 				} else if np.ConnectionKeepLog {
 					fmt.Printf("[%s] idle\n", np.Name)
 				}
 				continue
 			}
-			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+			if errors.Is(err, io.EOF) && len(frame) > 0 && emit() {
+				return errHandlerComplete
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
 				return err
 			}
 			return fmt.Errorf("read error: %w", err)
 		}
 
-		frame = append(frame, buf[:n]...)
 		if len(frame) >= maxFrame {
-			summary := logFrame(np, frame, collector, storage, storeCoord)
-			if handler != nil && handler.HandleFrame(frame, summary) {
+			if emit() {
 				return errHandlerComplete
 			}
-			frame = frame[:0]
 		}
 	}
 }
 
-func logFrame(np NPortConfig, frame []byte, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator) FrameSummary {
+// logFrame prints a frame received at receivedAt and stores the values of configured registers.
+func logFrame(np NPortConfig, frame []byte, receivedAt time.Time, requests *requestTracker, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, health *BusHealthMonitor) FrameSummary {
 	if len(frame) == 0 {
 		return FrameSummary{}
 	}
 	summary := summarizeFrame(frame)
+	summary.ReceivedAt = receivedAt.UTC()
+	if receivedAt.IsZero() {
+		summary.ReceivedAt = time.Now().UTC()
+	}
+	requests.observe(frame, &summary)
+	collector.Observe(np.Name, summary)
+	health.Observe(np.Name, summary)
 	if np.SkipInvalidCRC && (summary.CRCValid == nil || !*summary.CRCValid) {
 		return summary
 	}
-	if collector != nil && summary.CRCValid != nil && *summary.CRCValid {
-		collector.Record(np.Name, summary.SlaveID)
-	}
 	var (
 		dataDec        string
 		parserLines    []string
@@ -166,9 +262,9 @@ func logFrame(np NPortConfig, frame []byte, collector *SlaveCollector, storage *
 
 	if len(registerValues) > 0 {
 		if storeCoord != nil {
-			storeCoord.Record(np.Name, summary.SlaveID, slaveName, registerValues)
+			storeCoord.Record(np.Name, summary.SlaveID, slaveName, registerValues, summary.ReceivedAt)
 		} else if storage != nil {
-			storage.Store(np.Name, summary.SlaveID, slaveName, registerValues, time.Now().UTC())
+			storage.Store(np.Name, summary.SlaveID, slaveName, registerValues, summary.ReceivedAt)
 		}
 	}
 	return summary
@@ -190,27 +286,29 @@ func deriveIdleGap(np NPortConfig, fallback time.Duration) time.Duration {
 	if baud <= 0 {
 		return fallback
 	}
-	dataBits := np.Serial.DataBits
+	tCharSec := bitsPerChar(np.Serial) / float64(baud)
+	idle := tCharSec * 3.5
+	d := time.Duration(idle * float64(time.Second))
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// bitsPerChar is the number of bits one byte takes on the line: start, data, parity and stop bits.
+func bitsPerChar(serial SerialSettings) float64 {
+	dataBits := serial.DataBits
 	if dataBits <= 0 {
 		dataBits = 8
 	}
-	stopBits := np.Serial.StopBits
+	stopBits := serial.StopBits
 	if stopBits <= 0 {
 		stopBits = 1
 	}
 	parityBits := 0.0
-	switch strings.ToLower(np.Serial.Parity) {
+	switch strings.ToLower(serial.Parity) {
 	case "even", "odd", "mark", "space":
 		parityBits = 1
-	default:
-		parityBits = 0
 	}
-	bitsPerChar := 1.0 + float64(dataBits) + parityBits + stopBits
-	tCharSec := bitsPerChar / float64(baud)
-	idle := tCharSec * 3.5
-	d := time.Duration(idle * float64(time.Second))
-	if d <= 0 {
-		return fallback
-	}
-	return d
+	return 1.0 + float64(dataBits) + parityBits + stopBits
 }
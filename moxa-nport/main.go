@@ -10,10 +10,14 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"common/profiles"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yml", "path to config file")
+	pcapPath := flag.String("pcap", "", "decode a capture file (pcap/pcapng) instead of connecting to the NPorts")
+	reportFormat := flag.String("report-format", "yaml", "discovery report format: yaml or json")
 	flag.Parse()
 
 	cfg, err := loadConfig(*configPath)
@@ -40,7 +44,7 @@ func main() {
 		fmt.Printf("mode %q not implemented (expected passive-listening)\n", cfg.Mode)
 		os.Exit(1)
 	}
-	if subMode != "test" && subMode != "store" {
+	if subMode != "test" && subMode != "store" && subMode != "continuous" && subMode != "replay" {
 		fmt.Printf("sub_mode %q not implemented under passive-listening\n", cfg.SubMode)
 		os.Exit(1)
 	}
@@ -51,7 +55,7 @@ func main() {
 
 	ctx := sigCtx
 	var cancel context.CancelFunc
-	if subMode == "store" {
+	if storesData(subMode) {
 		ctx, cancel = context.WithCancel(sigCtx)
 		defer cancel()
 	}
@@ -70,21 +74,55 @@ func main() {
 		}()
 	}
 
+	lib, err := profiles.Load(cfg.ProfileDirs...)
+	if err != nil {
+		fmt.Printf("failed to load device profiles: %v\n", err)
+		os.Exit(1)
+	}
+
+	deriver, err := NewDeriver(cfg)
+	if err != nil {
+		fmt.Printf("failed to compile derived fields: %v\n", err)
+		os.Exit(1)
+	}
+
+	quality, err := NewQuality(cfg)
+	if err != nil {
+		fmt.Printf("failed to load quality checks: %v\n", err)
+		os.Exit(1)
+	}
+
 	collector := NewSlaveCollector()
 	var storage *StorageManager
 	var storeCoord *StoreCoordinator
-	if subMode == "store" {
+	var alerter *Alerter
+	if storesData(subMode) {
 		storage = NewStorageManager(cfg.Storage)
 		if storage == nil {
 			fmt.Println("no storage destinations configured; exiting")
 			return
 		}
-		storeCoord = NewStoreCoordinator(cfg, storage, cancel)
+		alerter, err = NewAlerter(cfg, *configPath, storage)
+		if err != nil {
+			fmt.Printf("failed to load alert rules: %v\n", err)
+			os.Exit(1)
+		}
+		storeCoord = NewStoreCoordinator(cfg, storage, quality, deriver, alerter, cancel, subMode, subMode != "replay" && *pcapPath == "")
 		if storeCoord == nil {
 			fmt.Println("no expected slaves configured for store; exiting")
 			return
 		}
 	}
+	health := NewBusHealthMonitor(cfg, storage)
+	var recorder *Recorder
+	if subMode != "replay" && *pcapPath == "" {
+		recorder, err = NewRecorder(cfg.Record)
+		if err != nil {
+			fmt.Printf("failed to start recorder: %v\n", err)
+			os.Exit(1)
+		}
+		defer recorder.Close()
+	}
 	var wg sync.WaitGroup
 	for _, np := range cfg.NPorts {
 		np := np
@@ -94,11 +132,21 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			runPassiveListeningTest(ctx, np, collector, storage, storeCoord, subMode)
+			switch {
+			case *pcapPath != "":
+				runPcapReplay(ctx, *pcapPath, np, collector, storage, storeCoord, health, lib, subMode)
+			case subMode == "replay":
+				runCaptureReplay(ctx, cfg.Replay, np, collector, storage, storeCoord, health, lib, subMode)
+			default:
+				runPassiveListeningTest(ctx, np, collector, storage, storeCoord, health, recorder, lib, subMode)
+			}
 		}()
 	}
 
 	wg.Wait()
+	storeCoord.Close()
+	alerter.Close()
+	health.Close()
 	if collector != nil {
 		outBase := outputSuffixFromConfig(*configPath)
 		outPath := fmt.Sprintf("test/slave_ids_detected%s.txt", outBase)
@@ -109,6 +157,27 @@ func main() {
 		} else {
 			fmt.Println(outPath + " written")
 		}
+		reportExt := ".yml"
+		if strings.EqualFold(*reportFormat, "json") {
+			reportExt = ".json"
+		}
+		reportPath := fmt.Sprintf("test/discovery%s%s", outBase, reportExt)
+		if err := collector.WriteDiscovery(reportPath); err != nil {
+			fmt.Printf("failed to write discovery report: %v\n", err)
+		} else {
+			fmt.Println(reportPath + " written")
+		}
+		skeletonPath := fmt.Sprintf("test/config_skeleton%s.yml", outBase)
+		if err := collector.WriteSkeleton(skeletonPath); err != nil {
+			fmt.Printf("failed to write config skeleton: %v\n", err)
+		} else {
+			fmt.Println(skeletonPath + " written")
+		}
 	}
 	fmt.Println("shutdown complete")
 }
+
+// storesData reports whether a sub-mode writes decoded values to the storage destinations.
+func storesData(subMode string) bool {
+	return subMode == "store" || subMode == "continuous" || subMode == "replay"
+}
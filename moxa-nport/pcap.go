@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"common/profiles"
+)
+
+// Link-layer types found in captures taken with tshark/tcpdump.
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeLoop      = 108
+	linkTypeLinuxSLL2 = 276
+)
+
+// runPcapReplay feeds the TCP payload the configured NPort sent in a capture file through the frame pipeline.
+// Like the live listener, it follows one connection: the first one the NPort sends data on.
+func runPcapReplay(ctx context.Context, path string, np NPortConfig, collector *SlaveCollector, storage *StorageManager, storeCoord *StoreCoordinator, health *BusHealthMonitor, lib *profiles.Library, subMode string) {
+	src, err := newPcapSource(path, np)
+	if err != nil {
+		fmt.Printf("[%s] pcap: %v\n", np.Name, err)
+		return
+	}
+	defer src.Close()
+
+	idleGap, readBufSize, maxFrame := streamLimits(np)
+	handler := newFrameHandler(np, subMode, storage, storeCoord, lib)
+
+	fmt.Printf("[%s] replaying %s (%s)\n", np.Name, path, net.JoinHostPort(np.Host, fmt.Sprint(np.Port)))
+	err = streamFrames(ctx, src, np, idleGap, readBufSize, maxFrame, collector, storage, storeCoord, health, handler)
+	switch {
+	case errors.Is(err, errHandlerComplete):
+		fmt.Printf("[%s] handler completed; stopping replay\n", np.Name)
+	case errors.Is(err, io.EOF):
+		fmt.Printf("[%s] pcap replay finished: %d segments, %d payload bytes\n", np.Name, src.segments, src.payloadBytes)
+		if src.otherFlows > 0 {
+			fmt.Printf("[%s] followed %s only; %d segments of other connections ignored\n", np.Name, src.flow, src.otherFlows)
+		}
+	case err != nil:
+		fmt.Printf("[%s] pcap replay stopped: %v\n", np.Name, err)
+	}
+}
+
+// pcapSource is a chunkSource backed by a capture file. Idle gaps are derived from capture timestamps.
+type pcapSource struct {
+	file   *os.File
+	reader *pcapReader
+	hosts  []net.IP
+	port   uint16
+	timedSource
+
+	flow         string // the followed connection, set by its first segment
+	nextSeq      uint32
+	otherFlows   int // payload segments of other connections to the NPort
+	segments     int
+	payloadBytes int
+}
+
+func newPcapSource(path string, np NPortConfig) (*pcapSource, error) {
+	if np.Port <= 0 || np.Port > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid port %d", np.Port)
+	}
+	hosts, err := resolveHost(np.Host)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newPcapReader(bufio.NewReader(f))
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	src := &pcapSource{
+		file:   f,
+		reader: r,
+		hosts:  hosts,
+		port:   uint16(np.Port),
+	}
+	src.next = src.nextPayload
+	return src, nil
+}
+
+func (p *pcapSource) Close() error {
+	return p.file.Close()
+}
+
+// nextPayload returns the next non-empty, non-duplicate TCP payload sent by the NPort on the followed connection.
+func (p *pcapSource) nextPayload() ([]byte, time.Time, error) {
+	for {
+		pkt, err := p.reader.next()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		seg, ok := decodeTCPSegment(pkt.linkType, pkt.data)
+		if !ok || len(seg.payload) == 0 {
+			continue
+		}
+		if !p.matches(seg) {
+			continue
+		}
+		payload := p.dedupe(seg)
+		if len(payload) == 0 {
+			continue
+		}
+		p.segments++
+		p.payloadBytes += len(payload)
+		return payload, pkt.ts, nil
+	}
+}
+
+// matches reports whether seg was sent by the NPort on the followed connection. Requests written by
+// the client and other connections are left out, as the live listener only reads what the NPort sends.
+func (p *pcapSource) matches(seg tcpSegment) bool {
+	if seg.srcPort != p.port || !containsIP(p.hosts, seg.srcIP) {
+		return false
+	}
+	flow := fmt.Sprintf("%s:%d>%s:%d", seg.srcIP, seg.srcPort, seg.dstIP, seg.dstPort)
+	if p.flow == "" {
+		p.flow = flow
+	}
+	if flow != p.flow {
+		p.otherFlows++
+		return false
+	}
+	return true
+}
+
+// dedupe drops retransmitted bytes using the TCP sequence number of the followed connection.
+func (p *pcapSource) dedupe(seg tcpSegment) []byte {
+	payload := seg.payload
+	end := seg.seq + uint32(len(payload))
+	if p.segments > 0 {
+		if int32(end-p.nextSeq) <= 0 {
+			return nil
+		}
+		if overlap := int32(p.nextSeq - seg.seq); overlap > 0 {
+			payload = payload[overlap:]
+		}
+	}
+	p.nextSeq = end
+	return payload
+}
+
+func resolveHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %q: %w", host, err)
+	}
+	return ips, nil
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, candidate := range list {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type pcapPacket struct {
+	ts       time.Time
+	linkType uint32
+	data     []byte
+}
+
+// pcapReader reads classic pcap and pcapng files (the tshark default) sequentially.
+type pcapReader struct {
+	r io.Reader
+	// classic pcap state
+	classic  bool
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	// pcapng state: one entry per interface description block in the current section
+	ifaces []pcapngIface
+}
+
+type pcapngIface struct {
+	linkType uint32
+	tsUnit   float64 // seconds per timestamp tick
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("read magic: %w", err)
+	}
+	pr := &pcapReader{r: r}
+	switch magic {
+	case [4]byte{0xD4, 0xC3, 0xB2, 0xA1}:
+		pr.classic, pr.order = true, binary.LittleEndian
+	case [4]byte{0xA1, 0xB2, 0xC3, 0xD4}:
+		pr.classic, pr.order = true, binary.BigEndian
+	case [4]byte{0x4D, 0x3C, 0xB2, 0xA1}:
+		pr.classic, pr.order, pr.nanos = true, binary.LittleEndian, true
+	case [4]byte{0xA1, 0xB2, 0x3C, 0x4D}:
+		pr.classic, pr.order, pr.nanos = true, binary.BigEndian, true
+	case [4]byte{0x0A, 0x0D, 0x0D, 0x0A}:
+		if err := pr.readSectionHeader(); err != nil {
+			return nil, err
+		}
+		return pr, nil
+	default:
+		return nil, fmt.Errorf("unrecognised capture format (magic % X)", magic[:])
+	}
+
+	var hdr [20]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+	pr.linkType = pr.order.Uint32(hdr[16:20]) & 0x0FFFFFFF
+	return pr, nil
+}
+
+func (pr *pcapReader) next() (pcapPacket, error) {
+	if pr.classic {
+		return pr.nextClassic()
+	}
+	return pr.nextPcapng()
+}
+
+func (pr *pcapReader) nextClassic() (pcapPacket, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return pcapPacket{}, io.EOF
+		}
+		return pcapPacket{}, err
+	}
+	sec := int64(pr.order.Uint32(hdr[0:4]))
+	frac := int64(pr.order.Uint32(hdr[4:8]))
+	capLen := pr.order.Uint32(hdr[8:12])
+	if capLen > 1<<24 {
+		return pcapPacket{}, fmt.Errorf("pcap record too large (%d bytes)", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return pcapPacket{}, io.EOF
+	}
+	if !pr.nanos {
+		frac *= 1000
+	}
+	return pcapPacket{ts: time.Unix(sec, frac).UTC(), linkType: pr.linkType, data: data}, nil
+}
+
+// readSectionHeader parses the rest of a pcapng section header block after its block type.
+func (pr *pcapReader) readSectionHeader() error {
+	var hdr [8]byte // block total length + byte-order magic
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return fmt.Errorf("read pcapng section header: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[4:8]) == 0x1A2B3C4D:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[4:8]) == 0x1A2B3C4D:
+		pr.order = binary.BigEndian
+	default:
+		return errors.New("invalid pcapng byte-order magic")
+	}
+	total := pr.order.Uint32(hdr[0:4])
+	if total < 28 || total%4 != 0 {
+		return fmt.Errorf("invalid pcapng section header length %d", total)
+	}
+	pr.ifaces = pr.ifaces[:0]
+	_, err := io.CopyN(io.Discard, pr.r, int64(total)-12)
+	return err
+}
+
+func (pr *pcapReader) nextPcapng() (pcapPacket, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return pcapPacket{}, io.EOF
+			}
+			return pcapPacket{}, err
+		}
+		if binary.BigEndian.Uint32(hdr[0:4]) == 0x0A0D0D0A {
+			// New section: the length that follows has to be read with the section's own byte order.
+			pr.r = io.MultiReader(bytes.NewReader(append([]byte(nil), hdr[4:8]...)), pr.r)
+			if err := pr.readSectionHeader(); err != nil {
+				return pcapPacket{}, err
+			}
+			continue
+		}
+		blockType := pr.order.Uint32(hdr[0:4])
+		total := pr.order.Uint32(hdr[4:8])
+		if total < 12 || total%4 != 0 || total > 1<<24 {
+			return pcapPacket{}, fmt.Errorf("invalid pcapng block length %d", total)
+		}
+		body := make([]byte, total-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return pcapPacket{}, io.EOF
+		}
+		body = body[:len(body)-4] // trailing block length
+
+		switch blockType {
+		case 1: // interface description block
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapngIface{linkType: uint32(pr.order.Uint16(body[0:2])), tsUnit: 1e-6}
+			if unit, ok := pcapngTsResol(body[8:], pr.order); ok {
+				iface.tsUnit = unit
+			}
+			pr.ifaces = append(pr.ifaces, iface)
+		case 6: // enhanced packet block
+			if len(body) < 20 {
+				continue
+			}
+			ifID := pr.order.Uint32(body[0:4])
+			if int(ifID) >= len(pr.ifaces) {
+				continue
+			}
+			iface := pr.ifaces[ifID]
+			ticks := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			capLen := pr.order.Uint32(body[12:16])
+			if int(capLen) > len(body)-20 {
+				continue
+			}
+			return pcapPacket{
+				ts:       pcapngTime(ticks, iface.tsUnit),
+				linkType: iface.linkType,
+				data:     body[20 : 20+capLen],
+			}, nil
+		}
+	}
+}
+
+// pcapngTsResol extracts the if_tsresol option from interface description block options.
+func pcapngTsResol(opts []byte, order binary.ByteOrder) (float64, bool) {
+	for len(opts) >= 4 {
+		code := order.Uint16(opts[0:2])
+		length := int(order.Uint16(opts[2:4]))
+		if code == 0 || 4+length > len(opts) {
+			return 0, false
+		}
+		if code == 9 && length >= 1 {
+			v := opts[4]
+			if v&0x80 != 0 {
+				return math.Pow(2, -float64(v&0x7F)), true
+			}
+			return math.Pow(10, -float64(v)), true
+		}
+		opts = opts[4+(length+3)&^3:]
+	}
+	return 0, false
+}
+
+func pcapngTime(ticks uint64, unit float64) time.Time {
+	perSecond := uint64(math.Round(1 / unit))
+	if perSecond == 0 {
+		return time.Unix(0, 0).UTC()
+	}
+	sec := ticks / perSecond
+	rem := ticks % perSecond
+	nanos := float64(rem) * unit * 1e9
+	return time.Unix(int64(sec), int64(nanos)).UTC()
+}
+
+type tcpSegment struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	seq              uint32
+	payload          []byte
+}
+
+// decodeTCPSegment strips the link, IP and TCP headers from a captured packet.
+func decodeTCPSegment(linkType uint32, data []byte) (tcpSegment, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return tcpSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return tcpSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return tcpSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return tcpSegment{}, false
+		}
+		data = data[4:]
+		etherType = ipEtherType(data)
+	case linkTypeRaw:
+		etherType = ipEtherType(data)
+	default:
+		return tcpSegment{}, false
+	}
+
+	var (
+		seg   tcpSegment
+		proto byte
+	)
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 {
+			return tcpSegment{}, false
+		}
+		ihl := int(data[0]&0x0F) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < 20 || totalLen < ihl || totalLen > len(data) {
+			return tcpSegment{}, false
+		}
+		if binary.BigEndian.Uint16(data[6:8])&0x3FFF != 0 {
+			return tcpSegment{}, false // fragmented
+		}
+		proto = data[9]
+		seg.srcIP = net.IP(data[12:16])
+		seg.dstIP = net.IP(data[16:20])
+		data = data[ihl:totalLen]
+	case 0x86DD:
+		if len(data) < 40 {
+			return tcpSegment{}, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		if 40+payloadLen > len(data) {
+			return tcpSegment{}, false
+		}
+		proto = data[6]
+		seg.srcIP = net.IP(data[8:24])
+		seg.dstIP = net.IP(data[24:40])
+		data = data[40 : 40+payloadLen]
+	default:
+		return tcpSegment{}, false
+	}
+	if proto != 6 || len(data) < 20 {
+		return tcpSegment{}, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return tcpSegment{}, false
+	}
+	seg.srcPort = binary.BigEndian.Uint16(data[0:2])
+	seg.dstPort = binary.BigEndian.Uint16(data[2:4])
+	seg.seq = binary.BigEndian.Uint32(data[4:8])
+	seg.payload = data[offset:]
+	return seg, true
+}
+
+func ipEtherType(data []byte) uint16 {
+	if len(data) == 0 {
+		return 0
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return 0x0800
+	case 6:
+		return 0x86DD
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testNPort  = "192.168.127.254"
+	testClient = "192.168.127.10"
+	testOther  = "192.168.127.11"
+)
+
+// testPacket is one TCP segment of a capture fixture.
+type testPacket struct {
+	at               time.Duration
+	src, dst         string
+	srcPort, dstPort uint16
+	seq              uint32
+	payload          string
+}
+
+var captureStart = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// nportCapture has a request written by the client, a retransmission, a partly retransmitted
+// segment and a second connection to the NPort, as captured with `host <nport>`.
+var nportCapture = []testPacket{
+	{at: 0, src: testClient, dst: testNPort, srcPort: 50000, dstPort: 4001, seq: 1, payload: "request"},
+	{at: 10 * time.Millisecond, src: testNPort, dst: testClient, srcPort: 4001, dstPort: 50000, seq: 1000, payload: "AAAA"},
+	{at: 20 * time.Millisecond, src: testNPort, dst: testClient, srcPort: 4001, dstPort: 50000, seq: 1000, payload: "AAAA"},
+	{at: 30 * time.Millisecond, src: testNPort, dst: testClient, srcPort: 4001, dstPort: 50000, seq: 1002, payload: "AABB"},
+	{at: 40 * time.Millisecond, src: testNPort, dst: testOther, srcPort: 4001, dstPort: 50001, seq: 7000, payload: "CCCC"},
+	{at: 50 * time.Millisecond, src: testNPort, dst: testClient, srcPort: 4001, dstPort: 50000, seq: 1006, payload: "DD"},
+	{at: 60 * time.Millisecond, src: testNPort, dst: testClient, srcPort: 4002, dstPort: 50002, seq: 1, payload: "other port"},
+}
+
+// ethernetFrame wraps a segment in Ethernet, IPv4 and TCP headers.
+func ethernetFrame(p testPacket) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], p.srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], p.dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], p.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	tcp = append(tcp, p.payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], net.ParseIP(p.src).To4())
+	copy(ip[16:20], net.ParseIP(p.dst).To4())
+
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	return append(append(frame, ip...), tcp...)
+}
+
+func classicPcap(packets []testPacket) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, []uint32{0xA1B2C3D4})
+	binary.Write(&b, le, []uint16{2, 4})
+	binary.Write(&b, le, []uint32{0, 0, 65535, linkTypeEthernet})
+	for _, p := range packets {
+		frame := ethernetFrame(p)
+		ts := captureStart.Add(p.at)
+		binary.Write(&b, le, []uint32{uint32(ts.Unix()), uint32(ts.Nanosecond() / 1000), uint32(len(frame)), uint32(len(frame))})
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+// pcapngBlock pads body to 32 bits and frames it with the block type and lengths.
+func pcapngBlock(b *bytes.Buffer, blockType uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	total := uint32(12 + len(body))
+	binary.Write(b, binary.LittleEndian, []uint32{blockType, total})
+	b.Write(body)
+	binary.Write(b, binary.LittleEndian, total)
+}
+
+// pcapng writes the packets like tshark does, with nanosecond timestamps.
+func pcapng(packets []testPacket) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	shb := le.AppendUint32(nil, 0x1A2B3C4D)
+	shb = le.AppendUint16(shb, 1)
+	shb = le.AppendUint16(shb, 0)
+	shb = le.AppendUint64(shb, ^uint64(0)) // section length not specified
+	pcapngBlock(&b, 0x0A0D0D0A, shb)
+
+	idb := le.AppendUint16(nil, linkTypeEthernet)
+	idb = le.AppendUint16(idb, 0)
+	idb = le.AppendUint32(idb, 65535)
+	idb = append(le.AppendUint16(le.AppendUint16(idb, 9), 1), 9, 0, 0, 0) // if_tsresol: 10^-9
+	idb = le.AppendUint32(idb, 0)                                         // opt_endofopt
+	pcapngBlock(&b, 1, idb)
+
+	for _, p := range packets {
+		frame := ethernetFrame(p)
+		ticks := uint64(captureStart.Add(p.at).UnixNano())
+		epb := le.AppendUint32(nil, 0)
+		epb = le.AppendUint32(epb, uint32(ticks>>32))
+		epb = le.AppendUint32(epb, uint32(ticks))
+		epb = le.AppendUint32(epb, uint32(len(frame)))
+		epb = le.AppendUint32(epb, uint32(len(frame)))
+		pcapngBlock(&b, 6, append(epb, frame...))
+	}
+	return b.Bytes()
+}
+
+func TestPcapSource(t *testing.T) {
+	formats := map[string][]byte{
+		"classic.pcap":  classicPcap(nportCapture),
+		"tshark.pcapng": pcapng(nportCapture),
+	}
+	for name, data := range formats {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			src, err := newPcapSource(path, NPortConfig{Host: testNPort, Port: 4001})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+
+			var payloads []string
+			var times []time.Duration
+			for {
+				payload, at, err := src.nextPayload()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				payloads = append(payloads, string(payload))
+				times = append(times, at.Sub(captureStart))
+			}
+
+			// The request, the retransmission, the repeated start of the third segment and the
+			// other connections are left out.
+			if want := []string{"AAAA", "BB", "DD"}; !reflect.DeepEqual(payloads, want) {
+				t.Errorf("payloads = %q, want %q", payloads, want)
+			}
+			if want := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 50 * time.Millisecond}; !reflect.DeepEqual(times, want) {
+				t.Errorf("times = %v, want %v", times, want)
+			}
+			if src.otherFlows != 1 {
+				t.Errorf("otherFlows = %d, want 1", src.otherFlows)
+			}
+			if src.segments != 3 || src.payloadBytes != 8 {
+				t.Errorf("segments, payloadBytes = %d, %d, want 3, 8", src.segments, src.payloadBytes)
+			}
+		})
+	}
+}
+
+func TestPcapReaderRejectsUnknownFormat(t *testing.T) {
+	if _, err := newPcapReader(bytes.NewReader([]byte("not a capture file"))); err == nil {
+		t.Error("newPcapReader accepted a file without a capture magic")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"common/profiles"
+)
+
+// profileHandler decodes frames of profiled devices. The profile comes from the slave's device_type,
+// falling back to the port's. Responses are placed by the start register of the request they answer.
+// Profiles marked cycle are assembled from several responses (DustIQ style); others are decoded from
+// each response on its own.
+type profileHandler struct {
+	port          string
+	mode          string
+	portProfile   *profiles.Profile
+	slaveProfiles map[uint8]*profiles.Profile
+	slaveNames    map[uint8]string
+	storage       *StorageManager
+	storeCoord    *StoreCoordinator
+
+	cycles map[uint8]*cycleState
+}
+
+// cycleState holds the registers received for one slave since its current polling cycle began.
+// Each slave has its own state, so interleaved polls of several devices on a line are decoded together.
+type cycleState struct {
+	slave     uint8
+	profile   *profiles.Profile
+	addresses map[int]bool // profile register addresses; other registers the master polls are ignored
+	words     map[int]uint16
+	startedAt time.Time // receive time of the cycle's first profile register, used as the cycle timestamp
+	flushed   bool      // an earlier cycle was seen, so the current one did not start mid-poll
+}
+
+// NewProfileHandler returns nil when neither the port nor any of its slaves selects a known profile.
+func NewProfileHandler(np NPortConfig, subMode string, storage *StorageManager, storeCoord *StoreCoordinator, lib *profiles.Library) FrameHandler {
+	h := &profileHandler{
+		port:          np.Name,
+		mode:          strings.ToLower(strings.TrimSpace(subMode)),
+		slaveProfiles: make(map[uint8]*profiles.Profile),
+		slaveNames:    make(map[uint8]string, len(np.Slaves)),
+		cycles:        make(map[uint8]*cycleState),
+		storage:       storage,
+		storeCoord:    storeCoord,
+	}
+	if dt := strings.TrimSpace(np.DeviceType); dt != "" {
+		p, ok := lib.Get(dt)
+		if !ok {
+			fmt.Printf("[%s] unknown device_type %q (profiles: %s)\n", np.Name, dt, strings.Join(lib.Names(), ", "))
+		}
+		h.portProfile = p
+	}
+	for _, s := range np.Slaves {
+		h.slaveNames[s.Address] = s.Name
+		if dt := strings.TrimSpace(s.DeviceType); dt != "" {
+			p, ok := lib.Get(dt)
+			if !ok {
+				fmt.Printf("[%s] slave %d: unknown device_type %q\n", np.Name, s.Address, dt)
+				continue
+			}
+			h.slaveProfiles[s.Address] = p
+		}
+	}
+	if h.portProfile == nil && len(h.slaveProfiles) == 0 {
+		return nil
+	}
+	return h
+}
+
+func (h *profileHandler) profileFor(slaveID uint8) *profiles.Profile {
+	if p, ok := h.slaveProfiles[slaveID]; ok {
+		return p
+	}
+	return h.portProfile
+}
+
+func (h *profileHandler) HandleFrame(frame []byte, summary FrameSummary) bool {
+	if summary.CRCValid == nil || !*summary.CRCValid {
+		return false
+	}
+	if summary.ByteCount == nil || *summary.ByteCount != len(frame)-5 || *summary.ByteCount < 2 || *summary.ByteCount%2 != 0 {
+		return false
+	}
+	p := h.profileFor(summary.SlaveID)
+	if p == nil {
+		return false
+	}
+	if p.Cycle {
+		return h.handleCycleFrame(p, frame, summary)
+	}
+	return h.handleBlock(p, frame, summary)
+}
+
+// handleBlock decodes a single response. Unpaired responses are assumed to start at the first
+// register of the profile, which is how the site masters poll these devices.
+func (h *profileHandler) handleBlock(p *profiles.Profile, frame []byte, summary FrameSummary) bool {
+	data := frame[3 : len(frame)-2]
+	start, _ := p.Span()
+	if summary.StartRegister != nil {
+		start = *summary.StartRegister
+	}
+	if p.Identify != nil {
+		idx := p.Identify.Register - start
+		if idx < 0 || idx*2+2 > len(data) || !p.Identify.Matches(int(binary.BigEndian.Uint16(data[idx*2:]))) {
+			return false
+		}
+	}
+
+	decoded, warnings := p.DecodeBlock(start, data)
+	values := registerValuesFromProfile(decoded)
+	if len(values) == 0 {
+		return false
+	}
+	slaveName := h.slaveNames[summary.SlaveID]
+	h.print(p, summary.SlaveID, slaveName, summary.ReceivedAt, values, warnings)
+
+	if !storesData(h.mode) {
+		return false
+	}
+	if h.storeCoord != nil {
+		h.storeCoord.Record(h.port, summary.SlaveID, slaveName, values, summary.ReceivedAt)
+	} else if h.storage != nil {
+		h.storage.Store(h.port, summary.SlaveID, slaveName, values, summary.ReceivedAt)
+	}
+	return false
+}
+
+// handleCycleFrame places the profile registers of a paired response into the slave's cycle. A cycle
+// ends when every profile register has arrived or when a register repeats, meaning the master started
+// over; registers may arrive in any order and some may be missing. Registers the profile does not
+// have are ignored, so polling them after the last profile register does not open the next cycle.
+func (h *profileHandler) handleCycleFrame(p *profiles.Profile, frame []byte, summary FrameSummary) bool {
+	if summary.StartRegister == nil {
+		return false
+	}
+	data := frame[3 : len(frame)-2]
+	start := *summary.StartRegister
+
+	c, ok := h.cycles[summary.SlaveID]
+	if !ok {
+		c = &cycleState{slave: summary.SlaveID, profile: p, addresses: make(map[int]bool), words: make(map[int]uint16)}
+		for _, a := range p.Addresses() {
+			c.addresses[a] = true
+		}
+		h.cycles[summary.SlaveID] = c
+	}
+	words := make(map[int]uint16)
+	for i := 0; i+1 < len(data); i += 2 {
+		if a := start + i/2; c.addresses[a] {
+			words[a] = binary.BigEndian.Uint16(data[i:])
+		}
+	}
+	if len(words) == 0 {
+		return false
+	}
+	for a := range words {
+		if _, dup := c.words[a]; dup {
+			if h.flush(c) {
+				return true
+			}
+			break
+		}
+	}
+	if len(c.words) == 0 {
+		c.startedAt = summary.ReceivedAt
+	}
+	for a, w := range words {
+		c.words[a] = w
+	}
+	if len(c.words) == len(c.addresses) {
+		return h.flush(c)
+	}
+	return false
+}
+
+// flush decodes, stores and resets a slave's cycle. Incomplete cycles are stored too, except the
+// first one, which likely began before we listened. Without a store coordinator, a stored complete
+// cycle ends acquisition.
+func (h *profileHandler) flush(c *cycleState) bool {
+	words := c.words
+	startedAt := c.startedAt
+	first := !c.flushed
+	c.words = make(map[int]uint16)
+	c.flushed = true
+	if len(words) == 0 {
+		return false
+	}
+	p := c.profile
+	if p.Identify != nil {
+		if v, ok := words[p.Identify.Register]; ok && !p.Identify.Matches(int(v)) {
+			fmt.Printf("[%s] %s: slave %d identify register %d=%d does not match; dropping cycle\n", h.port, p.Name, c.slave, p.Identify.Register, v)
+			return false
+		}
+	}
+
+	decoded, warnings := p.DecodeWords(words)
+	values := registerValuesFromProfile(decoded)
+	slaveName := h.slaveNames[c.slave]
+	missing := missingRegisters(p, words)
+	if len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("incomplete cycle for slave %d: missing registers %v", c.slave, missing))
+	}
+	h.print(p, c.slave, slaveName, startedAt, values, warnings)
+
+	if len(values) == 0 || !storesData(h.mode) || (len(missing) > 0 && first) {
+		return false
+	}
+	if h.storeCoord != nil {
+		h.storeCoord.Record(h.port, c.slave, slaveName, values, startedAt)
+		return false
+	}
+	if h.storage == nil {
+		return false
+	}
+	h.storage.Store(h.port, c.slave, slaveName, values, startedAt)
+	return len(missing) == 0
+}
+
+// missingRegisters lists the profile register addresses absent from words.
+func missingRegisters(p *profiles.Profile, words map[int]uint16) []int {
+	var out []int
+	for _, a := range p.Addresses() {
+		if _, ok := words[a]; !ok {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (h *profileHandler) print(p *profiles.Profile, slaveID uint8, slaveName string, at time.Time, values []RegisterValue, warnings []string) {
+	fmt.Printf("[%s] %s slave %d %s %s\n", h.port, p.Name, slaveID, slaveName, at.Format(time.RFC3339Nano))
+	for _, v := range values {
+		fmt.Printf("  %s\n", strings.TrimSpace(v.Name+"="+formatRegisterValue(v.Value, v.Type)+" "+v.Unit))
+	}
+	for _, warn := range warnings {
+		fmt.Printf("[%s] %s warning: %s\n", h.port, p.Name, warn)
+	}
+}
+
+func registerValuesFromProfile(decoded []profiles.Value) []RegisterValue {
+	values := make([]RegisterValue, 0, len(decoded))
+	for _, d := range decoded {
+		values = append(values, RegisterValue{
+			Register: d.Register,
+			Name:     d.Name,
+			Type:     d.Type,
+			Value:    d.Value,
+			Unit:     d.Unit,
+		})
+	}
+	return values
+}
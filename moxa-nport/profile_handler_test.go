@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"common/profiles"
+)
+
+// readResponse builds a function 4 response carrying words.
+func readResponse(slave uint8, words ...uint16) []byte {
+	frame := []byte{slave, 4, byte(len(words) * 2)}
+	for _, w := range words {
+		frame = binary.BigEndian.AppendUint16(frame, w)
+	}
+	return binary.LittleEndian.AppendUint16(frame, modbusCRC16(frame))
+}
+
+// TestCycleTimestamp polls a DustIQ one register at a time over 0..22, like the site master does.
+// Registers 10 and 22 are not in the profile: 22 arriving after the cycle completed must not open
+// the next cycle with its receive time.
+func TestCycleTimestamp(t *testing.T) {
+	lib, err := profiles.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := lib.Get("dustiq")
+	if !ok {
+		t.Fatal("no dustiq profile")
+	}
+	h := &profileHandler{port: "com1", mode: "test", cycles: make(map[uint8]*cycleState), slaveNames: map[uint8]string{}}
+
+	poll := func(start time.Time) {
+		for reg := 0; reg <= 22; reg++ {
+			value := uint16(0)
+			if reg == 0 {
+				value = 800 // identify
+			}
+			r := reg
+			h.handleCycleFrame(p, readResponse(1, value), FrameSummary{
+				SlaveID:       1,
+				StartRegister: &r,
+				ReceivedAt:    start.Add(time.Duration(reg) * 100 * time.Millisecond),
+			})
+		}
+	}
+	first := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	poll(first)
+	c := h.cycles[1]
+	if len(c.words) != 0 || !c.flushed {
+		t.Fatalf("after the first poll: %d words pending, flushed %v; want the cycle flushed on register 21", len(c.words), c.flushed)
+	}
+
+	second := first.Add(10 * time.Second)
+	r := 0
+	h.handleCycleFrame(p, readResponse(1, 800), FrameSummary{SlaveID: 1, StartRegister: &r, ReceivedAt: second})
+	if !c.startedAt.Equal(second) {
+		t.Errorf("second cycle started at %s, want its register 0 at %s", c.startedAt.Format(time.RFC3339Nano), second.Format(time.RFC3339Nano))
+	}
+	if _, ok := c.words[22]; ok {
+		t.Error("register 22, not in the profile, was kept in the cycle")
+	}
+}
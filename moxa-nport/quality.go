@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"common/solar"
+	"common/stats"
+)
+
+// QualityConfig enables plausibility checks on a port's irradiance registers. Every sample of a
+// checked register gets a <register>_qc field next to it, a bit mask of the failed checks (0 is
+// good). Windowed stores keep every bit set during the window.
+type QualityConfig struct {
+	Registers []string `yaml:"registers"` // e.g. smp_irradiance
+	Plane     string   `yaml:"plane"`     // horizontal (default) or tilted: tilted limits assume the sun at normal incidence
+
+	NightElevation    float64 `yaml:"night_elevation"`       // sun elevation below which it is night, default -3 deg
+	NightOffset       float64 `yaml:"night_offset"`          // largest magnitude expected at night, default 10 W/m2
+	AgreeAbs          float64 `yaml:"agree_abs"`             // largest difference from the other sensors' median, default 20 W/m2 ...
+	AgreeRel          float64 `yaml:"agree_rel"`             // ... or this fraction of it if larger, default 0.05
+	AgreeMaxAge       int     `yaml:"agree_max_age_seconds"` // other sensors' samples older than this are not compared, default 30
+	StuckSeconds      int     `yaml:"stuck_seconds"`         // unchanged for this long while the sun is up, default 600
+	StuckTolerance    float64 `yaml:"stuck_tolerance"`       // largest change still counted as unchanged, default 0
+	StuckMinElevation float64 `yaml:"stuck_min_elevation"`   // default 5 deg
+}
+
+// QC flag bits.
+const (
+	qcPhysicallyPossible = 1 << iota // outside the BSRN physically possible limits
+	qcExtremelyRare                  // outside the BSRN extremely rare limits
+	qcNightOffset                    // night value beyond night_offset
+	qcDisagree                       // away from the median of the port's other sensors
+	qcStuck                          // unchanged for stuck_seconds in daylight
+)
+
+// Quality applies the checks of every port's quality section to the samples recorded for storage.
+// The limits follow the BSRN recommendations (Long and Dutton) for global irradiance, scaled by the
+// extraterrestrial irradiance and the cosine of the zenith angle at the solar section's site.
+// Callers serialise access (the store coordinator's lock).
+type Quality struct {
+	site   solar.Site
+	ports  map[string]QualityConfig
+	latest map[string]map[uint8]qcSample  // port/register -> slave -> last sample
+	stuck  map[string]map[uint8]*qcSample // port/register -> slave -> value held since
+}
+
+type qcSample struct {
+	value float64
+	ts    time.Time
+}
+
+// NewQuality applies the defaults of the ports' quality sections. It returns nil when none is set.
+func NewQuality(cfg Config) (*Quality, error) {
+	q := &Quality{
+		ports:  make(map[string]QualityConfig),
+		latest: make(map[string]map[uint8]qcSample),
+		stuck:  make(map[string]map[uint8]*qcSample),
+	}
+	for _, np := range cfg.NPorts {
+		if np.Quality == nil {
+			continue
+		}
+		c := *np.Quality
+		if len(c.Registers) == 0 {
+			return nil, fmt.Errorf("nport %s quality: no registers", np.Name)
+		}
+		switch c.Plane {
+		case "":
+			c.Plane = "horizontal"
+		case "horizontal", "tilted":
+		default:
+			return nil, fmt.Errorf("nport %s quality: plane %q is not horizontal or tilted", np.Name, c.Plane)
+		}
+		if c.NightElevation == 0 {
+			c.NightElevation = -3
+		}
+		if c.NightOffset <= 0 {
+			c.NightOffset = 10
+		}
+		if c.AgreeAbs <= 0 {
+			c.AgreeAbs = 20
+		}
+		if c.AgreeRel <= 0 {
+			c.AgreeRel = 0.05
+		}
+		if c.AgreeMaxAge <= 0 {
+			c.AgreeMaxAge = 30
+		}
+		if c.StuckSeconds <= 0 {
+			c.StuckSeconds = 600
+		}
+		if c.StuckMinElevation == 0 {
+			c.StuckMinElevation = 5
+		}
+		q.ports[np.Name] = c
+	}
+	if len(q.ports) == 0 {
+		return nil, nil
+	}
+	if cfg.Solar == nil {
+		return nil, fmt.Errorf("quality checks need the solar section (site latitude and longitude)")
+	}
+	q.site = cfg.Solar.Site
+	return q, nil
+}
+
+// Sample returns values followed by the QC flags of the checked registers.
+func (q *Quality) Sample(port string, slaveID uint8, values []RegisterValue, ts time.Time) []RegisterValue {
+	if q == nil {
+		return values
+	}
+	c, ok := q.ports[port]
+	if !ok {
+		return values
+	}
+	sun := q.site.Position(ts)
+	mu := math.Max(0, math.Cos(sun.Zenith*math.Pi/180))
+	if c.Plane == "tilted" && sun.Elevation > 0 {
+		mu = 1
+	}
+	sa := sun.Extraterrestrial()
+
+	var flags []RegisterValue
+	for _, v := range values {
+		if !slices.Contains(c.Registers, v.Name) {
+			continue
+		}
+		x := derivedInput(v)
+		key := port + "/" + v.Name
+		qc := 0
+		if x < -4 || x > sa*1.5*math.Pow(mu, 1.2)+100 {
+			qc |= qcPhysicallyPossible
+		}
+		if x < -2 || x > sa*1.2*math.Pow(mu, 1.2)+50 {
+			qc |= qcExtremelyRare
+		}
+		if sun.Elevation < c.NightElevation && math.Abs(x) > c.NightOffset {
+			qc |= qcNightOffset
+		}
+		if q.disagrees(c, key, slaveID, x, ts) {
+			qc |= qcDisagree
+		}
+		if q.held(c, key, slaveID, x, ts, sun.Elevation) {
+			qc |= qcStuck
+		}
+		flags = append(flags, RegisterValue{Register: -1, Name: v.Name + "_qc", Type: "flags", Value: float64(qc)})
+	}
+	if len(flags) == 0 {
+		return values
+	}
+	out := make([]RegisterValue, 0, len(values)+len(flags))
+	out = append(out, values...)
+	return append(out, flags...)
+}
+
+// disagrees records the sample and compares it with the median of the recent samples of the same
+// register from the port's other sensors. Two sensors that disagree are both flagged.
+func (q *Quality) disagrees(c QualityConfig, key string, slaveID uint8, x float64, ts time.Time) bool {
+	if q.latest[key] == nil {
+		q.latest[key] = make(map[uint8]qcSample)
+	}
+	q.latest[key][slaveID] = qcSample{value: x, ts: ts}
+	maxAge := time.Duration(c.AgreeMaxAge) * time.Second
+	var values []float64
+	for id, s := range q.latest[key] {
+		if id == slaveID {
+			continue
+		}
+		if age := ts.Sub(s.ts); age <= maxAge && age >= -maxAge {
+			values = append(values, s.value)
+		}
+	}
+	if len(values) == 0 {
+		return false
+	}
+	med := stats.Median(values)
+	return math.Abs(x-med) > math.Max(c.AgreeAbs, c.AgreeRel*math.Abs(med))
+}
+
+// held reports whether the value stayed within stuck_tolerance for stuck_seconds while the sun was
+// above stuck_min_elevation.
+func (q *Quality) held(c QualityConfig, key string, slaveID uint8, x float64, ts time.Time, elevation float64) bool {
+	if q.stuck[key] == nil {
+		q.stuck[key] = make(map[uint8]*qcSample)
+	}
+	s := q.stuck[key][slaveID]
+	if s == nil || math.Abs(x-s.value) > c.StuckTolerance || ts.Before(s.ts) {
+		q.stuck[key][slaveID] = &qcSample{value: x, ts: ts}
+		return false
+	}
+	return elevation >= c.StuckMinElevation && ts.Sub(s.ts) >= time.Duration(c.StuckSeconds)*time.Second
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDisagrees compares each sample with the median of the other sensors only: counted in, the
+// sample's own value pulls the median toward it and hides the disagreement.
+func TestDisagrees(t *testing.T) {
+	c := QualityConfig{AgreeAbs: 20, AgreeRel: 0.05, AgreeMaxAge: 30}
+	ts := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		slave uint8
+		value float64
+		want  bool
+	}{
+		{1, 500, false}, // no other sensor yet
+		{2, 500, false},
+		{3, 530, true}, // others' median 500
+		{4, 530, true}, // others' median 500, with its own value 515
+		{1, 515, false},
+	}
+	q := &Quality{latest: make(map[string]map[uint8]qcSample)}
+	for _, tt := range tests {
+		if got := q.disagrees(c, "com1/irr", tt.slave, tt.value, ts); got != tt.want {
+			t.Errorf("slave %d at %v: disagrees = %v, want %v", tt.slave, tt.value, got, tt.want)
+		}
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"strings"
+	"sync"
 )
 
 // RegisterValue represents a decoded register value for a slave.
 type RegisterValue struct {
-	Register int
+	Register int // -1 for derived fields
 	Name     string
-	Type     string // int16 or uint16
+	Type     string // int16, uint16, int32, uint32 or float
 	Value    float64
+	Unit     string
+	Stats    []StatValue // windowed statistics; when set they are stored instead of Value
+}
+
+// StatValue is one statistic of a register over an aggregation window.
+type StatValue struct {
+	Name    string // mean, min, max, last, count or stddev
+	Value   float64
+	Integer bool
 }
 
 // decodeKnownRegisters returns human-readable lines and structured values for a slave's known registers.
@@ -35,47 +47,156 @@ func decodeKnownRegisters(np NPortConfig, slaveID uint8, data []byte) (slaveName
 		if reg.Register < 0 {
 			continue
 		}
-		count := reg.RegisterCount
-		if count == 0 {
-			count = 1
-		}
-		if count != 1 {
+		val, ok := decodeRegister(reg, data)
+		if !ok {
 			continue
 		}
+		lines = append(lines, formatRegisterLine(val))
+		values = append(values, val)
+	}
 
-		byteIdx := reg.Register * 2
-		if byteIdx+1 >= len(data) {
-			continue
-		}
-		raw := data[byteIdx : byteIdx+2]
-		valueU16 := uint16(raw[0])<<8 | uint16(raw[1])
+	return slaveName, lines, values
+}
 
-		typ := strings.ToLower(reg.RegisterType)
-		if typ == "" {
-			typ = "int16"
-		}
+// registerWidth returns the number of 16-bit registers used by a register type.
+func registerWidth(typ string) int {
+	switch typ {
+	case "int32", "uint32", "float32":
+		return 2
+	default:
+		return 1
+	}
+}
 
-		switch typ {
-		case "uint16":
-			val := float64(valueU16)
-			lines = append(lines, fmt.Sprintf("reg=%d name=%s uint16=%d", reg.Register, reg.RegisterName, int64(val)))
-			values = append(values, RegisterValue{
-				Register: reg.Register,
-				Name:     reg.RegisterName,
-				Type:     "uint16",
-				Value:    val,
-			})
-		default: // int16 or unknown -> treat as int16
-			val := float64(int16(valueU16))
-			lines = append(lines, fmt.Sprintf("reg=%d name=%s int16=%d", reg.Register, reg.RegisterName, int64(val)))
-			values = append(values, RegisterValue{
-				Register: reg.Register,
-				Name:     reg.RegisterName,
-				Type:     "int16",
-				Value:    val,
-			})
-		}
+// registerType normalizes a configured register_type to int16, uint16, int32, uint32 or float32.
+func registerType(typ string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(typ)) {
+	case "", "int16", "s16":
+		return "int16", true
+	case "uint16", "u16":
+		return "uint16", true
+	case "int32", "s32":
+		return "int32", true
+	case "uint32", "u32":
+		return "uint32", true
+	case "float32", "float", "f32":
+		return "float32", true
 	}
+	return "", false
+}
 
-	return slaveName, lines, values
+// validateRegister checks the type, count and word order of a configured register, so a typo fails
+// at startup instead of decoding every frame wrong or not at all.
+func validateRegister(reg RegisterConfig) error {
+	typ, ok := registerType(reg.RegisterType)
+	if !ok {
+		return fmt.Errorf("unknown register_type %q (int16, uint16, int32, uint32, float32)", reg.RegisterType)
+	}
+	if width := registerWidth(typ); reg.RegisterCount != 0 && reg.RegisterCount != width {
+		return fmt.Errorf("register_count %d does not match %s, which uses %d", reg.RegisterCount, typ, width)
+	}
+	if reg.Register < 0 {
+		return fmt.Errorf("negative register %d", reg.Register)
+	}
+	switch strings.ToLower(reg.WordOrder) {
+	case "", "big", "little":
+	default:
+		return fmt.Errorf("unknown word_order %q (big, little)", reg.WordOrder)
+	}
+	return nil
+}
+
+// decodeRegister extracts reg from a response payload where data[0:2] is register 0. reg has been
+// checked by validateRegister when the config was loaded.
+func decodeRegister(reg RegisterConfig, data []byte) (RegisterValue, bool) {
+	typ, _ := registerType(reg.RegisterType)
+	width := registerWidth(typ)
+
+	byteIdx := reg.Register * 2
+	if byteIdx+width*2 > len(data) {
+		return RegisterValue{}, false
+	}
+	raw := data[byteIdx : byteIdx+width*2]
+	if width == 2 && strings.EqualFold(reg.WordOrder, "little") {
+		raw = []byte{raw[2], raw[3], raw[0], raw[1]}
+	}
+
+	var val float64
+	switch typ {
+	case "uint16":
+		val = float64(binary.BigEndian.Uint16(raw))
+	case "int32":
+		val = float64(int32(binary.BigEndian.Uint32(raw)))
+	case "uint32":
+		val = float64(binary.BigEndian.Uint32(raw))
+	case "float32":
+		val = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+	default:
+		val = float64(int16(binary.BigEndian.Uint16(raw)))
+	}
+
+	outType := typ
+	if reg.Gain != 0 && reg.Gain != 1 {
+		val *= reg.Gain
+		outType = "float"
+	}
+	if reg.Offset != 0 {
+		val += reg.Offset
+		outType = "float"
+	}
+	if typ == "float32" {
+		outType = "float"
+	}
+	if nonFinite(fmt.Sprintf("register %d %s", reg.Register, reg.RegisterName), val) {
+		return RegisterValue{}, false
+	}
+	return RegisterValue{
+		Register: reg.Register,
+		Name:     reg.RegisterName,
+		Type:     outType,
+		Value:    val,
+		Unit:     reg.Unit,
+	}, true
+}
+
+// nonFiniteLogged holds the keys whose non-finite values were already reported.
+var nonFiniteLogged sync.Map
+
+// nonFinite reports whether v is NaN or infinite, which line protocol cannot carry, and logs the
+// first such value of each key.
+func nonFinite(key string, v float64) bool {
+	if !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return false
+	}
+	if _, seen := nonFiniteLogged.LoadOrStore(key, true); !seen {
+		fmt.Printf("%s: non-finite value %v dropped; later ones are not logged\n", key, v)
+	}
+	return true
+}
+
+func formatRegisterLine(v RegisterValue) string {
+	line := fmt.Sprintf("reg=%d name=%s %s=%s", v.Register, v.Name, v.Type, formatRegisterValue(v.Value, v.Type))
+	if v.Unit != "" {
+		line += " " + v.Unit
+	}
+	return line
+}
+
+func formatRegisterValue(v float64, typ string) string {
+	switch strings.ToLower(typ) {
+	case "float":
+		return trimFloat(v)
+	default:
+		return fmt.Sprintf("%d", int64(v))
+	}
+}
+
+func trimFloat(v float64) string {
+	s := fmt.Sprintf("%.4f", v)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimRight(s, ".")
+	if s == "" {
+		return "0"
+	}
+	return s
 }
@@ -8,11 +8,14 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"common/alerts"
 )
 
 // StorageManager coordinates writes to multiple storage targets.
 type StorageManager struct {
 	dests []influxDestination
+	grid  time.Duration
 }
 
 type influxDestination struct {
@@ -70,7 +73,7 @@ func NewStorageManager(cfg StorageConfig) *StorageManager {
 	if len(dests) == 0 {
 		return nil
 	}
-	return &StorageManager{dests: dests}
+	return &StorageManager{dests: dests, grid: time.Duration(cfg.TimestampGridSeconds) * time.Second}
 }
 
 // Store writes register values to all configured destinations. It keeps writing even if some targets fail.
@@ -78,9 +81,94 @@ func (sm *StorageManager) Store(port string, slaveID uint8, slaveName string, va
 	if sm == nil || len(values) == 0 {
 		return
 	}
+	if sm.grid > 0 {
+		ts = ts.Truncate(sm.grid)
+	}
+	sm.write(func(measurement string) string {
+		return buildLineProtocol(measurement, port, slaveID, slaveName, values, ts)
+	})
+}
+
+// StoreDerived writes port fields, or site fields when port is empty. They are tagged with their
+// scope instead of a slave.
+func (sm *StorageManager) StoreDerived(port string, values []RegisterValue, ts time.Time) {
+	if sm == nil || len(values) == 0 {
+		return
+	}
+	if sm.grid > 0 {
+		ts = ts.Truncate(sm.grid)
+	}
+	tags := ",scope=site"
+	if port != "" {
+		tags = ",port=" + escapeTag(port) + ",scope=port"
+	}
+	sm.write(func(measurement string) string {
+		var b strings.Builder
+		for _, v := range values {
+			if nonFinite(strings.TrimPrefix(tags, ",")+" "+v.Name, v.Value) {
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s,register_name=%s", escapeTag(measurement), tags, escapeTag(v.Name))
+			if v.Unit != "" {
+				b.WriteString(",unit=" + escapeTag(v.Unit))
+			}
+			fmt.Fprintf(&b, " %s=%s %d\n", fieldKey(v), formatFieldValue(v), ts.UnixNano())
+		}
+		return b.String()
+	})
+}
+
+// StoreMissingSlaves records an event listing the expected slaves of a port that sent nothing before
+// the store deadline.
+func (sm *StorageManager) StoreMissingSlaves(port string, missing []uint8, ts time.Time) {
+	if sm == nil || len(missing) == 0 {
+		return
+	}
+	ids := make([]string, len(missing))
+	for i, s := range missing {
+		ids[i] = strconv.Itoa(int(s))
+	}
+	sm.write(func(measurement string) string {
+		return fmt.Sprintf("%s,port=%s,event=missing_slaves missing_slaves=%q,missing_count=%di %d\n",
+			escapeTag(measurement), escapeTag(port), strings.Join(ids, ","), len(missing), ts.UnixNano())
+	})
+}
+
+// StoreBusHealth writes bus_health points, given as line protocol, to all destinations. They use
+// their own measurement instead of the destinations' register measurement.
+func (sm *StorageManager) StoreBusHealth(lines string) {
+	if sm == nil || lines == "" {
+		return
+	}
+	sm.write(func(string) string { return lines })
+}
 
+// StoreAlerts writes alert events to the alerts measurement.
+func (sm *StorageManager) StoreAlerts(events []alerts.Event) {
+	if sm == nil || len(events) == 0 {
+		return
+	}
+	var b strings.Builder
+	for _, ev := range events {
+		b.WriteString(alerts.Measurement)
+		for _, tag := range []struct{ k, v string }{{"rule", ev.Rule}, {"series", ev.Series}, {"severity", ev.Severity}, {"state", ev.State}} {
+			b.WriteString("," + tag.k + "=" + escapeTag(tag.v))
+		}
+		firing := 0
+		if ev.State == alerts.StateFiring {
+			firing = 1
+		}
+		message := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(ev.Message)
+		fmt.Fprintf(&b, " value=%s,message=\"%s\",firing=%di %d\n", strconv.FormatFloat(ev.Value, 'f', -1, 64), message, firing, ev.Time.UnixNano())
+	}
+	lines := b.String()
+	sm.write(func(string) string { return lines })
+}
+
+// write posts the body built for each destination's measurement.
+func (sm *StorageManager) write(build func(measurement string) string) {
 	for _, dest := range sm.dests {
-		body := buildLineProtocol(dest.measurement, port, slaveID, slaveName, values, ts)
+		body := build(dest.measurement)
 		if body == "" {
 			continue
 		}
@@ -128,6 +216,21 @@ func buildLineProtocol(measurement string, port string, slaveID uint8, slaveName
 		if v.Name == "" {
 			continue
 		}
+		key := fmt.Sprintf("port=%s slave=%d %s", port, slaveID, v.Name)
+		if len(v.Stats) > 0 {
+			stats := make([]StatValue, 0, len(v.Stats))
+			for _, st := range v.Stats {
+				if !nonFinite(key+"_"+st.Name, st.Value) {
+					stats = append(stats, st)
+				}
+			}
+			if len(stats) == 0 {
+				continue
+			}
+			v.Stats = stats
+		} else if nonFinite(key, v.Value) {
+			continue
+		}
 		b.WriteString(escapeTag(measurement))
 		b.WriteString(",port=")
 		b.WriteString(escapeTag(port))
@@ -137,14 +240,31 @@ func buildLineProtocol(measurement string, port string, slaveID uint8, slaveName
 			b.WriteString(",slave_name=")
 			b.WriteString(escapeTag(slaveName))
 		}
-		b.WriteString(",register=")
-		b.WriteString(fmt.Sprintf("%d", v.Register))
+		if v.Register >= 0 {
+			b.WriteString(",register=")
+			b.WriteString(fmt.Sprintf("%d", v.Register))
+		}
 		b.WriteString(",register_name=")
 		b.WriteString(escapeTag(v.Name))
+		if v.Unit != "" {
+			b.WriteString(",unit=")
+			b.WriteString(escapeTag(v.Unit))
+		}
 		b.WriteString(" ")
-		b.WriteString(fieldKey(v))
-		b.WriteString("=")
-		b.WriteString(formatFieldValue(v))
+		if len(v.Stats) > 0 {
+			for i, st := range v.Stats {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(fieldKey(v) + "_" + st.Name)
+				b.WriteString("=")
+				b.WriteString(formatStatValue(st))
+			}
+		} else {
+			b.WriteString(fieldKey(v))
+			b.WriteString("=")
+			b.WriteString(formatFieldValue(v))
+		}
 		b.WriteString(" ")
 		b.WriteString(fmt.Sprintf("%d", timestamp))
 		b.WriteByte('\n')
@@ -161,6 +281,13 @@ func formatFieldValue(v RegisterValue) string {
 	}
 }
 
+func formatStatValue(st StatValue) string {
+	if st.Integer {
+		return fmt.Sprintf("%di", int64(st.Value))
+	}
+	return strconv.FormatFloat(st.Value, 'f', -1, 64)
+}
+
 func fieldKey(v RegisterValue) string {
 	name := strings.TrimSpace(v.Name)
 	if name == "" {
@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+const defaultStoreQueueSize = 256
+
 // StoreCoordinator keeps track of which slaves have produced valid frames and triggers a single store when all are seen.
+// In continuous and replay sub-modes it instead writes every recorded set, or one aggregate per slave and window,
+// until shutdown or the end of the recording.
+// With a window configured, store sub-mode writes the statistics of the first full window in which all slaves were seen.
 type StoreCoordinator struct {
 	expected map[string]map[uint8]struct{}
 	last     map[string]map[uint8]StoredFrame
@@ -14,6 +23,26 @@ type StoreCoordinator struct {
 	cancel   context.CancelFunc
 	mu       sync.Mutex
 	done     bool
+	deadline time.Time     // store sub-mode: store partially once this passes; zero waits for all slaves
+	wait     time.Duration // store sub-mode on recorded input: store_deadline_seconds after the first value
+	live     bool          // input read from the NPorts as it happens; recordings and captures follow their receive times
+	lastTS   time.Time     // recorded input: latest receive time, the clock windows and the deadline follow
+	quality  *Quality
+	deriver  *Deriver
+	alerter  *Alerter
+	latest   map[string]map[uint8]*busSlave // continuous without window: last set per slave, for port and site fields and alerts
+	cycleTS  time.Time                      // continuous without window: receive time of the open bus cycle's last set
+
+	continuous  bool
+	interval    time.Duration // aggregation window; 0 stores every recorded set
+	stats       []string
+	window      map[string]map[uint8]*slaveWindow
+	windowStart time.Time // start of the open window on the receive-time grid; zero when none is open
+	windowFull  bool      // the open window follows a closed one, so it did not start mid-way at startup
+	writes      chan storeBatch
+	dropped     int
+	stop        chan struct{}
+	wg          sync.WaitGroup
 }
 
 type StoredFrame struct {
@@ -22,7 +51,36 @@ type StoredFrame struct {
 	ts        time.Time
 }
 
-func NewStoreCoordinator(cfg Config, storage *StorageManager, cancel context.CancelFunc) *StoreCoordinator {
+// storeBatch is one pending write of a slave's values.
+type storeBatch struct {
+	port      string
+	slaveID   uint8
+	slaveName string
+	values    []RegisterValue
+	ts        time.Time
+	derived   bool // port or site fields from Deriver.Cycle, stored by scope instead of slave
+}
+
+// slaveWindow accumulates the values of one slave during the current window.
+type slaveWindow struct {
+	slaveName string
+	registers map[string]*registerAccumulator
+	order     []string
+}
+
+// registerAccumulator keeps running statistics of one register (Welford's method for the variance).
+type registerAccumulator struct {
+	value    RegisterValue // last value seen
+	sum      float64
+	count    int
+	min, max float64
+	mean, m2 float64
+}
+
+// NewStoreCoordinator returns the coordinator of a storing sub-mode. live is false for replays and
+// captures, whose receive times are in the past: windows and the store deadline then follow the
+// receive times instead of the wall clock.
+func NewStoreCoordinator(cfg Config, storage *StorageManager, quality *Quality, deriver *Deriver, alerter *Alerter, cancel context.CancelFunc, subMode string, live bool) *StoreCoordinator {
 	if storage == nil {
 		return nil
 	}
@@ -37,19 +95,79 @@ func NewStoreCoordinator(cfg Config, storage *StorageManager, cancel context.Can
 		}
 		expected[np.Name] = set
 	}
+	interval := time.Duration(cfg.Aggregate.WindowSeconds) * time.Second
+	if subMode == "continuous" || subMode == "replay" {
+		if interval <= 0 {
+			interval = time.Duration(cfg.Continuous.IntervalSeconds) * time.Second
+		}
+		return newContinuousCoordinator(cfg.Continuous, storage, quality, deriver, alerter, expected, interval, cfg.Aggregate.Stats, live)
+	}
 	if len(expected) == 0 {
 		return nil
 	}
-	return &StoreCoordinator{
+	sc := &StoreCoordinator{
 		expected: expected,
 		last:     make(map[string]map[uint8]StoredFrame),
 		storage:  storage,
+		quality:  quality,
+		deriver:  deriver,
+		alerter:  alerter,
 		cancel:   cancel,
+		live:     live,
+		interval: interval,
+		stats:    cfg.Aggregate.Stats,
+		window:   make(map[string]map[uint8]*slaveWindow),
+		stop:     make(chan struct{}),
+	}
+	if cfg.StoreDeadlineSeconds > 0 {
+		if live {
+			sc.deadline = time.Now().Add(time.Duration(cfg.StoreDeadlineSeconds) * time.Second)
+		} else {
+			sc.wait = time.Duration(cfg.StoreDeadlineSeconds) * time.Second
+		}
+	}
+	if sc.interval > 0 && live {
+		sc.wg.Add(1)
+		go sc.intervalLoop()
+	}
+	if !sc.deadline.IsZero() {
+		sc.wg.Add(1)
+		go sc.deadlineLoop()
 	}
+	return sc
 }
 
-// Record saves the latest values for a slave and triggers storage when all expected slaves are seen.
-func (sc *StoreCoordinator) Record(port string, slaveID uint8, slaveName string, values []RegisterValue) {
+func newContinuousCoordinator(cfg ContinuousConfig, storage *StorageManager, quality *Quality, deriver *Deriver, alerter *Alerter, expected map[string]map[uint8]struct{}, interval time.Duration, stats []string, live bool) *StoreCoordinator {
+	queue := cfg.QueueSize
+	if queue <= 0 {
+		queue = defaultStoreQueueSize
+	}
+	sc := &StoreCoordinator{
+		expected:   expected,
+		storage:    storage,
+		quality:    quality,
+		deriver:    deriver,
+		alerter:    alerter,
+		latest:     make(map[string]map[uint8]*busSlave),
+		continuous: true,
+		live:       live,
+		interval:   interval,
+		stats:      stats,
+		window:     make(map[string]map[uint8]*slaveWindow),
+		writes:     make(chan storeBatch, queue),
+		stop:       make(chan struct{}),
+	}
+	sc.wg.Add(1)
+	go sc.writeLoop()
+	if sc.interval > 0 && live {
+		sc.wg.Add(1)
+		go sc.intervalLoop()
+	}
+	return sc
+}
+
+// Record saves the latest values for a slave, received at ts, and triggers storage when all expected slaves are seen.
+func (sc *StoreCoordinator) Record(port string, slaveID uint8, slaveName string, values []RegisterValue, ts time.Time) {
 	if sc == nil || len(values) == 0 {
 		return
 	}
@@ -59,6 +177,24 @@ func (sc *StoreCoordinator) Record(port string, slaveID uint8, slaveName string,
 	if sc.done {
 		return
 	}
+	if !sc.live {
+		if sc.wait > 0 && sc.deadline.IsZero() {
+			sc.deadline = ts.Add(sc.wait)
+		}
+		if ts.After(sc.lastTS) {
+			sc.lastTS = ts
+		}
+		if !sc.continuous && !sc.deadline.IsZero() && !ts.Before(sc.deadline) {
+			sc.expire()
+			return
+		}
+	}
+	values = sc.quality.Sample(port, slaveID, values, ts)
+	values = sc.deriver.Slave(port, slaveID, values)
+	if sc.continuous {
+		sc.recordContinuous(port, slaveID, slaveName, values, ts)
+		return
+	}
 
 	expectedSlaves, ok := sc.expected[port]
 	if !ok || len(expectedSlaves) == 0 {
@@ -67,6 +203,10 @@ func (sc *StoreCoordinator) Record(port string, slaveID uint8, slaveName string,
 	if _, wanted := expectedSlaves[slaveID]; !wanted {
 		return
 	}
+	if sc.interval > 0 {
+		sc.accumulate(port, slaveID, slaveName, values, ts)
+		return
+	}
 
 	if sc.last[port] == nil {
 		sc.last[port] = make(map[uint8]StoredFrame)
@@ -74,15 +214,12 @@ func (sc *StoreCoordinator) Record(port string, slaveID uint8, slaveName string,
 	sc.last[port][slaveID] = StoredFrame{
 		slaveName: slaveName,
 		values:    values,
-		ts:        time.Now().UTC(),
+		ts:        ts,
 	}
 
 	if sc.allSeen() {
 		sc.flush()
-		sc.done = true
-		if sc.cancel != nil {
-			sc.cancel()
-		}
+		sc.finish()
 	}
 }
 
@@ -102,9 +239,415 @@ func (sc *StoreCoordinator) allSeen() bool {
 }
 
 func (sc *StoreCoordinator) flush() {
+	var (
+		batches []storeBatch
+		latest  time.Time
+	)
 	for port, slaves := range sc.last {
 		for slaveID, frame := range slaves {
 			sc.storage.Store(port, slaveID, frame.slaveName, frame.values, frame.ts)
+			batches = append(batches, storeBatch{port: port, slaveID: slaveID, slaveName: frame.slaveName, values: frame.values, ts: frame.ts})
+			if frame.ts.After(latest) {
+				latest = frame.ts
+			}
+		}
+	}
+	derived := sc.deriver.Cycle(batches, latest)
+	for _, b := range derived {
+		sc.storage.StoreDerived(b.port, b.values, b.ts)
+	}
+	sc.alerter.Cycle(append(batches, derived...), latest)
+}
+
+// missingSlaves lists, per port, the expected slaves without stored values.
+func (sc *StoreCoordinator) missingSlaves() map[string][]uint8 {
+	missing := make(map[string][]uint8)
+	for port, expectedSlaves := range sc.expected {
+		for slave := range expectedSlaves {
+			if _, ok := sc.last[port][slave]; !ok {
+				missing[port] = append(missing[port], slave)
+			}
+		}
+		sort.Slice(missing[port], func(i, j int) bool { return missing[port][i] < missing[port][j] })
+	}
+	return missing
+}
+
+// storePartial stores the slaves that answered before the deadline, records the missing ones and
+// stops acquisition. Callers hold sc.mu.
+func (sc *StoreCoordinator) storePartial(ts time.Time) {
+	missing := sc.missingSlaves()
+	ports := make([]string, 0, len(missing))
+	for port := range missing {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		fmt.Printf("[%s] store deadline reached; missing slaves %v\n", port, missing[port])
+		sc.storage.StoreMissingSlaves(port, missing[port], ts)
+	}
+	sc.flush()
+	sc.finish()
+}
+
+// deadlineLoop stores partially at the deadline unless all slaves were stored before, so store
+// sub-mode ends even when every slave went quiet. With a window configured, the statistics of the
+// open window, if any, replace those of the last closed one for the slaves it has.
+func (sc *StoreCoordinator) deadlineLoop() {
+	defer sc.wg.Done()
+	timer := time.NewTimer(time.Until(sc.deadline))
+	defer timer.Stop()
+	select {
+	case <-sc.stop:
+		return
+	case <-timer.C:
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.done {
+		sc.expire()
+	}
+}
+
+// expire stores partially at the deadline. Callers hold sc.mu.
+func (sc *StoreCoordinator) expire() {
+	if sc.interval > 0 && !sc.windowStart.IsZero() {
+		for _, b := range sc.windowBatches(sc.windowStart.Add(sc.interval)) {
+			if sc.last[b.port] == nil {
+				sc.last[b.port] = make(map[uint8]StoredFrame)
+			}
+			sc.last[b.port][b.slaveID] = StoredFrame{slaveName: b.slaveName, values: b.values, ts: b.ts}
+		}
+	}
+	sc.storePartial(sc.now().UTC())
+}
+
+// now is the wall clock for live input and the latest receive time for recorded input.
+func (sc *StoreCoordinator) now() time.Time {
+	if sc.live {
+		return time.Now()
+	}
+	return sc.lastTS
+}
+
+// finish marks the single store done and stops acquisition. Callers hold sc.mu.
+func (sc *StoreCoordinator) finish() {
+	sc.done = true
+	if sc.cancel != nil {
+		sc.cancel()
+	}
+}
+
+// recordContinuous queues the values right away or adds them to the slave's window.
+// detected_slaves, when set for a port, limits which slaves are stored. Callers hold sc.mu.
+func (sc *StoreCoordinator) recordContinuous(port string, slaveID uint8, slaveName string, values []RegisterValue, ts time.Time) {
+	if expectedSlaves, ok := sc.expected[port]; ok {
+		if _, wanted := expectedSlaves[slaveID]; !wanted {
+			return
+		}
+	}
+	if sc.interval <= 0 {
+		b := storeBatch{port: port, slaveID: slaveID, slaveName: slaveName, values: values, ts: ts}
+		sc.enqueue(b)
+		if sc.deriver != nil || sc.alerter != nil {
+			sc.busCycle(b)
+		}
+		return
+	}
+	sc.accumulate(port, slaveID, slaveName, values, ts)
+}
+
+// accumulate adds values received at ts to the slave's window. Windows follow receive times, so a
+// value from a later window closes the open one; replayed captures aggregate like live traffic, with
+// the last window closed by Close instead of the wall-clock intervalLoop. Callers hold sc.mu.
+func (sc *StoreCoordinator) accumulate(port string, slaveID uint8, slaveName string, values []RegisterValue, ts time.Time) {
+	start := ts.Truncate(sc.interval)
+	if !sc.windowStart.IsZero() && start.After(sc.windowStart) {
+		sc.closeWindow(sc.windowStart.Add(sc.interval))
+		if sc.done {
+			return
+		}
+	}
+	if sc.windowStart.IsZero() || start.After(sc.windowStart) {
+		sc.windowStart = start
+	}
+	if sc.window[port] == nil {
+		sc.window[port] = make(map[uint8]*slaveWindow)
+	}
+	w := sc.window[port][slaveID]
+	if w == nil {
+		w = &slaveWindow{registers: make(map[string]*registerAccumulator)}
+		sc.window[port][slaveID] = w
+	}
+	w.slaveName = slaveName
+	for _, v := range values {
+		acc := w.registers[v.Name]
+		if acc == nil {
+			acc = &registerAccumulator{}
+			w.registers[v.Name] = acc
+			w.order = append(w.order, v.Name)
+		}
+		acc.add(v)
+	}
+}
+
+func (a *registerAccumulator) add(v RegisterValue) {
+	if v.Type == "flags" && a.count > 0 {
+		// QC flags keep every check that failed during the window.
+		v.Value = float64(int64(a.value.Value) | int64(v.Value))
+	}
+	a.value = v
+	a.sum += v.Value
+	a.count++
+	if a.count == 1 || v.Value < a.min {
+		a.min = v.Value
+	}
+	if a.count == 1 || v.Value > a.max {
+		a.max = v.Value
+	}
+	delta := v.Value - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (v.Value - a.mean)
+}
+
+// result returns the value stored for the window. Without configured stats, float registers store
+// their mean under the register name. Integer registers store their stats, by default the mean, as
+// <name>_<stat> fields, so the register name keeps its integer field type; their min, max and last
+// stay integers. QC flags are not averaged: they store every check that failed in the window.
+func (a *registerAccumulator) result(stats []string) RegisterValue {
+	v := a.value
+	if v.Type == "flags" || a.count == 0 {
+		return v
+	}
+	integer := !strings.EqualFold(v.Type, "float")
+	if len(stats) == 0 {
+		if !integer {
+			v.Value = a.sum / float64(a.count)
+			return v
+		}
+		stats = []string{"mean"}
+	}
+	for _, name := range stats {
+		st := StatValue{Name: strings.ToLower(name)}
+		switch st.Name {
+		case "mean":
+			st.Value = a.sum / float64(a.count)
+		case "min":
+			st.Value, st.Integer = a.min, integer
+		case "max":
+			st.Value, st.Integer = a.max, integer
+		case "last":
+			st.Value, st.Integer = a.value.Value, integer
+		case "count":
+			st.Value = float64(a.count)
+			st.Integer = true
+		case "stddev":
+			if a.count < 2 {
+				continue // sample standard deviation needs two readings
+			}
+			st.Value = math.Sqrt(a.m2 / float64(a.count-1))
+		default:
+			continue
+		}
+		v.Stats = append(v.Stats, st)
+	}
+	return v
+}
+
+func validAggregateStat(name string) bool {
+	switch strings.ToLower(name) {
+	case "mean", "min", "max", "last", "count", "stddev":
+		return true
+	}
+	return false
+}
+
+// enqueue hands a batch to the writer without blocking acquisition. When storage falls behind and
+// the queue is full the oldest batch is dropped; recorded input waits instead. Callers hold sc.mu.
+func (sc *StoreCoordinator) enqueue(b storeBatch) {
+	if !sc.live {
+		sc.writes <- b
+		return
+	}
+	for {
+		select {
+		case sc.writes <- b:
+			return
+		default:
+		}
+		select {
+		case <-sc.writes:
+			sc.dropped++
+			if sc.dropped == 1 || sc.dropped%100 == 0 {
+				fmt.Printf("store queue full; dropped %d pending writes so far\n", sc.dropped)
+			}
+		default:
+		}
+	}
+}
+
+func (sc *StoreCoordinator) writeLoop() {
+	defer sc.wg.Done()
+	for b := range sc.writes {
+		if b.derived {
+			sc.storage.StoreDerived(b.port, b.values, b.ts)
+			continue
+		}
+		sc.storage.Store(b.port, b.slaveID, b.slaveName, b.values, b.ts)
+	}
+}
+
+// busSlave is the last set of a slave written without windowing.
+type busSlave struct {
+	batch storeBatch
+	heard bool // heard in the open bus cycle
+}
+
+// busCycle tracks the bus cycles of sets written without windowing. A cycle ends when a slave is
+// heard again; closeCycle then evaluates the port and site fields and the alert rules once for it.
+// Callers hold sc.mu.
+func (sc *StoreCoordinator) busCycle(b storeBatch) {
+	slaves := sc.latest[b.port]
+	if slaves == nil {
+		slaves = make(map[uint8]*busSlave)
+		sc.latest[b.port] = slaves
+	}
+	s := slaves[b.slaveID]
+	if s == nil {
+		s = &busSlave{}
+		slaves[b.slaveID] = s
+	} else if s.heard {
+		sc.closeCycle()
+	}
+	s.batch, s.heard = b, true
+	if b.ts.After(sc.cycleTS) {
+		sc.cycleTS = b.ts
+	}
+}
+
+// closeCycle evaluates the port and site fields over the latest set of every slave, and the alert
+// rules over the sets heard in the open bus cycle, so slaves that went silent are missing from it.
+// Callers hold sc.mu.
+func (sc *StoreCoordinator) closeCycle() {
+	ts := sc.cycleTS
+	var latest, heard []storeBatch
+	for _, slaves := range sc.latest {
+		for _, s := range slaves {
+			latest = append(latest, s.batch)
+			if s.heard {
+				heard = append(heard, s.batch)
+			}
+			s.heard = false
+		}
+	}
+	derived := sc.deriver.Cycle(latest, ts)
+	for _, d := range derived {
+		sc.enqueue(d)
+	}
+	sc.alerter.Cycle(append(heard, derived...), ts)
+}
+
+// intervalLoop closes the open window when no later value arrived for a whole further interval,
+// so a silent bus still gets its last window written. It only runs for live input.
+func (sc *StoreCoordinator) intervalLoop() {
+	defer sc.wg.Done()
+	for {
+		now := time.Now()
+		next := now.Truncate(sc.interval).Add(sc.interval)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-sc.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		sc.mu.Lock()
+		if !sc.done && !sc.windowStart.IsZero() && !next.Before(sc.windowStart.Add(2*sc.interval)) {
+			sc.closeWindow(sc.windowStart.Add(sc.interval))
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// closeWindow ends the current window at end and starts a new one. Continuous mode queues every
+// slave's aggregate. Store mode writes once a full window saw every expected slave, or after the
+// store deadline whatever the full window has, then stops. Callers hold sc.mu.
+func (sc *StoreCoordinator) closeWindow(end time.Time) {
+	batches := sc.windowBatches(end)
+	full := sc.windowFull
+	sc.window = make(map[string]map[uint8]*slaveWindow)
+	sc.windowStart = time.Time{}
+	sc.windowFull = true
+
+	if sc.continuous {
+		for _, b := range batches {
+			sc.enqueue(b)
+		}
+		derived := sc.deriver.Cycle(batches, end)
+		for _, b := range derived {
+			sc.enqueue(b)
+		}
+		sc.alerter.Cycle(append(batches, derived...), end)
+		return
+	}
+	if !full {
+		return
+	}
+	sc.last = make(map[string]map[uint8]StoredFrame)
+	for _, b := range batches {
+		if sc.last[b.port] == nil {
+			sc.last[b.port] = make(map[uint8]StoredFrame)
+		}
+		sc.last[b.port][b.slaveID] = StoredFrame{slaveName: b.slaveName, values: b.values, ts: b.ts}
+	}
+	if !sc.allSeen() {
+		if !sc.deadline.IsZero() && !sc.now().Before(sc.deadline) && len(batches) > 0 {
+			sc.storePartial(end)
+			return
+		}
+		fmt.Printf("aggregate window ending %s missed expected slaves; waiting for the next one\n", end.Format(time.RFC3339))
+		return
+	}
+	sc.flush()
+	sc.finish()
+}
+
+func (sc *StoreCoordinator) windowBatches(end time.Time) []storeBatch {
+	var batches []storeBatch
+	for port, slaves := range sc.window {
+		for slaveID, w := range slaves {
+			values := make([]RegisterValue, 0, len(w.order))
+			for _, name := range w.order {
+				values = append(values, w.registers[name].result(sc.stats))
+			}
+			batches = append(batches, storeBatch{port: port, slaveID: slaveID, slaveName: w.slaveName, values: values, ts: end})
+		}
+	}
+	return batches
+}
+
+// Close stops the window timer. A continuous coordinator also writes its partial window or bus cycle
+// and drains pending writes. In store sub-mode, recorded input that ended before its deadline stores partially,
+// as no later receive time will reach it.
+func (sc *StoreCoordinator) Close() {
+	if sc == nil {
+		return
+	}
+	close(sc.stop)
+	sc.mu.Lock()
+	if !sc.continuous && !sc.live && !sc.done && !sc.deadline.IsZero() {
+		sc.expire()
+	}
+	if sc.continuous {
+		if sc.interval > 0 && !sc.done && !sc.windowStart.IsZero() {
+			sc.closeWindow(sc.windowStart.Add(sc.interval))
+		}
+		if sc.interval <= 0 && !sc.done && !sc.cycleTS.IsZero() {
+			sc.closeCycle()
 		}
+		close(sc.writes)
 	}
+	sc.done = true
+	sc.mu.Unlock()
+	sc.wg.Wait()
 }
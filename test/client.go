@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// Result kinds of a single read.
+const (
+	resultData      = "data"
+	resultException = "exception"
+	resultGateway   = "gateway" // the gateway answered for a slave behind it that did not (exception 0x0A/0x0B)
+	resultTimeout   = "timeout"
+	resultError     = "error"
+)
+
+// registerRange is a block of protocol (0-based) register addresses.
+type registerRange struct {
+	Start int `json:"start"`
+	Count int `json:"count"`
+}
+
+func (r registerRange) String() string {
+	return fmt.Sprintf("%d+%d", r.Start, r.Count)
+}
+
+// session is one Modbus TCP connection whose unit ID is switched between requests.
+type session struct {
+	handler *modbus.TCPClientHandler
+	client  modbus.Client
+}
+
+func newSession(addr string, timeout time.Duration) *session {
+	h := modbus.NewTCPClientHandler(addr)
+	h.Timeout = timeout
+	return &session{handler: h, client: modbus.NewClient(h)}
+}
+
+// read reads count registers at start with function code 3 or 4. After a timeout or transport
+// error the connection is closed, so a late response cannot be taken for the next request's.
+func (s *session) read(slave, fc, start, count int) ([]byte, error) {
+	s.handler.SlaveId = byte(slave)
+	var (
+		data []byte
+		err  error
+	)
+	switch fc {
+	case 3:
+		data, err = s.client.ReadHoldingRegisters(uint16(start), uint16(count))
+	case 4:
+		data, err = s.client.ReadInputRegisters(uint16(start), uint16(count))
+	default:
+		return nil, fmt.Errorf("unsupported function code %d", fc)
+	}
+	var mbErr *modbus.ModbusError
+	if err != nil && !errors.As(err, &mbErr) {
+		_ = s.handler.Close()
+	}
+	return data, err
+}
+
+func (s *session) close() {
+	_ = s.handler.Close()
+}
+
+// classify tells data, exceptions and timeouts apart. The exception code is 0 for other kinds.
+func classify(err error) (kind string, exception byte) {
+	if err == nil {
+		return resultData, 0
+	}
+	var mbErr *modbus.ModbusError
+	if errors.As(err, &mbErr) {
+		switch mbErr.ExceptionCode {
+		case modbus.ExceptionCodeGatewayPathUnavailable, modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond:
+			return resultGateway, mbErr.ExceptionCode
+		}
+		return resultException, mbErr.ExceptionCode
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return resultTimeout, 0
+	}
+	return resultError, 0
+}
+
+// parseIDList parses slave IDs such as "1-10,15,20-22".
+func parseIDList(spec string, min, max int) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i > 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("id range %q outside %d-%d", part, min, max)
+		}
+		for id := from; id <= to; id++ {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no ids in %q", spec)
+	}
+	return ids, nil
+}
+
+// parseRanges parses register blocks such as "4989:10,5000:2" (start:count, count defaults to 1).
+func parseRanges(spec string) ([]registerRange, error) {
+	var ranges []registerRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		startText, countText, hasCount := strings.Cut(part, ":")
+		start, err := strconv.Atoi(strings.TrimSpace(startText))
+		if err != nil || start < 0 || start > 0xFFFF {
+			return nil, fmt.Errorf("invalid register start in %q", part)
+		}
+		count := 1
+		if hasCount {
+			count, err = strconv.Atoi(strings.TrimSpace(countText))
+			if err != nil || count < 1 || count > 125 {
+				return nil, fmt.Errorf("invalid register count in %q (1-125)", part)
+			}
+		}
+		if start+count > 0x10000 {
+			return nil, fmt.Errorf("register range %q ends past 65535", part)
+		}
+		ranges = append(ranges, registerRange{Start: start, Count: count})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no register ranges in %q", spec)
+	}
+	return ranges, nil
+}
+
+// parseFunctionCodes parses read function codes such as "3,4".
+func parseFunctionCodes(spec string) ([]int, error) {
+	codes, err := parseIDList(spec, 3, 4)
+	if err != nil {
+		return nil, fmt.Errorf("function codes: %w (3 or 4)", err)
+	}
+	return codes, nil
+}
+
+// decodeValue renders register data as datatype: u16, s16, u32, s32, f32, utf8 or hex. 16-bit
+// types list every register; 32-bit types combine pairs in the given word order.
+func decodeValue(data []byte, datatype string, littleWords bool) (string, error) {
+	switch strings.ToLower(datatype) {
+	case "hex":
+		return fmt.Sprintf("% x", data), nil
+	case "utf8", "string":
+		return strings.TrimSpace(decodeUTF8(data)), nil
+	case "u16", "uint16", "s16", "int16":
+		signed := strings.HasPrefix(strings.ToLower(datatype), "s") || strings.HasPrefix(strings.ToLower(datatype), "int")
+		var parts []string
+		for i := 0; i+1 < len(data); i += 2 {
+			w := binary.BigEndian.Uint16(data[i:])
+			if signed {
+				parts = append(parts, strconv.Itoa(int(int16(w))))
+			} else {
+				parts = append(parts, strconv.Itoa(int(w)))
+			}
+		}
+		return strings.Join(parts, " "), nil
+	case "u32", "uint32", "s32", "int32", "f32", "float32":
+		kind := strings.ToLower(datatype)[:1]
+		var parts []string
+		for i := 0; i+3 < len(data); i += 4 {
+			v := combineWords(binary.BigEndian.Uint16(data[i:]), binary.BigEndian.Uint16(data[i+2:]), littleWords)
+			switch kind {
+			case "u":
+				parts = append(parts, strconv.FormatUint(uint64(v), 10))
+			case "s", "i":
+				parts = append(parts, strconv.Itoa(int(int32(v))))
+			default:
+				parts = append(parts, strconv.FormatFloat(float64(math.Float32frombits(v)), 'g', 7, 32))
+			}
+		}
+		return strings.Join(parts, " "), nil
+	}
+	return "", fmt.Errorf("unknown datatype %q (u16, s16, u32, s32, f32, utf8, hex)", datatype)
+}
+
+// combineWords joins two registers into 32 bits; little puts the low word first.
+func combineWords(first, second uint16, little bool) uint32 {
+	if little {
+		return uint32(second)<<16 | uint32(first)
+	}
+	return uint32(first)<<16 | uint32(second)
+}
+
+// decodeUTF8 decodes register bytes as a NUL-terminated UTF-8 string, like internal.UTF8.
+func decodeUTF8(b []byte) string {
+	if i := bytes.IndexByte(b, 0x00); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimRight(b, "\x00"))
+}
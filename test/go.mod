@@ -2,6 +2,9 @@ module test-slave-id-sungrow-inverters
 
 go 1.24.4
 
-require github.com/goburrow/modbus v0.1.0
+require (
+	github.com/goburrow/modbus v0.1.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require github.com/goburrow/serial v0.1.0 // indirect
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeBlock is a register range one read returned data for.
+type probeBlock struct {
+	fc    int
+	start int
+	count int
+}
+
+// probeRegister is what the samples tell about one register.
+type probeRegister struct {
+	fc      int
+	address int
+	samples []uint16
+}
+
+// draftRegister is one entry of the draft profile.
+type draftRegister struct {
+	fc        int
+	address   int
+	datatype  string
+	wordOrder string
+	class     string
+	values    []float64
+}
+
+func runProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	host := fs.String("host", "192.168.1.90", "Modbus TCP gateway address")
+	port := fs.Int("port", 502, "Modbus TCP port")
+	slave := fs.Int("slave", 1, "slave ID to probe")
+	from := fs.Int("from", 0, "first register address (0-based protocol address)")
+	to := fs.Int("to", 999, "last register address")
+	fcSpec := fs.String("fc", "3,4", "function codes to sweep: 3 (holding), 4 (input) or 3,4")
+	block := fs.Int("block", 50, "registers per read while sweeping (1-125)")
+	samples := fs.Int("samples", 5, "reads of each block used to classify registers")
+	interval := fs.Duration("interval", time.Second, "pause between samples")
+	timeout := fs.Duration("timeout", 500*time.Millisecond, "response timeout per request")
+	delay := fs.Duration("delay", 0, "pause between requests")
+	name := fs.String("name", "", "profile name (default probe_<host>_<slave>)")
+	out := fs.String("out", "", "write the draft profile to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	if *slave < 0 || *slave > 255 {
+		return fmt.Errorf("slave %d outside 0-255", *slave)
+	}
+	if *from < 0 || *to > 0xFFFF || *from > *to {
+		return fmt.Errorf("invalid address range %d-%d", *from, *to)
+	}
+	if *block < 1 || *block > 125 {
+		return fmt.Errorf("block %d outside 1-125", *block)
+	}
+	if *samples < 2 {
+		*samples = 2
+	}
+	codes, err := parseFunctionCodes(*fcSpec)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = fmt.Sprintf("probe_%s_%d", strings.NewReplacer(".", "_", ":", "_").Replace(*host), *slave)
+	}
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	s := newSession(addr, *timeout)
+	defer s.close()
+	p := &prober{session: s, slave: *slave, delay: *delay}
+
+	var blocks []probeBlock
+	for _, fc := range codes {
+		fmt.Fprintf(os.Stderr, "sweeping fc%d %d-%d on slave %d\n", fc, *from, *to, *slave)
+		for start := *from; start <= *to; start += *block {
+			count := min(*block, *to-start+1)
+			found, err := p.sweep(fc, start, count)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, found...)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d readable blocks, %d requests, %d exceptions, %d timeouts\n", len(blocks), p.requests, p.exceptions, p.timeouts)
+	if len(blocks) == 0 {
+		return fmt.Errorf("no readable registers found on slave %d", *slave)
+	}
+
+	regs, err := p.sample(blocks, *samples, *interval)
+	if err != nil {
+		return err
+	}
+	draft := draftProfile(regs)
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	writeDraftProfile(w, *name, fmt.Sprintf("draft from probing slave %d at %s, %d samples every %s", *slave, addr, *samples, *interval), draft)
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "%s written\n", *out)
+	}
+	return nil
+}
+
+type prober struct {
+	session    *session
+	slave      int
+	delay      time.Duration
+	requests   int
+	exceptions int
+	timeouts   int
+}
+
+func (p *prober) read(fc, start, count int) ([]byte, string, error) {
+	p.requests++
+	data, err := p.session.read(p.slave, fc, start, count)
+	if p.delay > 0 {
+		time.Sleep(p.delay)
+	}
+	kind, _ := classify(err)
+	switch kind {
+	case resultException:
+		p.exceptions++
+	case resultTimeout:
+		p.timeouts++
+	}
+	return data, kind, err
+}
+
+// sweep reads a range and, when the slave refuses it, halves the range until the readable parts
+// are isolated. Devices that stay silent on illegal addresses are handled like exceptions.
+func (p *prober) sweep(fc, start, count int) ([]probeBlock, error) {
+	data, kind, err := p.read(fc, start, count)
+	switch kind {
+	case resultData:
+		if len(data) != count*2 {
+			return nil, nil
+		}
+		return []probeBlock{{fc: fc, start: start, count: count}}, nil
+	case resultGateway, resultError:
+		return nil, fmt.Errorf("slave %d fc%d %d+%d: %v", p.slave, fc, start, count, err)
+	}
+	if count == 1 {
+		return nil, nil
+	}
+	half := count / 2
+	left, err := p.sweep(fc, start, half)
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.sweep(fc, start+half, count-half)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// sample reads every block n times and collects the values per register.
+func (p *prober) sample(blocks []probeBlock, n int, interval time.Duration) ([]*probeRegister, error) {
+	byKey := make(map[[2]int]*probeRegister)
+	var regs []*probeRegister
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		fmt.Fprintf(os.Stderr, "sample %d/%d\n", i+1, n)
+		for _, b := range blocks {
+			data, kind, err := p.read(b.fc, b.start, b.count)
+			if kind != resultData || len(data) != b.count*2 {
+				return nil, fmt.Errorf("fc%d %d+%d readable while sweeping but not while sampling: %v", b.fc, b.start, b.count, err)
+			}
+			for j := 0; j < b.count; j++ {
+				key := [2]int{b.fc, b.start + j}
+				r := byKey[key]
+				if r == nil {
+					r = &probeRegister{fc: b.fc, address: b.start + j}
+					byKey[key] = r
+					regs = append(regs, r)
+				}
+				r.samples = append(r.samples, binary.BigEndian.Uint16(data[j*2:]))
+			}
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].fc != regs[j].fc {
+			return regs[i].fc < regs[j].fc
+		}
+		return regs[i].address < regs[j].address
+	})
+	return regs, nil
+}
+
+// draftProfile guesses a datatype for each register. Adjacent register pairs become float32 when
+// every sample decodes to a plausible float, or uint32 when the pair counts up across the word
+// boundary; everything else stays 16-bit, signed when the values look negative. A float in one word
+// order overlaps a shifted float in the other, so each contiguous run of registers gets the word
+// order that yields more floats, big on a tie.
+func draftProfile(regs []*probeRegister) []draftRegister {
+	var draft []draftRegister
+	for start := 0; start < len(regs); {
+		end := start + 1
+		for end < len(regs) && regs[end].fc == regs[start].fc && regs[end].address == regs[end-1].address+1 {
+			end++
+		}
+		run := regs[start:end]
+		big := pairRun(run, "big")
+		little := pairRun(run, "little")
+		if countFloats(little) > countFloats(big) {
+			draft = append(draft, little...)
+		} else {
+			draft = append(draft, big...)
+		}
+		start = end
+	}
+	return draft
+}
+
+// pairRun drafts a contiguous run of registers, pairing 32-bit values in the given word order.
+func pairRun(run []*probeRegister, order string) []draftRegister {
+	var draft []draftRegister
+	for i := 0; i < len(run); i++ {
+		if i+1 < len(run) {
+			if d, ok := guessPair(run[i], run[i+1], order); ok {
+				draft = append(draft, d)
+				i++
+				continue
+			}
+		}
+		draft = append(draft, guessSingle(run[i]))
+	}
+	return draft
+}
+
+func countFloats(draft []draftRegister) int {
+	n := 0
+	for _, d := range draft {
+		if d.datatype == "float32" {
+			n++
+		}
+	}
+	return n
+}
+
+func guessPair(first, second *probeRegister, order string) (draftRegister, bool) {
+	d := draftRegister{fc: first.fc, address: first.address, wordOrder: order}
+	if isConstant(first.samples, 0) && isConstant(second.samples, 0) {
+		return d, false
+	}
+	little := order == "little"
+	floats := make([]float64, len(first.samples))
+	ints := make([]float64, len(first.samples))
+	plausible := true
+	for i := range first.samples {
+		v := combineWords(first.samples[i], second.samples[i], little)
+		floats[i] = float64(math.Float32frombits(v))
+		ints[i] = float64(v)
+		plausible = plausible && plausibleFloat(floats[i])
+	}
+	if plausible {
+		d.datatype, d.values, d.class = "float32", floats, classify3(floats)
+		return d, true
+	}
+	high, low := first.samples, second.samples
+	if little {
+		high, low = low, high
+	}
+	// A 32-bit counter: small, steady high word and a low word that moves, without running backwards.
+	if classify3(ints) == "counter" && isConstant(high, -1) && high[0] != 0 && high[0] < 0x100 && !isConstant(low, -1) {
+		d.datatype, d.values, d.class = "uint32", ints, "counter"
+		return d, true
+	}
+	return d, false
+}
+
+func guessSingle(r *probeRegister) draftRegister {
+	d := draftRegister{fc: r.fc, address: r.address, datatype: "uint16"}
+	unsigned := make([]float64, len(r.samples))
+	signed := make([]float64, len(r.samples))
+	negative := false
+	for i, w := range r.samples {
+		unsigned[i] = float64(w)
+		signed[i] = float64(int16(w))
+		// Values just below zero read as 65535, 65534, ... unsigned.
+		if w >= 0x8000 && int16(w) > -10000 {
+			negative = true
+		}
+	}
+	d.values = unsigned
+	if negative {
+		d.datatype, d.values = "int16", signed
+	}
+	d.class = classify3(d.values)
+	return d
+}
+
+// plausibleFloat accepts zero and finite magnitudes a field device would report. Integer register
+// pairs decoded as float32 mostly land on denormals or extreme exponents.
+func plausibleFloat(f float64) bool {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return false
+	}
+	if f == 0 {
+		return true
+	}
+	a := math.Abs(f)
+	return a >= 1e-3 && a <= 1e7
+}
+
+// classify3 labels samples constant, counter (never decreasing, rising at least once) or analog.
+func classify3(values []float64) string {
+	rising := false
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1] {
+			return "analog"
+		}
+		if values[i] > values[i-1] {
+			rising = true
+		}
+	}
+	if !rising {
+		return "constant"
+	}
+	return "counter"
+}
+
+// isConstant reports whether all samples are equal, and equal to want unless want is negative.
+func isConstant(samples []uint16, want int) bool {
+	for _, s := range samples {
+		if s != samples[0] {
+			return false
+		}
+	}
+	return want < 0 || int(samples[0]) == want
+}
+
+// writeDraftProfile writes the registers in the flow style of the built-in profiles, so the file can
+// be dropped into a profile directory once the names are filled in.
+func writeDraftProfile(w io.Writer, name, description string, draft []draftRegister) {
+	fmt.Fprintf(w, "name: %s\n", name)
+	fmt.Fprintf(w, "description: %s\n", description)
+	fc := draft[0].fc
+	fmt.Fprintf(w, "function_code: %d\n", fc)
+	fmt.Fprintln(w, "registers:")
+	for _, d := range draft {
+		prefix := "ir"
+		if d.fc == 3 {
+			prefix = "hr"
+		}
+		fields := []string{
+			fmt.Sprintf("register: %d", d.address),
+			fmt.Sprintf("name: %s_%d", prefix, d.address),
+		}
+		if d.fc != fc {
+			fields = append(fields, fmt.Sprintf("function_code: %d", d.fc))
+		}
+		fields = append(fields, "type: "+d.datatype)
+		if d.wordOrder == "little" {
+			fields = append(fields, "word_order: little")
+		}
+		fields = append(fields, fmt.Sprintf("description: %q", describeSamples(d)))
+		fmt.Fprintf(w, "  - {%s}\n", strings.Join(fields, ", "))
+	}
+}
+
+func describeSamples(d draftRegister) string {
+	lo, hi := d.values[0], d.values[0]
+	for _, v := range d.values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', 7, 64) }
+	if d.class == "constant" {
+		return "probe: constant " + format(lo)
+	}
+	return fmt.Sprintf("probe: %s %s..%s", d.class, format(lo), format(hi))
+}
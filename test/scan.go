@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scanResult is the outcome of one read of one slave.
+type scanResult struct {
+	SlaveID      int           `json:"slave_id"`
+	FunctionCode int           `json:"function_code"`
+	Range        registerRange `json:"range"`
+	Result       string        `json:"result"`
+	Exception    byte          `json:"exception,omitempty"`
+	Value        string        `json:"value,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	ElapsedMS    int64         `json:"elapsed_ms"`
+}
+
+// answered reports whether the slave itself responded, with data or with its own exception.
+func (r scanResult) answered() bool {
+	return r.Result == resultData || r.Result == resultException
+}
+
+// devicesConfig mirrors internal.Devices of the pollers, limited to what a scan can fill in.
+type devicesConfig struct {
+	Devices []devicesItem `yaml:"devices"`
+}
+
+type devicesItem struct {
+	Device devicesDevice `yaml:"device"`
+}
+
+type devicesDevice struct {
+	Name   string         `yaml:"name"`
+	IP     string         `yaml:"ip"`
+	Port   int            `yaml:"port"`
+	Slaves []devicesSlave `yaml:"slaves"`
+}
+
+type devicesSlave struct {
+	Name       string `yaml:"name"`
+	SlaveID    int    `yaml:"slave_id"`
+	Offset     int    `yaml:"offset"`
+	DeviceType string `yaml:"device_type,omitempty"`
+}
+
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	host := fs.String("host", "192.168.1.90", "Modbus TCP gateway address")
+	port := fs.Int("port", 502, "Modbus TCP port")
+	slaves := fs.String("slaves", "0-255", "slave IDs to try, e.g. 1-10,15")
+	rangesSpec := fs.String("ranges", "4989:10", "register blocks to read as start:count (0-based protocol addresses)")
+	fcSpec := fs.String("fc", "4", "function codes to use: 3 (holding), 4 (input) or 3,4")
+	datatype := fs.String("type", "utf8", "how to show values: u16, s16, u32, s32, f32, utf8, hex")
+	wordOrder := fs.String("word-order", "big", "32-bit word order: big (high word first) or little")
+	workers := fs.Int("workers", 4, "concurrent connections to the gateway")
+	timeout := fs.Duration("timeout", 500*time.Millisecond, "response timeout per request")
+	delay := fs.Duration("delay", 0, "pause between requests of one connection")
+	format := fs.String("format", "table", "output format: table or json")
+	all := fs.Bool("all", false, "list every read, including slaves that never answered")
+	devicesOut := fs.String("devices-out", "", "write a devices config with the slaves found to this file")
+	deviceName := fs.String("device-name", "Logger3000", "device name in the devices config")
+	deviceType := fs.String("device-type", "", "device_type (profile) given to every slave found")
+	offset := fs.Int("offset", 1, "register offset given to every slave found")
+	_ = fs.Parse(args)
+
+	ids, err := parseIDList(*slaves, 0, 255)
+	if err != nil {
+		return fmt.Errorf("slaves: %w", err)
+	}
+	ranges, err := parseRanges(*rangesSpec)
+	if err != nil {
+		return fmt.Errorf("ranges: %w", err)
+	}
+	codes, err := parseFunctionCodes(*fcSpec)
+	if err != nil {
+		return err
+	}
+	littleWords := strings.EqualFold(*wordOrder, "little")
+	if _, err := decodeValue(nil, *datatype, littleWords); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("%s not reachable: %w", addr, err)
+	}
+	_ = conn.Close()
+	status := os.Stdout
+	if *format == "json" {
+		status = os.Stderr
+	}
+	fmt.Fprintf(status, "scanning %d slave IDs on %s with %d connections\n", len(ids), addr, *workers)
+
+	started := time.Now()
+	render := func(data []byte) string {
+		v, _ := decodeValue(data, *datatype, littleWords)
+		return v
+	}
+	results := scanSlaves(addr, ids, codes, ranges, *workers, *timeout, *delay, render, func(r scanResult) {
+		if r.answered() {
+			fmt.Fprintf(status, "slave %3d fc%d %s: %s\n", r.SlaveID, r.FunctionCode, r.Range, describeResult(r))
+		}
+	})
+
+	found := foundSlaves(results)
+	fmt.Fprintf(status, "scan complete in %s: %d of %d slave IDs answered\n", time.Since(started).Round(time.Millisecond), len(found), len(ids))
+
+	shown := results
+	if !*all {
+		shown = nil
+		for _, r := range results {
+			if found[r.SlaveID] {
+				shown = append(shown, r)
+			}
+		}
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(shown); err != nil {
+			return err
+		}
+	default:
+		printScanTable(shown)
+	}
+
+	if *devicesOut != "" {
+		if err := writeDevicesConfig(*devicesOut, *deviceName, *host, *port, *deviceType, *offset, found); err != nil {
+			return fmt.Errorf("devices config: %w", err)
+		}
+		fmt.Fprintf(status, "%s written\n", *devicesOut)
+	}
+	return nil
+}
+
+// scanSlaves reads every range with every function code from each slave, spreading the slaves over
+// workers connections. render formats the data of a read; results come back sorted.
+func scanSlaves(addr string, ids, codes []int, ranges []registerRange, workers int, timeout, delay time.Duration, render func([]byte) string, progress func(scanResult)) []scanResult {
+	jobs := make(chan int)
+	var (
+		mu      sync.Mutex
+		results []scanResult
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := newSession(addr, timeout)
+			defer s.close()
+			for id := range jobs {
+				for _, fc := range codes {
+					for _, r := range ranges {
+						begin := time.Now()
+						data, err := s.read(id, fc, r.Start, r.Count)
+						res := scanResult{SlaveID: id, FunctionCode: fc, Range: r, ElapsedMS: time.Since(begin).Milliseconds()}
+						res.Result, res.Exception = classify(err)
+						switch res.Result {
+						case resultData:
+							res.Value = render(data)
+						case resultTimeout, resultError:
+							res.Error = err.Error()
+						}
+						mu.Lock()
+						results = append(results, res)
+						if progress != nil {
+							progress(res)
+						}
+						mu.Unlock()
+						if delay > 0 {
+							time.Sleep(delay)
+						}
+					}
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.SlaveID != b.SlaveID {
+			return a.SlaveID < b.SlaveID
+		}
+		if a.FunctionCode != b.FunctionCode {
+			return a.FunctionCode < b.FunctionCode
+		}
+		return a.Range.Start < b.Range.Start
+	})
+	return results
+}
+
+func foundSlaves(results []scanResult) map[int]bool {
+	found := make(map[int]bool)
+	for _, r := range results {
+		if r.answered() {
+			found[r.SlaveID] = true
+		}
+	}
+	return found
+}
+
+func describeResult(r scanResult) string {
+	switch r.Result {
+	case resultData:
+		return r.Value
+	case resultException, resultGateway:
+		return fmt.Sprintf("%s 0x%02X", r.Result, r.Exception)
+	case resultTimeout:
+		return r.Result
+	}
+	return r.Error
+}
+
+func printScanTable(results []scanResult) {
+	if len(results) == 0 {
+		fmt.Println("no slaves answered")
+		return
+	}
+	fmt.Println(strings.Repeat("-", 78))
+	fmt.Printf("%-8s | %-3s | %-10s | %-14s | %s\n", "Slave ID", "FC", "Range", "Result", "Value")
+	fmt.Println(strings.Repeat("-", 78))
+	for _, r := range results {
+		result := r.Result
+		value := r.Value
+		switch r.Result {
+		case resultException, resultGateway:
+			result = fmt.Sprintf("%s 0x%02X", r.Result, r.Exception)
+		case resultError:
+			value = r.Error
+		}
+		fmt.Printf("%-8d | %-3d | %-10s | %-14s | %s\n", r.SlaveID, r.FunctionCode, r.Range, result, value)
+	}
+	fmt.Println(strings.Repeat("-", 78))
+}
+
+// writeDevicesConfig writes the slaves found as the devices section of a poller config.
+func writeDevicesConfig(path, name, host string, port int, deviceType string, offset int, found map[int]bool) error {
+	ids := make([]int, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	prefix := "SLAVE"
+	if deviceType != "" {
+		prefix = strings.ToUpper(deviceType)
+	}
+	dev := devicesDevice{Name: name, IP: host, Port: port}
+	for _, id := range ids {
+		dev.Slaves = append(dev.Slaves, devicesSlave{
+			Name:       fmt.Sprintf("%s_%d", prefix, id),
+			SlaveID:    id,
+			Offset:     offset,
+			DeviceType: deviceType,
+		})
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(devicesConfig{Devices: []devicesItem{{Device: dev}}}); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
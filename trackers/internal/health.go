@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"common/jsonfile"
+	"common/stats"
+)
+
+// HealthConfig is the optional `tracker_health:` section. Every run each tracker's angle is compared
+// with its reference angle, trackers that stay off it or do not move while it does are flagged, and
+// stow events are counted with the wind speed that caused them.
+type HealthConfig struct {
+	Measurement string `yaml:"measurement"` // default tracker_health
+	Match       string `yaml:"match"`       // glob over <device>.<slave> holding the tracker registers; default every slave
+	Position    string `yaml:"position"`    // register name, * stands for the tracker; default position_a1_rad_*
+	Target      string `yaml:"target"`      // controller target angle, default target_angle_a1_rad_*
+	Wind        string `yaml:"wind"`        // glob over wind speed registers, the highest is used; default rsu*_wind_speed
+	Reference   string `yaml:"reference"`   // target (default; the median where a tracker has none), median, or sun (tracker_angle of solar.tracker)
+	AngleUnit   string `yaml:"angle_unit"`  // rad (default) or deg
+
+	MisalignDeg     float64 `yaml:"misalign_deg"`     // error counted as misaligned, default 5
+	MisalignMinutes int     `yaml:"misalign_minutes"` // ... for this long, default 15
+	StuckDeg        float64 `yaml:"stuck_deg"`        // largest movement still counted as not moving, default 0.5
+	StuckMinutes    int     `yaml:"stuck_minutes"`    // not moving while the reference does for this long, default 30
+
+	Stow      *StowConfig `yaml:"stow"`
+	StateFile string      `yaml:"state_file"` // default: <config>.trackers.json
+}
+
+// StowConfig detects stow events: an event starts when at least min_fraction of the trackers are
+// at the stow angle with the wind at or above wind_speed, and lasts until they leave it.
+type StowConfig struct {
+	AngleDeg     float64 `yaml:"angle_deg"`     // default 0 (flat)
+	ToleranceDeg float64 `yaml:"tolerance_deg"` // default 2
+	MinFraction  float64 `yaml:"min_fraction"`  // default 0.8
+	WindSpeed    float64 `yaml:"wind_speed"`    // m/s, required
+}
+
+// TrackerHealth is the state of one tracker in a run. Angles are in degrees.
+type TrackerHealth struct {
+	Device     string
+	Slave      string
+	Tracker    string
+	Position   float64
+	Reference  float64
+	Error      float64 // position - reference
+	Misaligned bool
+	Stuck      bool
+}
+
+// SiteHealth summarises the trackers of a run.
+type SiteHealth struct {
+	Trackers       int
+	Misaligned     int
+	Stuck          int
+	MedianPosition float64 // degrees
+	WindSpeed      float64 // highest wind speed, NaN without wind registers
+	Stow           bool
+	StowEvents     int     // events started today (local time)
+	StowWindSpeed  float64 // wind speed when the current or last event started
+	StowMaxWind    float64 // highest wind speed during the current or last event
+	StowMinutes    float64 // duration of the current or last event
+}
+
+// Tags and Fields are the InfluxDB point of the tracker.
+func (t TrackerHealth) Tags() map[string]string {
+	return map[string]string{"device": t.Device, "slave": t.Slave, "tracker": t.Tracker}
+}
+
+func (t TrackerHealth) Fields() map[string]any {
+	return map[string]any{
+		"position_deg":  t.Position,
+		"reference_deg": t.Reference,
+		"error_deg":     t.Error,
+		"misaligned":    boolInt(t.Misaligned),
+		"stuck":         boolInt(t.Stuck),
+	}
+}
+
+// Fields is the InfluxDB point of the site, tagged scope=site.
+func (s SiteHealth) Fields() map[string]any {
+	fields := map[string]any{
+		"trackers":            s.Trackers,
+		"misaligned":          s.Misaligned,
+		"stuck":               s.Stuck,
+		"median_position_deg": s.MedianPosition,
+		"stow":                boolInt(s.Stow),
+		"stow_events":         s.StowEvents,
+	}
+	if !math.IsNaN(s.WindSpeed) {
+		fields["wind_speed"] = s.WindSpeed
+	}
+	if s.StowEvents > 0 {
+		fields["stow_wind_speed"] = s.StowWindSpeed
+		fields["stow_max_wind_speed"] = s.StowMaxWind
+		fields["stow_minutes"] = s.StowMinutes
+	}
+	return fields
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type trackerState struct {
+	Position  float64   `json:"position"`  // where the tracker last moved to
+	Reference float64   `json:"reference"` // the reference at that time
+	Moved     time.Time `json:"moved"`
+	Off       time.Time `json:"off,omitzero"` // misaligned since
+}
+
+type stowState struct {
+	Active  bool      `json:"active"`
+	Start   time.Time `json:"start,omitzero"`
+	End     time.Time `json:"end,omitzero"`
+	Wind    float64   `json:"wind"`
+	MaxWind float64   `json:"max_wind"`
+	Day     string    `json:"day"`
+	Events  int       `json:"events"`
+}
+
+type healthState struct {
+	Trackers map[string]*trackerState `json:"trackers"` // <device>.<slave>.<tracker>
+	Stow     stowState                `json:"stow"`
+}
+
+// Health evaluates the tracker health of every run, keeping its state in a JSON file between runs.
+type Health struct {
+	cfg   HealthConfig
+	path  string
+	state healthState
+}
+
+// LoadHealth applies the defaults to the tracker_health section of devices and reads the state
+// file. It returns nil when the section is missing.
+func LoadHealth(devices *Devices, configPath string) (*Health, error) {
+	if devices.TrackerHealth == nil {
+		return nil, nil
+	}
+	c := *devices.TrackerHealth
+	if c.Measurement == "" {
+		c.Measurement = "tracker_health"
+	}
+	if c.Match == "" {
+		c.Match = "*"
+	}
+	if c.Position == "" {
+		c.Position = "position_a1_rad_*"
+	}
+	if c.Target == "" {
+		c.Target = "target_angle_a1_rad_*"
+	}
+	if c.Wind == "" {
+		c.Wind = "rsu*_wind_speed"
+	}
+	if c.Reference == "" {
+		c.Reference = "target"
+	}
+	if c.AngleUnit == "" {
+		c.AngleUnit = "rad"
+	}
+	if c.MisalignDeg <= 0 {
+		c.MisalignDeg = 5
+	}
+	if c.MisalignMinutes <= 0 {
+		c.MisalignMinutes = 15
+	}
+	if c.StuckDeg <= 0 {
+		c.StuckDeg = 0.5
+	}
+	if c.StuckMinutes <= 0 {
+		c.StuckMinutes = 30
+	}
+	switch c.Reference {
+	case "target", "median":
+	case "sun":
+		if devices.Solar == nil || devices.Solar.Tracker == nil {
+			return nil, fmt.Errorf("tracker_health: reference sun needs solar.tracker")
+		}
+	default:
+		return nil, fmt.Errorf("tracker_health: reference %q is not target, median or sun", c.Reference)
+	}
+	if c.AngleUnit != "rad" && c.AngleUnit != "deg" {
+		return nil, fmt.Errorf("tracker_health: angle_unit %q is not rad or deg", c.AngleUnit)
+	}
+	for _, pattern := range []string{c.Position, c.Target} {
+		if strings.Count(pattern, "*") != 1 {
+			return nil, fmt.Errorf("tracker_health: %q needs exactly one * for the tracker", pattern)
+		}
+	}
+	for _, glob := range []string{c.Match, c.Wind} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("tracker_health: %q is not a valid glob", glob)
+		}
+	}
+	if c.Stow != nil {
+		stow := *c.Stow
+		if stow.WindSpeed <= 0 {
+			return nil, fmt.Errorf("tracker_health.stow: wind_speed is required")
+		}
+		if stow.ToleranceDeg <= 0 {
+			stow.ToleranceDeg = 2
+		}
+		if stow.MinFraction <= 0 {
+			stow.MinFraction = 0.8
+		}
+		c.Stow = &stow
+	}
+
+	h := &Health{cfg: c, path: c.StateFile, state: healthState{Trackers: make(map[string]*trackerState)}}
+	if h.path == "" {
+		h.path = configPath + ".trackers.json"
+	}
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.state); err != nil {
+		return nil, fmt.Errorf("tracker state %s: %w", h.path, err)
+	}
+	if h.state.Trackers == nil {
+		h.state.Trackers = make(map[string]*trackerState)
+	}
+	return h, nil
+}
+
+// Measurement is the InfluxDB measurement the results are stored in.
+func (h *Health) Measurement() string {
+	return h.cfg.Measurement
+}
+
+// trackerID returns the part of name matched by the * of pattern.
+func trackerID(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// Evaluate runs the checks over the values of a run, named <device>.<slave>.<register> as for site
+// derived fields.
+func (h *Health) Evaluate(vars map[string]float64, ts time.Time) ([]TrackerHealth, SiteHealth) {
+	site := SiteHealth{WindSpeed: math.NaN()}
+	if h == nil {
+		return nil, site
+	}
+	scale := 1.0
+	if h.cfg.AngleUnit == "rad" {
+		scale = 180 / math.Pi
+	}
+	var trackers []TrackerHealth
+	targets := make(map[string]float64)
+	for key, v := range vars {
+		parts := strings.SplitN(key, ".", 3)
+		if len(parts) != 3 || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		dev, slave, reg := parts[0], parts[1], parts[2]
+		if ok, _ := path.Match(h.cfg.Match, dev+"."+slave); !ok {
+			continue
+		}
+		if id, ok := trackerID(h.cfg.Position, reg); ok {
+			trackers = append(trackers, TrackerHealth{Device: dev, Slave: slave, Tracker: id, Position: v * scale})
+		} else if id, ok := trackerID(h.cfg.Target, reg); ok {
+			targets[dev+"."+slave+"."+id] = v * scale
+		} else if ok, _ := path.Match(h.cfg.Wind, reg); ok && (math.IsNaN(site.WindSpeed) || v > site.WindSpeed) {
+			site.WindSpeed = v
+		}
+	}
+	sort.Slice(trackers, func(i, j int) bool {
+		a, b := trackers[i], trackers[j]
+		if a.Device+"."+a.Slave != b.Device+"."+b.Slave {
+			return a.Device+"."+a.Slave < b.Device+"."+b.Slave
+		}
+		return naturalLess(a.Tracker, b.Tracker)
+	})
+	if len(trackers) == 0 {
+		return nil, site
+	}
+
+	positions := make([]float64, len(trackers))
+	for i, t := range trackers {
+		positions[i] = t.Position
+	}
+	site.MedianPosition = stats.Median(positions)
+	site.Trackers = len(trackers)
+
+	seen := make(map[string]bool, len(trackers))
+	for i := range trackers {
+		t := &trackers[i]
+		key := t.Device + "." + t.Slave + "." + t.Tracker
+		seen[key] = true
+		t.Reference = site.MedianPosition
+		switch h.cfg.Reference {
+		case "target":
+			if target, ok := targets[key]; ok {
+				t.Reference = target
+			}
+		case "sun":
+			if angle, ok := vars["tracker_angle"]; ok {
+				t.Reference = angle
+			}
+		}
+		t.Error = t.Position - t.Reference
+
+		s := h.state.Trackers[key]
+		if s == nil {
+			s = &trackerState{Position: t.Position, Reference: t.Reference, Moved: ts}
+			h.state.Trackers[key] = s
+		}
+		if math.Abs(t.Position-s.Position) > h.cfg.StuckDeg {
+			s.Position, s.Reference, s.Moved = t.Position, t.Reference, ts
+		}
+		t.Stuck = ts.Sub(s.Moved) >= time.Duration(h.cfg.StuckMinutes)*time.Minute &&
+			math.Abs(t.Reference-s.Reference) > h.cfg.StuckDeg
+		if math.Abs(t.Error) > h.cfg.MisalignDeg {
+			if s.Off.IsZero() {
+				s.Off = ts
+			}
+			t.Misaligned = ts.Sub(s.Off) >= time.Duration(h.cfg.MisalignMinutes)*time.Minute
+		} else {
+			s.Off = time.Time{}
+		}
+		if t.Misaligned {
+			site.Misaligned++
+		}
+		if t.Stuck {
+			site.Stuck++
+		}
+	}
+	for key := range h.state.Trackers {
+		if !seen[key] {
+			delete(h.state.Trackers, key)
+		}
+	}
+	h.stow(trackers, &site, ts)
+	return trackers, site
+}
+
+// stow advances the stow event detection and fills in the stow fields of site.
+func (h *Health) stow(trackers []TrackerHealth, site *SiteHealth, ts time.Time) {
+	st := &h.state.Stow
+	if day := ts.Local().Format("2006-01-02"); st.Day != day {
+		st.Day, st.Events = day, 0
+	}
+	if h.cfg.Stow != nil {
+		stowed := 0
+		for _, t := range trackers {
+			if math.Abs(t.Position-h.cfg.Stow.AngleDeg) <= h.cfg.Stow.ToleranceDeg {
+				stowed++
+			}
+		}
+		atStow := float64(stowed) >= h.cfg.Stow.MinFraction*float64(len(trackers))
+		wind := site.WindSpeed
+		switch {
+		case !st.Active && atStow && wind >= h.cfg.Stow.WindSpeed:
+			*st = stowState{Active: true, Start: ts, Wind: wind, MaxWind: wind, Day: st.Day, Events: st.Events + 1}
+		case st.Active && atStow:
+			if wind > st.MaxWind {
+				st.MaxWind = wind
+			}
+		case st.Active:
+			st.Active = false
+			st.End = ts
+		}
+	}
+	site.Stow = st.Active
+	site.StowEvents = st.Events
+	if st.Events > 0 {
+		site.StowWindSpeed = st.Wind
+		site.StowMaxWind = st.MaxWind
+		end := st.End
+		if st.Active {
+			end = ts
+		}
+		site.StowMinutes = end.Sub(st.Start).Minutes()
+	}
+}
+
+// Save writes the state file, replacing it atomically.
+func (h *Health) Save() error {
+	if h == nil {
+		return nil
+	}
+	return jsonfile.Save(h.path, h.state)
+}
+
+// naturalLess orders tracker ids such as s2 before s10.
+func naturalLess(a, b string) bool {
+	ta, tb := strings.TrimLeft(a, "abcdefghijklmnopqrstuvwxyz_"), strings.TrimLeft(b, "abcdefghijklmnopqrstuvwxyz_")
+	if len(ta) != len(tb) && a[:len(a)-len(ta)] == b[:len(b)-len(tb)] {
+		return len(ta) < len(tb)
+	}
+	return a < b
+}
@@ -2,6 +2,11 @@ package internal
 
 import (
 	"bytes"
+	"common/alerts"
+	"common/counters"
+	"common/expr"
+	"common/profiles"
+	"common/solar"
 	"math"
 	"os"
 
@@ -9,7 +14,17 @@ import (
 )
 
 type Devices struct {
-	Devices []DeviceItem `yaml:"devices"`
+	ProfileDirs []string     `yaml:"profile_dirs"` // optional, override the built-in device profiles
+	Devices     []DeviceItem `yaml:"devices"`
+	Derived     expr.Fields  `yaml:"derived"` // optional site-level fields computed from all devices
+	// Optional state file and gap limit for counter and power registers
+	Counters counters.Config `yaml:"counters"`
+	// Optional alert rules over the values of every run, named like site derived variables
+	Alerts alerts.Config `yaml:"alerts"`
+	// Optional site location; adds the sun position (and tracker angle) as site fields
+	Solar *solar.Config `yaml:"solar"`
+	// Optional tracker misalignment, stuck and stow monitoring
+	TrackerHealth *HealthConfig `yaml:"tracker_health"`
 }
 
 type DeviceItem struct {
@@ -22,14 +37,20 @@ type Device struct {
 	Port   int      `yaml:"port"`
 	Flags  []string `yaml:"flags,omitempty"` // optional at device level
 	Slaves []Slave  `yaml:"slaves"`
+	// Optional fields computed from the device's slaves after each poll
+	Derived expr.Fields `yaml:"derived"`
 }
 
 type Slave struct {
 	Name    string `yaml:"name"`
 	SlaveID int    `yaml:"slave_id"`
 	Offset  int    `yaml:"offset"`
+	// Optional profile name (e.g. sg250hx); its registers are merged with modbus_registers
+	DeviceType string `yaml:"device_type"`
 	// No 'flags' at slave level in the new structure
 	Registers []Register `yaml:"modbus_registers"`
+	// Optional fields computed from the slave's registers after each poll
+	Derived expr.Fields `yaml:"derived"`
 }
 
 type Register struct {
@@ -42,6 +63,7 @@ type Register struct {
 	Unit         string       `yaml:"unit"`
 	Gain         float64      `yaml:"gain"`
 	Flags        RegisterFlag `yaml:"flags,omitempty"` // list of objects per register
+	Kind         string       `yaml:"kind"`            // optional: counter or power, see common/counters
 }
 
 // RegisterFlag supports heterogeneous keys used in YAML:
@@ -57,7 +79,44 @@ func LoadRegisters(path string, devices *Devices) error {
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, devices)
+	if err := yaml.Unmarshal(data, devices); err != nil {
+		return err
+	}
+	return expandProfiles(devices)
+}
+
+// expandProfiles fills the registers of slaves that set device_type from the profile library and
+// checks the register kinds. Registers listed explicitly on the slave override profile registers
+// with the same name.
+func expandProfiles(devices *Devices) error {
+	p := profiles.NewPoller(devices.ProfileDirs)
+	for di := range devices.Devices {
+		dev := &devices.Devices[di].Device
+		for si := range dev.Slaves {
+			slave := &dev.Slaves[si]
+			regs, err := profiles.Expand(p, slave.Name, slave.DeviceType, slave.Registers, profileRegister,
+				func(r Register) (string, string) { return r.Name, r.Kind })
+			if err != nil {
+				return err
+			}
+			slave.Registers = regs
+		}
+	}
+	return nil
+}
+
+func profileRegister(r profiles.PollerRegister) Register {
+	return Register{
+		Register:     r.Register,
+		FunctionCode: r.FunctionCode,
+		Name:         r.Name,
+		Description:  r.Description,
+		Words:        r.Words,
+		Datatype:     r.Datatype,
+		Unit:         r.Unit,
+		Gain:         r.Gain,
+		Kind:         r.Kind,
+	}
 }
 
 // ---------- Byte-order helpers (big-endian by byte) ----------
@@ -165,4 +224,4 @@ func U64BE(b []byte) uint64 {
 	return uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32 |
 		uint64(b[4])<<24 | uint64(b[5])<<16 | uint64(b[6])<<8 | uint64(b[7])
 }
-func S64BE(b []byte) int64 { return int64(U64BE(b)) }
\ No newline at end of file
+func S64BE(b []byte) int64 { return int64(U64BE(b)) }